@@ -4,5 +4,10 @@ go 1.16
 
 require (
 	github.com/gin-gonic/gin v1.8.2
+	github.com/prometheus/client_golang v1.11.1
 	github.com/stretchr/testify v1.8.1
+	go.opentelemetry.io/otel v1.4.1
+	go.opentelemetry.io/otel/sdk v1.4.1
+	go.opentelemetry.io/otel/trace v1.4.1
+	golang.org/x/time v0.3.0
 )
@@ -0,0 +1,345 @@
+package stream
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// BatchDatapack is a Datapack which combines several datapacks,
+// its ReadCloser reads the ReadClosers of the datapacks one by one, and closes all of them on Close.
+// It implements Metadata with the metadata entries shared by all the datapacks.
+type BatchDatapack struct {
+	ctx       context.Context
+	rc        io.ReadCloser
+	datapacks []Datapack
+}
+
+// NewBatchDatapack creates a BatchDatapack, whose Context is the context of the first datapack.
+func NewBatchDatapack(datapacks []Datapack) *BatchDatapack {
+
+	ctx := context.Background()
+	if len(datapacks) > 0 && datapacks[0].Context() != nil {
+		ctx = datapacks[0].Context()
+	}
+
+	rcs := make([]io.ReadCloser, 0, len(datapacks))
+	for i := range datapacks {
+		if rc := datapacks[i].ReadCloser(); rc != nil {
+			rcs = append(rcs, rc)
+		}
+	}
+
+	return &BatchDatapack{
+		ctx:       ctx,
+		rc:        newMultiReadCloser(rcs),
+		datapacks: datapacks,
+	}
+
+}
+
+func (b *BatchDatapack) Context() context.Context {
+	return b.ctx
+}
+
+func (b *BatchDatapack) ReadCloser() io.ReadCloser {
+	return b.rc
+}
+
+// Meta returns the metadata entries shared by all the datapacks in the batch, or nil if there's none.
+func (b *BatchDatapack) Meta() map[string]string {
+
+	var meta map[string]string
+	for i := range b.datapacks {
+		m := MetaOf(b.datapacks[i])
+		if len(m) == 0 {
+			return nil
+		}
+		if meta == nil {
+			meta = make(map[string]string, len(m))
+			for k, v := range m {
+				meta[k] = v
+			}
+			continue
+		}
+		for k, v := range meta {
+			if mv, ok := m[k]; !ok || mv != v {
+				delete(meta, k)
+			}
+		}
+	}
+
+	if len(meta) == 0 {
+		return nil
+	}
+	return meta
+
+}
+
+// Datapacks returns the datapacks in the batch.
+func (b *BatchDatapack) Datapacks() []Datapack {
+	return b.datapacks
+}
+
+// Batch collects at most size datapacks from inputStream and writes them into outputStream as one BatchDatapack,
+// a batch with fewer datapacks is written if flush elapsed since its first datapack arrived, flush <= 0 means never.
+// NOTE: the partial batch is flushed after inputStream is closed, and only WithClock and WithStageName in opts are used.
+func Batch(inputStream *IOStream, inputErr *ErrorPasser, size int, flush time.Duration, opts ...Option) (
+	*IOStream, *ErrorPasser) {
+
+	if inputStream == nil || inputErr == nil {
+		return nil, nil
+	}
+
+	if size < 1 {
+		size = 1
+	}
+
+	o := newOptions(opts...)
+	outputStream := NewIOStream()
+	outputErr := NewErrorPasserWithCap(inputErr.Cap() + 1)
+
+	go func() {
+
+		defer func() {
+			if r := recover(); r != nil {
+				inputStream.Close()
+				outputErr.Put(o.named(newPanicError("Batch", r)))
+			}
+			outputErr.Close()
+			outputStream.Close()
+		}()
+
+		batch := make([]Datapack, 0, size)
+		var timeout <-chan time.Time
+
+		emit := func() {
+			timeout = nil
+			if len(batch) == 0 {
+				return
+			}
+			if streamClosed := outputStream.Write(NewBatchDatapack(batch)); streamClosed {
+				inputStream.Close()
+			}
+			batch = make([]Datapack, 0, size)
+		}
+
+		for closed := false; !closed; {
+			select {
+			case datapack, ok := <-inputStream.dataCh:
+				inputStream.onRead(ok)
+				if !ok {
+					closed = true
+					break
+				}
+				if datapack == nil {
+					continue
+				}
+				batch = append(batch, datapack)
+				if len(batch) == 1 && flush > 0 {
+					timeout = o.clock.After(flush)
+				}
+				if len(batch) >= size {
+					emit()
+				}
+			case <-timeout:
+				emit()
+			}
+		}
+
+		emit()
+		passErrors(inputErr, outputErr)
+
+	}()
+
+	return outputStream, outputErr
+
+}
+
+type multiReadCloser struct {
+	r   io.Reader
+	rcs []io.ReadCloser
+}
+
+func newMultiReadCloser(rcs []io.ReadCloser) *multiReadCloser {
+	readers := make([]io.Reader, 0, len(rcs))
+	for i := range rcs {
+		readers = append(readers, rcs[i])
+	}
+	return &multiReadCloser{
+		r:   io.MultiReader(readers...),
+		rcs: rcs,
+	}
+}
+
+func (m *multiReadCloser) Read(p []byte) (int, error) {
+	return m.r.Read(p)
+}
+
+// Close closes all the ReadClosers, and returns the first error.
+func (m *multiReadCloser) Close() error {
+	var err error
+	for i := range m.rcs {
+		if cerr := m.rcs[i].Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// TimeWindow groups the datapacks arriving within each fixed window into one BatchDatapack,
+// a window without any datapack emits nothing, window <= 0 means the whole input is one window.
+// NOTE: the partial window is flushed after inputStream is closed, and only WithClock and WithStageName in opts are used.
+func TimeWindow(inputStream *IOStream, inputErr *ErrorPasser, window time.Duration, opts ...Option) (
+	*IOStream, *ErrorPasser) {
+
+	if inputStream == nil || inputErr == nil {
+		return nil, nil
+	}
+
+	o := newOptions(opts...)
+	outputStream := NewIOStream()
+	outputErr := NewErrorPasserWithCap(inputErr.Cap() + 1)
+
+	go func() {
+
+		defer func() {
+			if r := recover(); r != nil {
+				inputStream.Close()
+				outputErr.Put(o.named(newPanicError("TimeWindow", r)))
+			}
+			outputErr.Close()
+			outputStream.Close()
+		}()
+
+		group := make([]Datapack, 0)
+		emit := func() {
+			if len(group) == 0 {
+				return
+			}
+			if streamClosed := outputStream.Write(NewBatchDatapack(group)); streamClosed {
+				inputStream.Close()
+			}
+			group = make([]Datapack, 0)
+		}
+
+		var boundary <-chan time.Time
+		if window > 0 {
+			boundary = o.clock.After(window)
+		}
+
+		for closed := false; !closed; {
+			select {
+			case datapack, ok := <-inputStream.dataCh:
+				inputStream.onRead(ok)
+				if !ok {
+					closed = true
+					break
+				}
+				if datapack != nil {
+					group = append(group, datapack)
+				}
+			case <-boundary:
+				// start the next window before emitting, so a slow consumer doesn't shift the boundaries
+				boundary = o.clock.After(window)
+				emit()
+			}
+		}
+
+		emit()
+		passErrors(inputErr, outputErr)
+
+	}()
+
+	return outputStream, outputErr
+
+}
+
+// Rechunk concatenates the content of the datapacks from inputStream and writes it into outputStream as BytesDatapacks
+// of exactly frameSize bytes, except the last one which may be smaller, frameSize < 1 is treated as 1.
+// The context of a frame is that of the datapack where the frame starts, and errors from inputErr are passed through.
+// NOTE: the ReadCloser of each datapack is read and closed by Rechunk, a read error is put into outputErr
+// as a StreamError, and stops Rechunk as well as its upstream, the frame being filled is not written.
+func Rechunk(inputStream *IOStream, inputErr *ErrorPasser, frameSize int) (*IOStream, *ErrorPasser) {
+
+	if inputStream == nil || inputErr == nil {
+		return nil, nil
+	}
+
+	if frameSize < 1 {
+		frameSize = 1
+	}
+
+	outputStream := NewIOStream()
+	outputErr := NewErrorPasserWithCap(inputErr.Cap() + 1)
+
+	go func() {
+
+		defer func() {
+			if r := recover(); r != nil {
+				inputStream.Close()
+				outputErr.Put(newPanicError("Rechunk", r))
+			}
+			outputErr.Close()
+			outputStream.Close()
+		}()
+
+		var frame []byte
+		var frameCtx context.Context
+
+		// write emits the frame, and reports false if the consumer is gone
+		write := func() bool {
+			if streamClosed := outputStream.Write(NewBytesDatapack(frameCtx, frame)); streamClosed {
+				inputStream.Close()
+				return false
+			}
+			frame = nil
+			return true
+		}
+
+		// fill reads rc into the frames, it reports false if Rechunk should stop
+		fill := func(idx int, ctx context.Context, rc io.ReadCloser) bool {
+			defer rc.Close()
+			for {
+				if frame == nil {
+					frame, frameCtx = make([]byte, 0, frameSize), ctx
+				}
+				n, err := io.ReadFull(rc, frame[len(frame):frameSize])
+				frame = frame[:len(frame)+n]
+				if len(frame) == frameSize && !write() {
+					return false
+				}
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					return true
+				}
+				if err != nil {
+					inputStream.Close()
+					outputErr.Put(NewStreamError(StageHandler, idx, err))
+					return false
+				}
+			}
+		}
+
+		for idx := 0; ; idx++ {
+			datapack, closed := inputStream.readUntil(outputStream)
+			if closed {
+				if len(frame) > 0 {
+					write()
+				}
+				break
+			}
+			if datapack == nil {
+				continue
+			}
+			if rc := datapack.ReadCloser(); rc != nil && !fill(idx, datapack.Context(), rc) {
+				break
+			}
+		}
+
+		passErrors(inputErr, outputErr)
+
+	}()
+
+	return outputStream, outputErr
+
+}
@@ -0,0 +1,215 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatch(t *testing.T) {
+
+	cases := []struct {
+		input    []string
+		expected []string
+	}{
+		{
+			input:    []string{"a", "b", "c", "d", "e", "f"},
+			expected: []string{"abc", "def"},
+		},
+		{
+			input:    []string{"a", "b", "c", "d"},
+			expected: []string{"abc", "d"},
+		},
+		{
+			input:    []string{},
+			expected: []string{},
+		},
+	}
+
+	for _, c := range cases {
+		stream, ep := NewSafeIOStreamWriter(newStringProducer(c.input...)).Start()
+		outputStream, outputErr := Batch(stream, ep, 3, 0)
+		assert.Equal(t, c.expected, readStrings(t, outputStream))
+		assert.Nil(t, outputErr.Get())
+	}
+
+}
+
+func TestBatchDatapack(t *testing.T) {
+
+	outputStream, outputErr := Batch(
+		NewClosedIOStream(newStringDatapack("a"), newStringDatapack("b")),
+		NewClosedErrorPasser(errors.New("upstream err")),
+		2, 0,
+	)
+
+	datapack, closed := outputStream.Read()
+	assert.False(t, closed)
+	batch, ok := datapack.(*BatchDatapack)
+	assert.True(t, ok)
+	assert.Len(t, batch.Datapacks(), 2)
+	bs, err := ioutil.ReadAll(batch.ReadCloser())
+	assert.Nil(t, err)
+	assert.Equal(t, "ab", string(bs))
+	assert.Nil(t, batch.ReadCloser().Close())
+
+	_, closed = outputStream.Read()
+	assert.True(t, closed)
+	assert.Equal(t, "upstream err", outputErr.Get().Error())
+
+}
+
+func TestBatchDatapackMeta(t *testing.T) {
+
+	outputStream, _ := Batch(NewClosedIOStream(
+		newMetaDatapack("a", map[string]string{"source": "s3", "content-type": "text/plain"}),
+		newMetaDatapack("b", map[string]string{"source": "s3", "content-type": "application/json"}),
+		newMetaDatapack("c", map[string]string{"source": "s3"}),
+		newStringDatapack("d"),
+	), NewClosedErrorPasser(), 2, 0)
+
+	// only the shared entries are kept
+	datapack, _ := outputStream.Read()
+	m, ok := datapack.(Metadata)
+	assert.True(t, ok)
+	assert.Equal(t, map[string]string{"source": "s3"}, m.Meta())
+
+	// no metadata is shared with a datapack without metadata
+	datapack, _ = outputStream.Read()
+	assert.Nil(t, MetaOf(datapack))
+
+}
+
+func TestBatchFlush(t *testing.T) {
+
+	stream, ep := NewIOStream(), NewErrorPasser()
+	outputStream, outputErr := Batch(stream, ep, 3, time.Millisecond*100)
+
+	go func() {
+		stream.Write(newStringDatapack("a"))
+		stream.Write(newStringDatapack("b"))
+		time.Sleep(time.Millisecond * 300)
+		stream.Write(newStringDatapack("c"))
+		stream.Close()
+		ep.Close()
+	}()
+
+	assert.Equal(t, []string{"ab", "c"}, readStrings(t, outputStream))
+	assert.Nil(t, outputErr.Get())
+
+}
+
+func TestTimeWindow(t *testing.T) {
+
+	c := NewFakeClock(time.Unix(0, 0))
+	inputStream, inputErr := NewIOStreamWithCap(0), NewErrorPasser()
+	outputStream, outputErr := TimeWindow(inputStream, inputErr, time.Second, WithClock(c))
+
+	readGroup := func() []string {
+		datapack, closed := outputStream.Read()
+		assert.False(t, closed)
+		strs := make([]string, 0)
+		for _, dp := range datapack.(*BatchDatapack).Datapacks() {
+			bs, _ := ioutil.ReadAll(dp.ReadCloser())
+			strs = append(strs, string(bs))
+		}
+		return strs
+	}
+	advance := func() {
+		// wait for the window to be started
+		for c.Waiters() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		c.Advance(time.Second)
+	}
+
+	// the first window
+	inputStream.Write(newStringDatapack("a"))
+	inputStream.Write(newStringDatapack("b"))
+	advance()
+	assert.Equal(t, []string{"a", "b"}, readGroup())
+
+	// an empty window emits nothing
+	advance()
+
+	// the partial window is flushed on close
+	inputStream.Write(newStringDatapack("c"))
+	advance()
+	assert.Equal(t, []string{"c"}, readGroup())
+	inputStream.Write(newStringDatapack("d"))
+	inputStream.Close()
+	inputErr.Put(errors.New("upstream err"))
+	inputErr.Close()
+	assert.Equal(t, []string{"d"}, readGroup())
+
+	_, closed := outputStream.Read()
+	assert.True(t, closed)
+	assert.Equal(t, []error{errors.New("upstream err")}, outputErr.Drain())
+
+}
+
+func TestTimeWindowRealClock(t *testing.T) {
+
+	stream, ep := NewSafeIOStreamWriter(&slowProducer{p: &countProducer{cnt: 6}, interval: time.Millisecond * 40}).Start()
+	outputStream, outputErr := TimeWindow(stream, ep, time.Millisecond*100)
+
+	datapacks, errs := Collect(outputStream, outputErr)
+	assert.Empty(t, errs)
+	total := 0
+	for _, datapack := range datapacks {
+		total += len(datapack.(*BatchDatapack).Datapacks())
+	}
+	assert.Equal(t, 6, total)
+	assert.True(t, len(datapacks) > 1)
+
+}
+
+func TestRechunk(t *testing.T) {
+
+	inputs := []string{"abc", "", "defghij", "k", "lmnopqrstuvwxyz"}
+	for _, frameSize := range []int{1, 4, 5, 26, 100} {
+		packs := make([]Datapack, 0, len(inputs))
+		for _, str := range inputs {
+			packs = append(packs, newStringDatapack(str))
+		}
+		packs = append(packs, NewSimpleDatapack(context.Background(), nil))
+
+		outputStream, outputErr := Rechunk(NewClosedIOStream(packs...), NewClosedErrorPasser(), frameSize)
+		frames := readStrings(t, outputStream)
+		assert.Empty(t, outputErr.Drain())
+
+		// every frame but the last one has exactly frameSize bytes
+		for i := range frames[:len(frames)-1] {
+			assert.Len(t, frames[i], frameSize)
+		}
+		assert.LessOrEqual(t, len(frames[len(frames)-1]), frameSize)
+		assert.Equal(t, strings.Join(inputs, ""), strings.Join(frames, ""))
+	}
+
+}
+
+func TestRechunkReadErr(t *testing.T) {
+
+	// the second Read of TimeoutReader fails
+	outputStream, outputErr := Rechunk(NewClosedIOStream(
+		newStringDatapack("abcdef"),
+		NewSimpleDatapack(context.Background(), ioutil.NopCloser(iotest.TimeoutReader(bytes.NewBufferString("ghijkl")))),
+		newStringDatapack("never read"),
+	), NewClosedErrorPasser(), 4)
+
+	assert.Equal(t, []string{"abcd", "efgh"}, readStrings(t, outputStream))
+	errs := outputErr.Drain()
+	assert.Len(t, errs, 1)
+	streamErr := &StreamError{}
+	assert.True(t, errors.As(errs[0], &streamErr))
+	assert.Equal(t, 1, streamErr.Index)
+	assert.True(t, errors.Is(errs[0], iotest.ErrTimeout))
+
+}
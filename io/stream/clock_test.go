@@ -0,0 +1,97 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFakeClock(t *testing.T) {
+
+	start := time.Unix(100, 0)
+	c := NewFakeClock(start)
+	assert.Equal(t, start, c.Now())
+
+	ch1, ch2 := c.After(time.Second), c.After(time.Second*2)
+	assert.Equal(t, 2, c.Waiters())
+
+	c.Advance(time.Second)
+	assert.Equal(t, start.Add(time.Second), <-ch1)
+	select {
+	case <-ch2:
+		t.Fatal("ch2 should not fire")
+	default:
+	}
+	assert.Equal(t, 1, c.Waiters())
+
+	c.Advance(time.Second)
+	assert.Equal(t, start.Add(time.Second*2), <-ch2)
+	assert.Equal(t, 0, c.Waiters())
+
+	// fires at once
+	<-c.After(0)
+
+}
+
+// waitForWaiters blocks until a stage is waiting on c.
+func waitForWaiters(c *FakeClock, n int) {
+	for c.Waiters() < n {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBatchWithFakeClock(t *testing.T) {
+
+	c := NewFakeClock(time.Unix(0, 0))
+	inputStream, inputErr := NewIOStreamWithCap(0), NewClosedErrorPasser()
+	outputStream, outputErr := Batch(inputStream, inputErr, 10, time.Minute, WithClock(c))
+
+	inputStream.Write(newStringDatapack("a"))
+	inputStream.Write(newStringDatapack("b"))
+	waitForWaiters(c, 1)
+
+	// not flushed until the clock says so
+	c.Advance(time.Second * 59)
+	_, closed := outputStream.TryRead()
+	assert.False(t, closed)
+
+	c.Advance(time.Second)
+	datapack, closed := outputStream.Read()
+	assert.False(t, closed)
+	assert.Len(t, datapack.(*BatchDatapack).Datapacks(), 2)
+
+	inputStream.Close()
+	_, closed = outputStream.Read()
+	assert.True(t, closed)
+	assert.Empty(t, outputErr.Drain())
+
+}
+
+func TestHandlerTimeoutWithFakeClock(t *testing.T) {
+
+	c := NewFakeClock(time.Unix(0, 0))
+	handlerCtxDone := make(chan struct{})
+	stream, ep := NewSafeIOStreamWriter(&countProducer{cnt: 1}).Start()
+	safeHandler := NewSafeIOStreamHandler(stream, ep, func(ctx context.Context, rc io.ReadCloser) error {
+		ioutil.ReadAll(rc)
+		<-ctx.Done()
+		close(handlerCtxDone)
+		return ctx.Err()
+	}, nil, WithHandlerTimeout(time.Hour), WithClock(c))
+	_, outputErr := safeHandler.BuildStream()
+	safeHandler.Start()
+
+	waitForWaiters(c, 1)
+	c.Advance(time.Hour)
+
+	errs := outputErr.Drain()
+	assert.Len(t, errs, 1)
+	assert.True(t, errors.Is(errs[0], ErrHandlerTimeout))
+	<-handlerCtxDone
+
+}
@@ -0,0 +1,115 @@
+package stream
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Gzip compresses every datapack from inputStream, reading the ReadCloser of the output datapack yields gzip-compressed
+// bytes, level is the same as gzip.NewWriterLevel, an invalid level fails the first datapack.
+// NOTE: the compression is done lazily while reading through an io.Pipe, so the payload is never buffered as a whole,
+// the output datapack must be read or closed, otherwise the source ReadCloser is not closed.
+func Gzip(inputStream *IOStream, inputErr *ErrorPasser, level int) (*IOStream, *ErrorPasser) {
+	return Map(inputStream, inputErr, func(datapack Datapack) (Datapack, error) {
+		if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+			return nil, fmt.Errorf("gzip: invalid compression level: %d", level)
+		}
+		return NewSimpleDatapack(datapack.Context(), newGzipReadCloser(datapack.ReadCloser(), level)), nil
+	})
+}
+
+// Gunzip decompresses every datapack from inputStream, it's the reverse of Gzip.
+// NOTE: the gzip header is read lazily on the first Read, so a malformed payload is reported by Read rather than here.
+func Gunzip(inputStream *IOStream, inputErr *ErrorPasser) (*IOStream, *ErrorPasser) {
+	return Map(inputStream, inputErr, func(datapack Datapack) (Datapack, error) {
+		return NewSimpleDatapack(datapack.Context(), newGunzipReadCloser(datapack.ReadCloser())), nil
+	})
+}
+
+// gzipReadCloser compresses src in a goroutine which is started on the first Read.
+type gzipReadCloser struct {
+	src   io.ReadCloser
+	level int
+	once  *sync.Once
+	pr    *io.PipeReader
+	pw    *io.PipeWriter
+}
+
+func newGzipReadCloser(src io.ReadCloser, level int) *gzipReadCloser {
+	pr, pw := io.Pipe()
+	return &gzipReadCloser{
+		src:   src,
+		level: level,
+		once:  &sync.Once{},
+		pr:    pr,
+		pw:    pw,
+	}
+}
+
+func (g *gzipReadCloser) Read(p []byte) (int, error) {
+	g.once.Do(func() {
+		go g.compress()
+	})
+	return g.pr.Read(p)
+}
+
+func (g *gzipReadCloser) Close() error {
+	started := true
+	g.once.Do(func() {
+		started = false
+	})
+	// the compressing goroutine gets io.ErrClosedPipe and returns
+	g.pr.Close()
+	if !started {
+		return g.src.Close()
+	}
+	return nil
+}
+
+func (g *gzipReadCloser) compress() {
+	defer g.src.Close()
+	gw, err := gzip.NewWriterLevel(g.pw, g.level)
+	if err != nil {
+		g.pw.CloseWithError(err)
+		return
+	}
+	if _, err = io.Copy(gw, g.src); err != nil {
+		g.pw.CloseWithError(err)
+		return
+	}
+	g.pw.CloseWithError(gw.Close())
+}
+
+// gunzipReadCloser creates the gzip.Reader on the first Read, since gzip.NewReader reads the header eagerly.
+type gunzipReadCloser struct {
+	src io.ReadCloser
+	gr  *gzip.Reader
+	err error
+}
+
+func newGunzipReadCloser(src io.ReadCloser) *gunzipReadCloser {
+	return &gunzipReadCloser{
+		src: src,
+	}
+}
+
+func (g *gunzipReadCloser) Read(p []byte) (int, error) {
+	if g.err != nil {
+		return 0, g.err
+	}
+	if g.gr == nil {
+		if g.gr, g.err = gzip.NewReader(g.src); g.err != nil {
+			return 0, g.err
+		}
+	}
+	return g.gr.Read(p)
+}
+
+func (g *gunzipReadCloser) Close() error {
+	if g.gr != nil {
+		g.gr.Close()
+	}
+	return g.src.Close()
+}
@@ -0,0 +1,90 @@
+package stream
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGzipRoundTrip(t *testing.T) {
+
+	payloads := []string{
+		"",
+		"hello world",
+		strings.Repeat("sinfra", 10000),
+	}
+	random := make([]byte, 1<<20)
+	rand.Read(random)
+	payloads = append(payloads, string(random))
+
+	stream, ep := NewSafeIOStreamWriter(newStringProducer(payloads...)).Start()
+	stream, ep = Gzip(stream, ep, gzip.BestSpeed)
+	stream, ep = Gunzip(stream, ep)
+
+	results := readStrings(t, stream)
+	assert.Empty(t, ep.Drain())
+	assert.Equal(t, len(payloads), len(results))
+	for i := range payloads {
+		assert.True(t, payloads[i] == results[i], "payload %d mismatched", i)
+	}
+
+}
+
+func TestGzip(t *testing.T) {
+
+	stream, ep := NewSafeIOStreamWriter(newStringProducer(strings.Repeat("a", 1024))).Start()
+	stream, ep = Gzip(stream, ep, gzip.BestCompression)
+
+	compressed := readStrings(t, stream)
+	assert.Empty(t, ep.Drain())
+	assert.Len(t, compressed, 1)
+	assert.Less(t, len(compressed[0]), 1024)
+	t.Logf("compressed size = %d", len(compressed[0]))
+
+	gr, err := gzip.NewReader(bytes.NewBufferString(compressed[0]))
+	assert.Nil(t, err)
+	bs, err := ioutil.ReadAll(gr)
+	assert.Nil(t, err)
+	assert.Equal(t, strings.Repeat("a", 1024), string(bs))
+
+}
+
+func TestGzipInvalidLevel(t *testing.T) {
+
+	stream, ep := NewSafeIOStreamWriter(newStringProducer("a", "b")).Start()
+	stream, ep = Gzip(stream, ep, 100)
+
+	assert.Empty(t, readStrings(t, stream))
+	errs := ep.Drain()
+	assert.Len(t, errs, 1)
+	assert.Contains(t, errs[0].Error(), "invalid compression level")
+
+}
+
+func TestGzipCloseWithoutRead(t *testing.T) {
+
+	src := &closeRecorder{Reader: bytes.NewBufferString("hello")}
+	rc := newGzipReadCloser(src, gzip.DefaultCompression)
+	assert.Nil(t, rc.Close())
+	assert.True(t, src.closed)
+
+}
+
+func TestGunzipMalformed(t *testing.T) {
+
+	stream, ep := Gunzip(NewClosedIOStream(NewSimpleDatapack(context.Background(),
+		ioutil.NopCloser(bytes.NewBufferString("definitely not a gzip payload")))), NewClosedErrorPasser())
+
+	datapack, closed := stream.Read()
+	assert.False(t, closed)
+	_, err := ioutil.ReadAll(datapack.ReadCloser())
+	assert.Equal(t, gzip.ErrHeader, err)
+	assert.Empty(t, ep.Drain())
+
+}
@@ -0,0 +1,246 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// MergeContext returns a context which is derived from both parent and child:
+//  1. Value looks up child first, then parent, so the values of child win.
+//  2. Deadline is the earlier one of them.
+//  3. Done is closed once either of them is done, Err returns the error of child if it is done, otherwise that of parent.
+//
+// A nil parent or child is ignored.
+// NOTE: if both of them can be canceled, a goroutine is started on the first call of Done (or Err),
+// which returns once either of them is done.
+func MergeContext(parent, child context.Context) context.Context {
+	ctx, _ := mergeContext(parent, child, false)
+	return ctx
+}
+
+// mergeContext is the same as MergeContext, but if releasable, the returned release stops the goroutine watching
+// parent and child, after which the context is no longer done by them, unless it's done already.
+// It's used for the context of each datapack, so a datapack handled long before its parent is done doesn't keep
+// a goroutine alive until then.
+func mergeContext(parent, child context.Context, releasable bool) (ctx context.Context, release func()) {
+	if parent == nil {
+		return child, func() {}
+	}
+	if child == nil || child == parent {
+		return parent, func() {}
+	}
+	c := &mergedContext{
+		parent: parent,
+		child:  child,
+		once:   &sync.Once{},
+	}
+	if !releasable {
+		return c, func() {}
+	}
+	c.released = make(chan struct{})
+	releaseOnce := &sync.Once{}
+	return c, func() {
+		releaseOnce.Do(func() {
+			close(c.released)
+		})
+	}
+}
+
+type mergedContext struct {
+	parent, child context.Context
+	once          *sync.Once
+	done          <-chan struct{}
+	// released is closed by the release of mergeContext, it's nil if the context is not releasable
+	released chan struct{}
+}
+
+func (c *mergedContext) Deadline() (deadline time.Time, ok bool) {
+	pd, pok := c.parent.Deadline()
+	cd, cok := c.child.Deadline()
+	switch {
+	case pok && cok:
+		if pd.Before(cd) {
+			return pd, true
+		}
+		return cd, true
+	case pok:
+		return pd, true
+	default:
+		return cd, cok
+	}
+}
+
+func (c *mergedContext) Done() <-chan struct{} {
+	c.once.Do(func() {
+		pDone, cDone := c.parent.Done(), c.child.Done()
+		switch {
+		case pDone == nil:
+			c.done = cDone
+		case cDone == nil:
+			c.done = pDone
+		case c.isReleased():
+			// not watched any more, it's done only if it's done already
+			done := make(chan struct{})
+			if c.parent.Err() != nil || c.child.Err() != nil {
+				close(done)
+			}
+			c.done = done
+		default:
+			done := make(chan struct{})
+			go func() {
+				select {
+				case <-pDone:
+				case <-cDone:
+				case <-c.released:
+					// a nil released blocks forever, so an unreleasable context is watched until it's done
+					return
+				}
+				close(done)
+			}()
+			c.done = done
+		}
+	})
+	return c.done
+}
+
+func (c *mergedContext) Err() error {
+	if c.isReleased() {
+		select {
+		case <-c.Done():
+		default:
+			return nil
+		}
+	}
+	if err := c.child.Err(); err != nil {
+		return err
+	}
+	return c.parent.Err()
+}
+
+func (c *mergedContext) isReleased() bool {
+	if c.released == nil {
+		return false
+	}
+	select {
+	case <-c.released:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *mergedContext) Value(key interface{}) interface{} {
+	if v := c.child.Value(key); v != nil {
+		return v
+	}
+	return c.parent.Value(key)
+}
+
+// DatapackContextDecorator returns a Processor which forwards every datapack from inputStream with its context replaced
+// by fn(ctx), e.g. to add a request ID or tenant, the payload (and the metadata) is left untouched,
+// errors from inputErr are passed through.
+// NOTE: a panic in fn is recovered and put into outputErr as an error.
+func DatapackContextDecorator(fn func(context.Context) context.Context) Processor {
+	return func(inputStream *IOStream, inputErr *ErrorPasser) (*IOStream, *ErrorPasser) {
+
+		if inputStream == nil || inputErr == nil {
+			return nil, nil
+		}
+
+		outputStream := NewIOStream()
+		outputErr := NewErrorPasserWithCap(inputErr.Cap() + 1)
+
+		go func() {
+
+			defer func() {
+				if r := recover(); r != nil {
+					inputStream.Close()
+					outputErr.Put(newPanicError("DatapackContextDecorator", r))
+				}
+				outputErr.Close()
+				outputStream.Close()
+			}()
+
+			for {
+				datapack, closed := inputStream.readUntil(outputStream)
+				if closed {
+					break
+				}
+				if datapack != nil {
+					datapack = withContext(datapack, fn(datapack.Context()))
+				}
+				if streamClosed := outputStream.Write(datapack); streamClosed {
+					inputStream.Close()
+					break
+				}
+			}
+
+			passErrors(inputErr, outputErr)
+
+		}()
+
+		return outputStream, outputErr
+
+	}
+}
+
+// contextDatapack overrides the context of a Datapack.
+type contextDatapack struct {
+	Datapack
+	ctx context.Context
+	// release releases ctx if it's made by mergeContext, see releaseContext
+	release func()
+}
+
+func withContext(datapack Datapack, ctx context.Context) Datapack {
+	return &contextDatapack{
+		Datapack: datapack,
+		ctx:      ctx,
+	}
+}
+
+func (d *contextDatapack) Context() context.Context {
+	return d.ctx
+}
+
+// withMergedContext wraps datapack with its context merged into parent, which is released by releaseContext.
+func withMergedContext(datapack Datapack, parent context.Context) Datapack {
+	ctx, release := mergeContext(parent, datapack.Context(), true)
+	return &contextDatapack{
+		Datapack: datapack,
+		ctx:      ctx,
+		release:  release,
+	}
+}
+
+// releaseContext releases the merged contexts of datapack (of all the wrapping layers) once it has been handled,
+// so they stop watching their parents, see mergeContext.
+func releaseContext(datapack Datapack) {
+	for {
+		d, ok := datapack.(*contextDatapack)
+		if !ok {
+			return
+		}
+		if d.release != nil {
+			d.release()
+		}
+		datapack = d.Datapack
+	}
+}
+
+// ctxKeyStreamCtx is the key of the context.Context which limits the run of the SafeIOStreamWriter of the datapack.
+type ctxKeyStreamCtx struct{}
+
+// streamCanceled reports whether err is caused by the stream-level context in ctx being done.
+func streamCanceled(ctx context.Context, err error) bool {
+	if ctx == nil {
+		return false
+	}
+	streamCtx, ok := ctx.Value(ctxKeyStreamCtx{}).(context.Context)
+	if !ok || streamCtx.Err() == nil {
+		return false
+	}
+	return errors.Is(err, streamCtx.Err())
+}
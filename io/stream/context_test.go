@@ -0,0 +1,177 @@
+package stream
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type ctxKey string
+
+func TestMergeContext(t *testing.T) {
+
+	parent, cancelParent := context.WithCancel(context.WithValue(context.Background(), ctxKey("k"), "parent"))
+	defer cancelParent()
+	deadline := time.Now().Add(time.Hour)
+	child, cancelChild := context.WithDeadline(context.WithValue(context.Background(), ctxKey("k"), "child"), deadline)
+	defer cancelChild()
+	child = context.WithValue(child, ctxKey("child"), "only")
+
+	ctx := MergeContext(context.WithValue(parent, ctxKey("parent"), "only"), child)
+	assert.Equal(t, "child", ctx.Value(ctxKey("k")))
+	assert.Equal(t, "only", ctx.Value(ctxKey("child")))
+	assert.Equal(t, "only", ctx.Value(ctxKey("parent")))
+	d, ok := ctx.Deadline()
+	assert.True(t, ok)
+	assert.Equal(t, deadline, d)
+	assert.Nil(t, ctx.Err())
+
+	// canceled by parent
+	cancelParent()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("merged context should be done")
+	}
+	assert.Equal(t, context.Canceled, ctx.Err())
+
+	// the earlier deadline wins
+	early, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	ctx = MergeContext(early, child)
+	d, _ = ctx.Deadline()
+	assert.True(t, d.Before(deadline))
+	<-ctx.Done()
+	assert.Equal(t, context.DeadlineExceeded, ctx.Err())
+
+	// nil and uncancelable
+	assert.Equal(t, child, MergeContext(nil, child))
+	assert.Equal(t, child, MergeContext(child, nil))
+	assert.Equal(t, child.Done(), MergeContext(context.Background(), child).Done())
+
+}
+
+func TestWriterWithContext(t *testing.T) {
+
+	deadline := time.Now().Add(time.Hour)
+	dpCtx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	ctx := context.WithValue(context.Background(), ctxKey("request_id"), "req-1")
+	datapacks := []Datapack{
+		NewSimpleDatapack(dpCtx, ioutil.NopCloser(nil)),
+		NewSimpleDatapack(nil, ioutil.NopCloser(nil)),
+	}
+	stream, ep := NewSafeIOStreamWriterWithContext(ctx, NewSliceDatapackProducer(datapacks)).Start()
+
+	handled := 0
+	safeHandler := NewSafeIOStreamHandler(stream, ep, func(ctx context.Context, rc io.ReadCloser) error {
+		assert.Equal(t, "req-1", ctx.Value(ctxKey("request_id")))
+		if handled == 0 {
+			d, ok := ctx.Deadline()
+			assert.True(t, ok)
+			assert.Equal(t, deadline, d)
+		}
+		handled++
+		return nil
+	}, nil)
+	_, outputErr := safeHandler.BuildStream()
+	safeHandler.Start()
+
+	assert.Empty(t, outputErr.Drain())
+	assert.Equal(t, 2, handled)
+
+}
+
+func TestMergedContextReleased(t *testing.T) {
+
+	goroutineCnt := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	datapacks := make([]Datapack, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		dpCtx, cancelDatapack := context.WithCancel(context.Background())
+		defer cancelDatapack()
+		datapacks = append(datapacks, NewSimpleDatapack(dpCtx, ioutil.NopCloser(strings.NewReader("a"))))
+	}
+	stream, ep := NewSafeIOStreamWriterWithContext(ctx, NewSliceDatapackProducer(datapacks)).Start()
+
+	handled := make([]context.Context, 0, len(datapacks))
+	safeHandler := NewSafeIOStreamHandler(stream, ep, func(ctx context.Context, rc io.ReadCloser) error {
+		// watching both the writer and the datapack
+		select {
+		case <-ctx.Done():
+		default:
+		}
+		handled = append(handled, ctx)
+		return rc.Close()
+	}, nil)
+	_, outputErr := safeHandler.BuildStream()
+	safeHandler.Start()
+	safeHandler.Wait()
+	assert.Empty(t, outputErr.Drain())
+	assert.Len(t, handled, 1000)
+
+	// the watching goroutines are gone although neither the writer nor the datapacks are canceled
+	assertNoGoroutineLeak(t, goroutineCnt)
+
+	// a released context is not done by its parents any more
+	cancel()
+	assert.Nil(t, handled[0].Err())
+
+	// while an unreleased one is
+	parent, cancelParent := context.WithCancel(context.Background())
+	child, cancelChild := context.WithCancel(context.Background())
+	defer cancelChild()
+	merged, release := mergeContext(parent, child, true)
+	<-merged.Done()
+	cancelParent()
+	<-merged.Done()
+	assert.Equal(t, context.Canceled, merged.Err())
+	release()
+	assert.Equal(t, context.Canceled, merged.Err())
+
+}
+
+func TestDatapackContextDecorator(t *testing.T) {
+
+	decorate := DatapackContextDecorator(func(ctx context.Context) context.Context {
+		return context.WithValue(ctx, ctxKey("tenant"), "t-1")
+	})
+
+	upstream := context.WithValue(context.Background(), ctxKey("request_id"), "req-1")
+	inputStream := NewClosedIOStream(
+		NewSimpleDatapack(upstream, ioutil.NopCloser(strings.NewReader("a"))),
+		NewSimpleDatapack(upstream, ioutil.NopCloser(strings.NewReader("b"))),
+	)
+	stream, ep := decorate(inputStream, NewClosedErrorPasser())
+
+	handled := make([]string, 0)
+	safeHandler := NewSafeIOStreamHandler(stream, ep, func(ctx context.Context, rc io.ReadCloser) error {
+		// the injected value is visible along with the upstream ones
+		assert.Equal(t, "t-1", ctx.Value(ctxKey("tenant")))
+		assert.Equal(t, "req-1", ctx.Value(ctxKey("request_id")))
+		bs, err := ioutil.ReadAll(rc)
+		handled = append(handled, string(bs))
+		return err
+	}, nil)
+	_, outputErr := safeHandler.BuildStream()
+	safeHandler.Start()
+
+	assert.Empty(t, outputErr.Drain())
+	assert.Equal(t, []string{"a", "b"}, handled)
+
+	// the metadata is kept
+	stream, _ = decorate(NewClosedIOStream(newMetaDatapack("c", map[string]string{"k": "v"})), NewClosedErrorPasser())
+	datapack, _ := stream.Read()
+	assert.Equal(t, map[string]string{"k": "v"}, MetaOf(datapack))
+	assert.Equal(t, "t-1", datapack.Context().Value(ctxKey("tenant")))
+
+}
@@ -0,0 +1,229 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+)
+
+// Sized is implemented by the datapacks which know their size in bytes without reading the content.
+type Sized interface {
+	Len() int
+}
+
+// BytesDatapack is a Datapack holding its content in memory.
+type BytesDatapack struct {
+	ctx context.Context
+	bs  []byte
+}
+
+func NewBytesDatapack(ctx context.Context, bs []byte) *BytesDatapack {
+	return &BytesDatapack{
+		ctx: ctx,
+		bs:  bs,
+	}
+}
+
+func (b *BytesDatapack) Context() context.Context {
+	return b.ctx
+}
+
+// ReadCloser returns a new ReadCloser over the content every time it's called.
+func (b *BytesDatapack) ReadCloser() io.ReadCloser {
+	return ioutil.NopCloser(bytes.NewReader(b.bs))
+}
+
+// Len returns the size of the content in bytes.
+func (b *BytesDatapack) Len() int {
+	return len(b.bs)
+}
+
+// Bytes returns the content, which should not be modified.
+func (b *BytesDatapack) Bytes() []byte {
+	return b.bs
+}
+
+// PooledDatapackFactory hands out the byte buffers from a sync.Pool for building PooledBytesDatapacks,
+// the buffer of a PooledBytesDatapack is returned to the pool once its ReadCloser is closed.
+type PooledDatapackFactory struct {
+	// inUse is accessed atomically, and kept first for the 64-bit alignment
+	inUse int64
+	pool  *sync.Pool
+}
+
+// NewPooledDatapackFactory creates a PooledDatapackFactory whose new buffers have the capacity of size bytes.
+func NewPooledDatapackFactory(size int) *PooledDatapackFactory {
+	if size < 0 {
+		size = 0
+	}
+	return &PooledDatapackFactory{
+		pool: &sync.Pool{
+			New: func() interface{} {
+				bs := make([]byte, 0, size)
+				return &bs
+			},
+		},
+	}
+}
+
+// Acquire returns an empty buffer from the pool, which should be handed to NewDatapack after being filled.
+func (f *PooledDatapackFactory) Acquire() []byte {
+	atomic.AddInt64(&f.inUse, 1)
+	return (*f.pool.Get().(*[]byte))[:0]
+}
+
+// NewDatapack creates a PooledBytesDatapack holding bs, which should be got from Acquire.
+func (f *PooledDatapackFactory) NewDatapack(ctx context.Context, bs []byte) *PooledBytesDatapack {
+	d := &PooledBytesDatapack{
+		ctx: ctx,
+		bs:  bs,
+	}
+	d.rc = &pooledReadCloser{
+		Reader:  bytes.NewReader(bs),
+		once:    &sync.Once{},
+		release: func() { f.release(d) },
+	}
+	return d
+}
+
+// InUse returns the number of the buffers acquired but not returned yet.
+func (f *PooledDatapackFactory) InUse() int64 {
+	return atomic.LoadInt64(&f.inUse)
+}
+
+func (f *PooledDatapackFactory) release(d *PooledBytesDatapack) {
+	bs := d.bs
+	d.bs = nil
+	f.pool.Put(&bs)
+	atomic.AddInt64(&f.inUse, -1)
+}
+
+// PooledBytesDatapack is a Datapack holding its content in a buffer of a PooledDatapackFactory,
+// closing its ReadCloser returns the buffer to the pool.
+// WARN: the buffer is reused by other datapacks after Close, so reading the content (including the slice got from
+// Bytes) after Close is undefined, the handler must be done with the content before closing the ReadCloser.
+type PooledBytesDatapack struct {
+	ctx context.Context
+	bs  []byte
+	rc  *pooledReadCloser
+}
+
+func (p *PooledBytesDatapack) Context() context.Context {
+	return p.ctx
+}
+
+// ReadCloser returns the same ReadCloser over the content every time it's called, since the buffer can only be
+// returned to the pool once.
+func (p *PooledBytesDatapack) ReadCloser() io.ReadCloser {
+	return p.rc
+}
+
+// Len returns the size of the content in bytes.
+func (p *PooledBytesDatapack) Len() int {
+	return len(p.bs)
+}
+
+// Bytes returns the content, which should not be modified or used after Close.
+func (p *PooledBytesDatapack) Bytes() []byte {
+	return p.bs
+}
+
+// pooledReadCloser calls release on the first Close.
+type pooledReadCloser struct {
+	*bytes.Reader
+	once    *sync.Once
+	release func()
+}
+
+func (p *pooledReadCloser) Close() error {
+	p.once.Do(p.release)
+	return nil
+}
+
+// Metadata is implemented by the datapacks carrying key/value metadata along with the content,
+// such as content-type, source or trace IDs.
+type Metadata interface {
+	Meta() map[string]string
+}
+
+// MetaDatapack is a Datapack carrying key/value metadata.
+type MetaDatapack struct {
+	ctx  context.Context
+	rc   io.ReadCloser
+	meta map[string]string
+}
+
+// NewMetaDatapack creates a MetaDatapack, meta is not copied and should not be modified afterwards.
+func NewMetaDatapack(ctx context.Context, rc io.ReadCloser, meta map[string]string) *MetaDatapack {
+	return &MetaDatapack{
+		ctx:  ctx,
+		rc:   rc,
+		meta: meta,
+	}
+}
+
+func (m *MetaDatapack) Context() context.Context {
+	return m.ctx
+}
+
+func (m *MetaDatapack) ReadCloser() io.ReadCloser {
+	return m.rc
+}
+
+// Meta returns the metadata, which should not be modified.
+func (m *MetaDatapack) Meta() map[string]string {
+	return m.meta
+}
+
+// MetaOf returns the metadata of datapack if it implements Metadata, otherwise nil.
+func MetaOf(datapack Datapack) map[string]string {
+	switch d := datapack.(type) {
+	case Metadata:
+		return d.Meta()
+	case *contextDatapack:
+		// the context overriding wrapper of SafeIOStreamWriter hides the methods of the datapack
+		return MetaOf(d.Datapack)
+	}
+	return nil
+}
+
+// ReadAllAndClose reads the whole content of datapack and closes its ReadCloser, the close happens even on read error.
+// NOTE: the read error wins if both reading and closing failed, a nil datapack or ReadCloser gives nil, nil.
+func ReadAllAndClose(datapack Datapack) ([]byte, error) {
+	if datapack == nil {
+		return nil, nil
+	}
+	rc := datapack.ReadCloser()
+	if rc == nil {
+		return nil, nil
+	}
+	bs, err := ioutil.ReadAll(rc)
+	if closeErr := rc.Close(); err == nil {
+		err = closeErr
+	}
+	return bs, err
+}
+
+// CloneDatapack reads the whole content of d into memory once (and closes its ReadCloser), then returns two independent
+// datapacks with the same context and metadata, each of which has its own ReadCloser over the content,
+// so closing one of them doesn't affect the other. A datapack with a nil ReadCloser is returned as is for both.
+// NOTE: the whole content is held in memory until both clones are released, which costs the size of the content
+// once (the clones share the bytes), so it's not suitable for huge datapacks.
+func CloneDatapack(d Datapack) (Datapack, Datapack, error) {
+	if d == nil || d.ReadCloser() == nil {
+		return d, d, nil
+	}
+	bs, err := ReadAllAndClose(d)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx := d.Context()
+	if meta := MetaOf(d); meta != nil {
+		return NewMetaDatapack(ctx, ioutil.NopCloser(bytes.NewReader(bs)), meta),
+			NewMetaDatapack(ctx, ioutil.NopCloser(bytes.NewReader(bs)), meta), nil
+	}
+	return NewBytesDatapack(ctx, bs), NewBytesDatapack(ctx, bs), nil
+}
@@ -0,0 +1,39 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+var payload = bytes.Repeat([]byte("x"), 4096)
+
+func BenchmarkBytesDatapack(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		bs := make([]byte, 0, len(payload))
+		bs = append(bs, payload...)
+		datapack := NewBytesDatapack(context.Background(), bs)
+		rc := datapack.ReadCloser()
+		if _, err := io.Copy(ioutil.Discard, rc); err != nil {
+			b.Error(err)
+		}
+		rc.Close()
+	}
+}
+
+func BenchmarkPooledBytesDatapack(b *testing.B) {
+	b.ReportAllocs()
+	factory := NewPooledDatapackFactory(len(payload))
+	for i := 0; i < b.N; i++ {
+		bs := append(factory.Acquire(), payload...)
+		datapack := factory.NewDatapack(context.Background(), bs)
+		rc := datapack.ReadCloser()
+		if _, err := io.Copy(ioutil.Discard, rc); err != nil {
+			b.Error(err)
+		}
+		rc.Close()
+	}
+}
@@ -0,0 +1,216 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBytesDatapack(t *testing.T) {
+
+	ctx := context.WithValue(context.Background(), "key", "value")
+	datapack := NewBytesDatapack(ctx, []byte("hello world"))
+
+	var sized Sized = datapack
+	assert.Equal(t, 11, sized.Len())
+	assert.Equal(t, "value", datapack.Context().Value("key"))
+
+	// Len doesn't consume the content, and each ReadCloser reads from the beginning
+	for i := 0; i < 2; i++ {
+		bs, err := ioutil.ReadAll(datapack.ReadCloser())
+		assert.Nil(t, err)
+		assert.Equal(t, "hello world", string(bs))
+		assert.Equal(t, 11, datapack.Len())
+	}
+
+	assert.Equal(t, 0, NewBytesDatapack(ctx, nil).Len())
+
+}
+
+type errCloser struct {
+	io.Reader
+	closed   bool
+	closeErr error
+}
+
+func (e *errCloser) Close() error {
+	e.closed = true
+	return e.closeErr
+}
+
+func TestReadAllAndClose(t *testing.T) {
+
+	rc := &errCloser{Reader: bytes.NewBufferString("hello")}
+	bs, err := ReadAllAndClose(NewSimpleDatapack(context.Background(), rc))
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(bs))
+	assert.True(t, rc.closed)
+
+	// close error is surfaced
+	closeErr := errors.New("close failed")
+	rc = &errCloser{Reader: bytes.NewBufferString("hello"), closeErr: closeErr}
+	bs, err = ReadAllAndClose(NewSimpleDatapack(context.Background(), rc))
+	assert.Equal(t, closeErr, err)
+	assert.Equal(t, "hello", string(bs))
+
+	// closed on read error, and the read error wins
+	readErr := errors.New("read failed")
+	rc = &errCloser{Reader: iotest.ErrReader(readErr), closeErr: closeErr}
+	_, err = ReadAllAndClose(NewSimpleDatapack(context.Background(), rc))
+	assert.Equal(t, readErr, err)
+	assert.True(t, rc.closed)
+
+	// nil
+	bs, err = ReadAllAndClose(NewSimpleDatapack(context.Background(), nil))
+	assert.Nil(t, bs)
+	assert.Nil(t, err)
+
+}
+
+func newMetaDatapack(str string, meta map[string]string) Datapack {
+	return NewMetaDatapack(context.Background(), ioutil.NopCloser(bytes.NewBufferString(str)), meta)
+}
+
+func TestMetaDatapack(t *testing.T) {
+
+	inputStream, inputErr := NewSafeIOStreamWriter(NewSliceDatapackProducer([]Datapack{
+		newMetaDatapack("a", map[string]string{"content-type": "text/plain"}),
+		newMetaDatapack("b", map[string]string{"content-type": "application/json"}),
+		newStringDatapack("c"),
+	})).Start()
+
+	seen := make([]string, 0)
+	mapped, mappedErr := Map(inputStream, inputErr, func(datapack Datapack) (Datapack, error) {
+		// fn sees the metadata of the input
+		if m, ok := datapack.(Metadata); ok {
+			seen = append(seen, m.Meta()["content-type"])
+		}
+		bs, err := ReadAllAndClose(datapack)
+		if err != nil {
+			return nil, err
+		}
+		if string(bs) == "b" {
+			// the metadata of the result wins
+			return NewMetaDatapack(datapack.Context(), ioutil.NopCloser(bytes.NewReader(bs)),
+				map[string]string{"content-type": "text/csv"}), nil
+		}
+		return NewBytesDatapack(datapack.Context(), bytes.ToUpper(bs)), nil
+	})
+	outputStream, outputErr := Filter(mapped, mappedErr, func(Datapack) bool {
+		return true
+	})
+
+	results := make(map[string]Datapack)
+	for {
+		datapack, closed := outputStream.Read()
+		if closed {
+			break
+		}
+		bs, err := ReadAllAndClose(datapack)
+		assert.Nil(t, err)
+		results[string(bs)] = datapack
+	}
+	assert.Nil(t, outputErr.Get())
+	assert.Equal(t, []string{"text/plain", "application/json"}, seen)
+
+	m, ok := results["A"].(Metadata)
+	assert.True(t, ok)
+	assert.Equal(t, map[string]string{"content-type": "text/plain"}, m.Meta())
+	assert.Equal(t, map[string]string{"content-type": "text/csv"}, MetaOf(results["b"]))
+	_, ok = results["C"].(Metadata)
+	assert.False(t, ok)
+	assert.Nil(t, MetaOf(results["C"]))
+	assert.Nil(t, MetaOf(nil))
+
+}
+
+func TestPooledBytesDatapack(t *testing.T) {
+
+	factory := NewPooledDatapackFactory(16)
+	datapacks := make([]*PooledBytesDatapack, 0)
+	for i := 0; i < 3; i++ {
+		bs := append(factory.Acquire(), "hello"...)
+		datapacks = append(datapacks, factory.NewDatapack(context.Background(), bs))
+	}
+	assert.Equal(t, int64(3), factory.InUse())
+
+	var sized Sized = datapacks[0]
+	assert.Equal(t, 5, sized.Len())
+	assert.Equal(t, "hello", string(datapacks[0].Bytes()))
+
+	outputStream, outputErr := Map(NewClosedIOStream(datapacks[0], datapacks[1], datapacks[2]), NewClosedErrorPasser(),
+		func(datapack Datapack) (Datapack, error) {
+			// consume the content before closing
+			bs, err := ReadAllAndClose(datapack)
+			return NewBytesDatapack(datapack.Context(), bytes.ToUpper(bs)), err
+		})
+	assert.Equal(t, []string{"HELLO", "HELLO", "HELLO"}, readStrings(t, outputStream))
+	assert.Empty(t, outputErr.Drain())
+
+	// all the buffers are returned, closing again is a no-op
+	assert.Equal(t, int64(0), factory.InUse())
+	assert.Nil(t, datapacks[0].ReadCloser().Close())
+	assert.Equal(t, int64(0), factory.InUse())
+
+	// a returned buffer comes back empty
+	bs := factory.Acquire()
+	assert.Empty(t, bs)
+	assert.GreaterOrEqual(t, cap(bs), 16)
+	assert.Equal(t, int64(1), factory.InUse())
+
+}
+
+func TestCloneDatapack(t *testing.T) {
+
+	ctx := context.WithValue(context.Background(), "key", "value")
+	rc := &errCloser{Reader: bytes.NewBufferString("hello world")}
+	first, second, err := CloneDatapack(NewSimpleDatapack(ctx, rc))
+	assert.Nil(t, err)
+	assert.True(t, rc.closed)
+	assert.Equal(t, "value", first.Context().Value("key"))
+	assert.Equal(t, "value", second.Context().Value("key"))
+
+	// reading or closing one clone doesn't affect the other
+	firstRC := first.ReadCloser()
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(firstRC, buf)
+	assert.Nil(t, err)
+	assert.Nil(t, firstRC.Close())
+	bs, err := ReadAllAndClose(second)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello world", string(bs))
+	assert.Equal(t, "hello", string(buf))
+
+	// metadata is kept
+	first, second, err = CloneDatapack(newMetaDatapack("hi", map[string]string{"k": "v"}))
+	assert.Nil(t, err)
+	for _, clone := range []Datapack{first, second} {
+		assert.Equal(t, map[string]string{"k": "v"}, MetaOf(clone))
+		bs, err := ReadAllAndClose(clone)
+		assert.Nil(t, err)
+		assert.Equal(t, "hi", string(bs))
+	}
+
+	// read error, the source is still closed
+	readErr := errors.New("read failed")
+	rc = &errCloser{Reader: iotest.ErrReader(readErr)}
+	first, second, err = CloneDatapack(NewSimpleDatapack(ctx, rc))
+	assert.Equal(t, readErr, err)
+	assert.Nil(t, first)
+	assert.Nil(t, second)
+	assert.True(t, rc.closed)
+
+	// nil ReadCloser
+	empty := NewSimpleDatapack(ctx, nil)
+	first, second, err = CloneDatapack(empty)
+	assert.Nil(t, err)
+	assert.Equal(t, Datapack(empty), first)
+	assert.Equal(t, Datapack(empty), second)
+
+}
@@ -1,7 +1,31 @@
 package stream
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+)
+
+// OverflowPolicy decides what ErrorPasser.Put does when the buffer is full.
+type OverflowPolicy int
+
+const (
+	// Block makes Put block until there's room, it's the default policy.
+	Block OverflowPolicy = iota
+	// DropOldest makes Put drop the oldest buffered error to make room, so the most recent errors are kept.
+	DropOldest
+	// DropNewest makes Put drop the error being put.
+	DropNewest
+)
+
 type ErrorPasser struct {
-	errCh chan error
+	// dropped is accessed atomically, keep it 64-bit aligned
+	dropped int64
+	errCh   chan error
+	policy  OverflowPolicy
 }
 
 func NewErrorPasser() *ErrorPasser {
@@ -20,6 +44,13 @@ func NewErrorPasserWithCap(maxErrCnt int) *ErrorPasser {
 	}
 }
 
+// NewErrorPasserWithPolicy is the same as NewErrorPasserWithCap, but Put follows policy when the buffer is full.
+func NewErrorPasserWithPolicy(maxErrCnt int, policy OverflowPolicy) *ErrorPasser {
+	ep := NewErrorPasserWithCap(maxErrCnt)
+	ep.policy = policy
+	return ep
+}
+
 func NewClosedErrorPasser(errs ...error) *ErrorPasser {
 	ep := NewErrorPasserWithCap(len(errs))
 	for i := range errs {
@@ -40,6 +71,17 @@ func (e *ErrorPasser) Check() (err error, done bool) {
 	}
 }
 
+// CheckContext blocks until an error is got, the ErrorPasser is closed or ctx is done.
+// NOTE: if done or canceled, err is nil.
+func (e *ErrorPasser) CheckContext(ctx context.Context) (err error, done bool, canceled bool) {
+	select {
+	case err, ok := <-e.errCh:
+		return err, !ok, false
+	case <-ctx.Done():
+		return nil, false, true
+	}
+}
+
 func (e *ErrorPasser) Get() error {
 	for err := range e.errCh {
 		return err
@@ -47,14 +89,293 @@ func (e *ErrorPasser) Get() error {
 	return nil
 }
 
+// Drain blocks until the ErrorPasser is closed, and returns all the errors in order.
+func (e *ErrorPasser) Drain() []error {
+	errs := make([]error, 0, len(e.errCh))
+	for err := range e.errCh {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// Put puts err into the ErrorPasser, with the default policy it blocks while the buffer is full,
+// until someone takes an error out of it, see OverflowPolicy for the others.
+// NOTE: with DropOldest, an unbuffered ErrorPasser drops err if there's no reader waiting.
+// WARN: Put panics if the ErrorPasser is closed.
 func (e *ErrorPasser) Put(err error) {
-	e.errCh <- err
+	switch e.policy {
+	case DropNewest:
+		if !e.TryPut(err) {
+			atomic.AddInt64(&e.dropped, 1)
+		}
+	case DropOldest:
+		for !e.TryPut(err) {
+			select {
+			case <-e.errCh:
+				atomic.AddInt64(&e.dropped, 1)
+			default:
+				if cap(e.errCh) == 0 {
+					atomic.AddInt64(&e.dropped, 1)
+					return
+				}
+			}
+		}
+	default:
+		e.errCh <- err
+	}
+}
+
+// TryPut try put err in a non-block way, it returns false without putting when the buffer is full, no matter the policy.
+// WARN: TryPut panics if the ErrorPasser is closed.
+func (e *ErrorPasser) TryPut(err error) bool {
+	select {
+	case e.errCh <- err:
+		return true
+	default:
+		return false
+	}
 }
 
+// Close closes the ErrorPasser, the errors already buffered are not discarded,
+// Check / Get / Drain still deliver them in order before reporting done.
+// WARN: Close must be called only once, by the writer, after its last Put.
 func (e *ErrorPasser) Close() {
 	close(e.errCh)
 }
 
+// Reset makes the ErrorPasser open and empty again with its original capacity and policy, so it can be reused,
+// the Dropped counter is reset as well.
+// WARN: Reset must not be called while the ErrorPasser is being used by any reader or writer.
+func (e *ErrorPasser) Reset() {
+	e.errCh = make(chan error, cap(e.errCh))
+	atomic.StoreInt64(&e.dropped, 0)
+}
+
+// Dropped returns the number of errors dropped by Put because of the policy.
+func (e *ErrorPasser) Dropped() int {
+	return int(atomic.LoadInt64(&e.dropped))
+}
+
 func (e *ErrorPasser) Cap() int {
 	return cap(e.errCh)
 }
+
+// MergeErrorPassers forwards the non-nil errors from all the passers into the returned ErrorPasser,
+// which is closed after all the passers are closed, the nil passers are ignored,
+// so an already closed one is returned if there's no passer.
+// NOTE: the errors from the same passer keep their order, while the ones across passers are interleaved.
+func MergeErrorPassers(passers ...*ErrorPasser) *ErrorPasser {
+
+	total, cnt := 0, 0
+	for _, ep := range passers {
+		if ep != nil {
+			total, cnt = total+ep.Cap(), cnt+1
+		}
+	}
+	if cnt == 0 {
+		return NewClosedErrorPasser()
+	}
+	merged := NewErrorPasserWithCap(total)
+
+	wg := &sync.WaitGroup{}
+	for _, ep := range passers {
+		if ep == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(ep *ErrorPasser) {
+			defer wg.Done()
+			passErrors(ep, merged)
+		}(ep)
+	}
+
+	go func() {
+		wg.Wait()
+		merged.Close()
+	}()
+
+	return merged
+
+}
+
+// passErrors puts all the non-nil errors from src into dst until src is closed.
+func passErrors(src, dst *ErrorPasser) {
+	for _, err := range src.Drain() {
+		if err != nil {
+			dst.Put(err)
+		}
+	}
+}
+
+// passErrorsContext is the same as passErrors, but once ctx is done it only passes the errors already buffered in src,
+// so an upstream which never closes src can't block it forever.
+func passErrorsContext(ctx context.Context, src, dst *ErrorPasser) {
+	for {
+		err, done, canceled := src.CheckContext(ctx)
+		if done {
+			return
+		}
+		if canceled {
+			break
+		}
+		if err != nil {
+			dst.Put(err)
+		}
+	}
+	for len(src.errCh) > 0 {
+		err, done := src.Check()
+		if done {
+			return
+		}
+		if err != nil {
+			dst.Put(err)
+		}
+	}
+}
+
+const (
+	StageProducer = "producer"
+	StageHandler  = "handler"
+)
+
+// StreamError is an error with the stage which it comes from, and the zero-based index of the datapack being processed.
+type StreamError struct {
+	Stage string
+	Index int
+	Err   error
+}
+
+func NewStreamError(stage string, idx int, err error) *StreamError {
+	return &StreamError{
+		Stage: stage,
+		Index: idx,
+		Err:   err,
+	}
+}
+
+func (e *StreamError) Error() string {
+	return fmt.Sprintf("stage = %s, datapack index = %d, err = %v", e.Stage, e.Index, e.Err)
+}
+
+func (e *StreamError) Unwrap() error {
+	return e.Err
+}
+
+// PanicError is the error of a panic recovered by a stage, which carries the stack where it panicked, e.g.
+//
+//	var pe *PanicError
+//	if errors.As(err, &pe) {
+//		log.Printf("%v\n%s", pe, pe.Stack())
+//	}
+type PanicError struct {
+	// Name is the name of the stage which recovered the panic.
+	Name string
+	// Value is the value passed to panic.
+	Value interface{}
+	stack []byte
+}
+
+// newPanicError should be called in the deferred function which recovers r, so the stack still has the panicking frames.
+func newPanicError(name string, r interface{}) *PanicError {
+	return newPanicErrorWithStack(name, r, debug.Stack())
+}
+
+func newPanicErrorWithStack(name string, r interface{}, stack []byte) *PanicError {
+	return &PanicError{
+		Name:  name,
+		Value: r,
+		stack: stack,
+	}
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("%s panicked, err = %v", e.Name, e.Value)
+}
+
+// Stack returns the stack trace of the goroutine which panicked, as formatted by debug.Stack.
+func (e *PanicError) Stack() []byte {
+	return e.stack
+}
+
+// Retryable is implemented by the errors which know whether the failed call is worth retrying.
+type Retryable interface {
+	Retryable() bool
+}
+
+// fatalError marks an error as fatal, so it's never continued or retried.
+type fatalError struct {
+	err error
+}
+
+// MarkFatal wraps err so IsFatal reports true for it, a nil err gives nil.
+// A fatal error stops SafeIOStreamHandler even with WithContinueOnError, and is never retried by WithHandlerRetry.
+func MarkFatal(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &fatalError{err: err}
+}
+
+func (e *fatalError) Error() string {
+	return e.err.Error()
+}
+
+func (e *fatalError) Unwrap() error {
+	return e.err
+}
+
+func (e *fatalError) Fatal() bool {
+	return true
+}
+
+func (e *fatalError) Retryable() bool {
+	return false
+}
+
+// IsFatal reports whether any error in the chain of err has a `Fatal() bool` method returning true, e.g. by MarkFatal.
+func IsFatal(err error) bool {
+	var f interface {
+		Fatal() bool
+	}
+	return errors.As(err, &f) && f.Fatal()
+}
+
+// IsRetryable reports whether err is worth retrying: a fatal error is not, otherwise the first error in the chain
+// implementing Retryable (or `Temporary() bool`, like net.Error) decides, and the other errors are retryable.
+func IsRetryable(err error) bool {
+	if err == nil || IsFatal(err) {
+		return false
+	}
+	for ; err != nil; err = errors.Unwrap(err) {
+		if r, ok := err.(Retryable); ok {
+			return r.Retryable()
+		}
+		if t, ok := err.(interface{ Temporary() bool }); ok {
+			return t.Temporary()
+		}
+	}
+	return true
+}
+
+// NamedError is an error raised by a stage named by WithStageName, it usually wraps a StreamError.
+type NamedError struct {
+	Name string
+	Err  error
+}
+
+func (e *NamedError) Error() string {
+	return fmt.Sprintf("stage=%q: %v", e.Name, e.Err)
+}
+
+func (e *NamedError) Unwrap() error {
+	return e.Err
+}
+
+// StageName returns the name of the outermost NamedError in the chain of err, or "" if there's none.
+func StageName(err error) string {
+	var named *NamedError
+	if errors.As(err, &named) {
+		return named.Name
+	}
+	return ""
+}
@@ -1,7 +1,10 @@
 package stream
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"io"
 	"testing"
 	"time"
 
@@ -82,3 +85,311 @@ func TestCheckAndClose(t *testing.T) {
 	t.Logf("check again after 'check done', result: err = %v, done = %v", err, done)
 
 }
+
+func TestCloseKeepsBuffered(t *testing.T) {
+
+	ep := NewErrorPasserWithCap(3)
+	for i := 0; i < 3; i++ {
+		ep.Put(fmt.Errorf("err %d", i))
+	}
+	ep.Close()
+
+	for i := 0; i < 3; i++ {
+		err, done := ep.Check()
+		assert.False(t, done)
+		assert.Equal(t, fmt.Sprintf("err %d", i), err.Error())
+	}
+	err, done := ep.Check()
+	assert.Nil(t, err)
+	assert.True(t, done)
+
+}
+
+func TestDrain(t *testing.T) {
+
+	ep := NewErrorPasser()
+
+	go func() {
+		for i := 0; i < 5; i++ {
+			ep.Put(fmt.Errorf("err %d", i))
+		}
+		ep.Close()
+	}()
+
+	errs := ep.Drain()
+	assert.Len(t, errs, 5)
+	for i := range errs {
+		assert.Equal(t, fmt.Sprintf("err %d", i), errs[i].Error())
+	}
+
+	// drain again
+	errs = ep.Drain()
+	assert.NotNil(t, errs)
+	assert.Empty(t, errs)
+
+	errs = NewClosedErrorPasser().Drain()
+	assert.NotNil(t, errs)
+	assert.Empty(t, errs)
+
+}
+
+func TestCheckContext(t *testing.T) {
+
+	// normal read
+	ep := NewErrorPasser()
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		ep.Put(errors.New("an err after 100ms"))
+	}()
+	err, done, canceled := ep.CheckContext(context.Background())
+	assert.NotNil(t, err)
+	assert.False(t, done)
+	assert.False(t, canceled)
+
+	// closed
+	ep.Close()
+	err, done, canceled = ep.CheckContext(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, done)
+	assert.False(t, canceled)
+
+	// canceled
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	err, done, canceled = NewErrorPasser().CheckContext(ctx)
+	assert.Nil(t, err)
+	assert.False(t, done)
+	assert.True(t, canceled)
+
+	// race between canceling and putting
+	for i := 0; i < 100; i++ {
+		ep := NewErrorPasser()
+		ctx, cancel := context.WithCancel(context.Background())
+		go ep.Put(errors.New("racing err"))
+		go cancel()
+		err, done, canceled := ep.CheckContext(ctx)
+		assert.False(t, done)
+		assert.True(t, (err != nil) != canceled, "either got an error or canceled")
+		cancel()
+	}
+
+}
+
+func TestReset(t *testing.T) {
+
+	ep := NewErrorPasserWithCap(3)
+	ep.Put(errors.New("err before reset"))
+	ep.Close()
+
+	ep.Reset()
+	assert.Equal(t, 3, ep.Cap())
+
+	// behaves like a fresh one
+	err, done := ep.Check()
+	assert.Nil(t, err)
+	assert.False(t, done)
+
+	for i := 0; i < 3; i++ {
+		ep.Put(fmt.Errorf("err %d", i))
+	}
+	ep.Close()
+	assert.Equal(t, []error{errors.New("err 0"), errors.New("err 1"), errors.New("err 2")}, ep.Drain())
+
+	err, done = ep.Check()
+	assert.Nil(t, err)
+	assert.True(t, done)
+
+}
+
+func TestTryPut(t *testing.T) {
+
+	ep := NewErrorPasserWithCap(2)
+	assert.True(t, ep.TryPut(errors.New("1")))
+	assert.True(t, ep.TryPut(errors.New("2")))
+
+	// full
+	assert.False(t, ep.TryPut(errors.New("3")))
+
+	// make room
+	assert.Equal(t, "1", ep.Get().Error())
+	assert.True(t, ep.TryPut(errors.New("3")))
+	ep.Close()
+
+	errs := ep.Drain()
+	assert.Len(t, errs, 2)
+	assert.Equal(t, "2", errs[0].Error())
+	assert.Equal(t, "3", errs[1].Error())
+
+	// unbuffered without a reader
+	assert.False(t, NewErrorPasserWithCap(0).TryPut(errors.New("1")))
+
+}
+
+func TestOverflowPolicy(t *testing.T) {
+
+	putAll := func(ep *ErrorPasser, n int) {
+		for i := 1; i <= n; i++ {
+			ep.Put(fmt.Errorf("%d", i))
+		}
+		ep.Close()
+	}
+
+	// DropOldest keeps the most recent errors
+	ep := NewErrorPasserWithPolicy(2, DropOldest)
+	putAll(ep, 5)
+	assert.Equal(t, []error{errors.New("4"), errors.New("5")}, ep.Drain())
+	assert.Equal(t, 3, ep.Dropped())
+
+	// DropNewest keeps the first errors
+	ep = NewErrorPasserWithPolicy(2, DropNewest)
+	putAll(ep, 5)
+	assert.Equal(t, []error{errors.New("1"), errors.New("2")}, ep.Drain())
+	assert.Equal(t, 3, ep.Dropped())
+
+	// Block blocks until there's room
+	ep = NewErrorPasserWithPolicy(2, Block)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		putAll(ep, 3)
+	}()
+	select {
+	case <-done:
+		t.Fatal("Put should block")
+	case <-time.After(time.Millisecond * 100):
+	}
+	assert.Equal(t, []error{errors.New("1"), errors.New("2"), errors.New("3")}, ep.Drain())
+	<-done
+	assert.Equal(t, 0, ep.Dropped())
+
+	// unbuffered without a reader
+	ep = NewErrorPasserWithPolicy(0, DropOldest)
+	putAll(ep, 2)
+	assert.Empty(t, ep.Drain())
+	assert.Equal(t, 2, ep.Dropped())
+
+	// Reset keeps the policy
+	ep = NewErrorPasserWithPolicy(1, DropNewest)
+	ep.Put(errors.New("1"))
+	ep.Put(errors.New("2"))
+	assert.Equal(t, 1, ep.Dropped())
+	ep.Reset()
+	assert.Equal(t, 0, ep.Dropped())
+	putAll(ep, 2)
+	assert.Equal(t, []error{errors.New("1")}, ep.Drain())
+	assert.Equal(t, 1, ep.Dropped())
+
+}
+
+func TestMergeErrorPassers(t *testing.T) {
+
+	e1, e2, e3 := NewErrorPasser(), NewErrorPasserWithCap(0), NewErrorPasserWithCap(3)
+	merged := MergeErrorPassers(e1, nil, e2, e3)
+
+	go func() {
+		e3.Put(errors.New("3-1"))
+		e1.Put(errors.New("1-1"))
+		e1.Close()
+		e2.Put(errors.New("2-1"))
+		e3.Put(nil)
+		e3.Put(errors.New("3-2"))
+		e3.Close()
+		time.Sleep(time.Millisecond * 50)
+		e2.Put(errors.New("2-2"))
+		e2.Close()
+	}()
+
+	errs := merged.Drain()
+	assert.Len(t, errs, 5)
+
+	// the order within a passer is kept
+	order := make(map[byte][]string)
+	for _, err := range errs {
+		order[err.Error()[0]] = append(order[err.Error()[0]], err.Error())
+	}
+	assert.Equal(t, []string{"1-1"}, order['1'])
+	assert.Equal(t, []string{"2-1", "2-2"}, order['2'])
+	assert.Equal(t, []string{"3-1", "3-2"}, order['3'])
+
+	// empty
+	for _, ep := range []*ErrorPasser{MergeErrorPassers(), MergeErrorPassers(nil)} {
+		err, done := ep.Check()
+		assert.Nil(t, err)
+		assert.True(t, done)
+	}
+
+}
+
+type retryableErr bool
+
+func (r retryableErr) Error() string {
+	return fmt.Sprintf("retryable = %v", bool(r))
+}
+
+func (r retryableErr) Retryable() bool {
+	return bool(r)
+}
+
+type temporaryErr struct{}
+
+func (temporaryErr) Error() string   { return "temporary" }
+func (temporaryErr) Temporary() bool { return false }
+
+func TestErrorClassification(t *testing.T) {
+
+	plain := errors.New("plain")
+	assert.Nil(t, MarkFatal(nil))
+	fatal := MarkFatal(plain)
+	assert.Equal(t, "plain", fatal.Error())
+	assert.True(t, errors.Is(fatal, plain))
+
+	assert.True(t, IsFatal(fatal))
+	assert.True(t, IsFatal(fmt.Errorf("wrapped, %w", fatal)))
+	assert.True(t, IsFatal(NewStreamError(StageHandler, 0, fatal)))
+	assert.False(t, IsFatal(plain))
+	assert.False(t, IsFatal(nil))
+
+	assert.True(t, IsRetryable(plain))
+	assert.False(t, IsRetryable(nil))
+	assert.False(t, IsRetryable(fatal))
+	assert.False(t, IsRetryable(fmt.Errorf("wrapped, %w", retryableErr(false))))
+	assert.True(t, IsRetryable(fmt.Errorf("wrapped, %w", retryableErr(true))))
+	assert.False(t, IsRetryable(temporaryErr{}))
+
+}
+
+func TestPanicError(t *testing.T) {
+
+	// recovered by an operator
+	outputStream, outputErr := Filter(NewClosedIOStream(newStringDatapack("a")), NewClosedErrorPasser(),
+		func(Datapack) bool {
+			panic("filter panic")
+		})
+	readStrings(t, outputStream)
+	err := outputErr.Get()
+	var pe *PanicError
+	assert.True(t, errors.As(err, &pe))
+	assert.Equal(t, "Filter panicked, err = filter panic", err.Error())
+	assert.Equal(t, "Filter", pe.Name)
+	assert.Equal(t, "filter panic", pe.Value)
+	// the stack has the panicking frame
+	assert.Contains(t, string(pe.Stack()), "TestPanicError.func1")
+
+	// recovered by the handler, in the goroutine of WithHandlerTimeout as well
+	for _, opts := range [][]Option{nil, {WithHandlerTimeout(time.Second)}} {
+		safeHandler := NewSafeIOStreamHandler(NewClosedIOStream(newStringDatapack("a")), NewClosedErrorPasser(),
+			func(context.Context, io.ReadCloser) error {
+				panic("handler panic")
+			}, nil, opts...)
+		_, outputErr = safeHandler.BuildStream()
+		safeHandler.Start()
+		safeHandler.Wait()
+		err = outputErr.Get()
+		t.Logf("err = %v", err)
+		pe = nil
+		assert.True(t, errors.As(err, &pe))
+		assert.Equal(t, "handler panic", pe.Value)
+		assert.Contains(t, string(pe.Stack()), "TestPanicError.func2")
+	}
+
+}
@@ -0,0 +1,363 @@
+package stream
+
+import (
+	"sync"
+)
+
+// FanOut distributes the datapacks from inputStream into n output streams in a round-robin way,
+// every error from inputErr is put into all the output ErrorPassers.
+// NOTE: ordering is only preserved within each output stream, and a slow consumer blocks the others.
+func FanOut(inputStream *IOStream, inputErr *ErrorPasser, n int) ([]*IOStream, []*ErrorPasser) {
+
+	if inputStream == nil || inputErr == nil {
+		return nil, nil
+	}
+
+	if n < 1 {
+		n = 1
+	}
+
+	outputStreams := make([]*IOStream, n)
+	outputErrs := make([]*ErrorPasser, n)
+	for i := 0; i < n; i++ {
+		outputStreams[i] = NewIOStream()
+		outputErrs[i] = NewErrorPasserWithCap(inputErr.Cap() + 1)
+	}
+
+	go func() {
+
+		defer func() {
+			if r := recover(); r != nil {
+				inputStream.Close()
+				err := newPanicError("FanOut", r)
+				for i := range outputErrs {
+					outputErrs[i].Put(err)
+				}
+			}
+			for i := range outputStreams {
+				outputErrs[i].Close()
+				outputStreams[i].Close()
+			}
+		}()
+
+		for idx := 0; ; {
+			datapack, closed := inputStream.Read()
+			if closed {
+				break
+			}
+
+			// skip the outputs which are closed by their consumers
+			written := false
+			for i := 0; i < n && !written; i++ {
+				written = !outputStreams[idx].Write(datapack)
+				idx = (idx + 1) % n
+			}
+
+			if !written {
+				inputStream.Close()
+				break
+			}
+		}
+
+		for _, err := range inputErr.Drain() {
+			if err == nil {
+				continue
+			}
+			for i := range outputErrs {
+				outputErrs[i].Put(err)
+			}
+		}
+
+	}()
+
+	return outputStreams, outputErrs
+
+}
+
+// FanIn merges the datapacks from all the inputStreams into one output stream in their arrival order,
+// errors from all the inputErrs are put into one output ErrorPasser, nil inputs are skipped.
+// NOTE: the outputs are closed after all the inputs are closed.
+func FanIn(inputStreams []*IOStream, inputErrs []*ErrorPasser) (*IOStream, *ErrorPasser) {
+
+	errCap := 1
+	for _, inputErr := range inputErrs {
+		if inputErr != nil {
+			errCap += inputErr.Cap()
+		}
+	}
+
+	outputStream := NewIOStream()
+	outputErr := NewErrorPasserWithCap(errCap)
+
+	wg := &sync.WaitGroup{}
+
+	for _, inputStream := range inputStreams {
+		if inputStream == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(inputStream *IOStream) {
+			defer func() {
+				if r := recover(); r != nil {
+					inputStream.Close()
+					outputErr.Put(newPanicError("FanIn", r))
+				}
+				wg.Done()
+			}()
+			for {
+				datapack, closed := inputStream.readUntil(outputStream)
+				if closed {
+					return
+				}
+				if streamClosed := outputStream.Write(datapack); streamClosed {
+					inputStream.Close()
+					return
+				}
+			}
+		}(inputStream)
+	}
+
+	for _, inputErr := range inputErrs {
+		if inputErr == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(inputErr *ErrorPasser) {
+			defer wg.Done()
+			passErrors(inputErr, outputErr)
+		}(inputErr)
+	}
+
+	go func() {
+		wg.Wait()
+		outputErr.Close()
+		outputStream.Close()
+	}()
+
+	return outputStream, outputErr
+
+}
+
+// Tee writes every datapack from inputStream into both output streams, errors are put into both output ErrorPassers.
+// NOTE: both outputs get the very same datapack, whose ReadCloser can only be read once, so only one consumer should read it,
+// use TeeBuffered if both consumers need the content.
+func Tee(inputStream *IOStream, inputErr *ErrorPasser) (*IOStream, *ErrorPasser, *IOStream, *ErrorPasser) {
+	return tee("Tee", inputStream, inputErr, func(datapack Datapack) (Datapack, Datapack, error) {
+		return datapack, datapack, nil
+	})
+}
+
+// TeeBuffered is the same as Tee, but splits each datapack by CloneDatapack, so both outputs get the same context,
+// metadata and content, with their own ReadCloser over the content.
+func TeeBuffered(inputStream *IOStream, inputErr *ErrorPasser) (*IOStream, *ErrorPasser, *IOStream, *ErrorPasser) {
+	return tee("TeeBuffered", inputStream, inputErr, CloneDatapack)
+}
+
+func tee(name string, inputStream *IOStream, inputErr *ErrorPasser, split func(Datapack) (Datapack, Datapack, error)) (
+	*IOStream, *ErrorPasser, *IOStream, *ErrorPasser) {
+
+	if inputStream == nil || inputErr == nil {
+		return nil, nil, nil, nil
+	}
+
+	outputStreams := []*IOStream{NewIOStream(), NewIOStream()}
+	outputErrs := []*ErrorPasser{NewErrorPasserWithCap(inputErr.Cap() + 2), NewErrorPasserWithCap(inputErr.Cap() + 2)}
+
+	putErr := func(err error) {
+		for i := range outputErrs {
+			outputErrs[i].Put(err)
+		}
+	}
+
+	go func() {
+
+		defer func() {
+			if r := recover(); r != nil {
+				inputStream.Close()
+				putErr(newPanicError(name, r))
+			}
+			for i := range outputStreams {
+				outputErrs[i].Close()
+				outputStreams[i].Close()
+			}
+		}()
+
+		for {
+			datapack, closed := inputStream.Read()
+			if closed {
+				break
+			}
+
+			first, second, err := split(datapack)
+			if err != nil {
+				inputStream.Close()
+				putErr(err)
+				break
+			}
+
+			firstClosed := outputStreams[0].Write(first)
+			secondClosed := outputStreams[1].Write(second)
+			if firstClosed && secondClosed {
+				inputStream.Close()
+				break
+			}
+		}
+
+		for _, err := range inputErr.Drain() {
+			if err != nil {
+				putErr(err)
+			}
+		}
+
+	}()
+
+	return outputStreams[0], outputErrs[0], outputStreams[1], outputErrs[1]
+
+}
+
+// Partition routes every datapack from inputStream into matched if pred returns true, otherwise into rest,
+// errors from inputErr are put into both matchedErr and restErr, and both outputs are closed after inputStream is closed.
+// NOTE: a panic in pred is recovered and put into both output ErrorPassers as an error, the datapacks routed to
+// an output closed by its consumer are discarded, and a slow consumer blocks the other one.
+func Partition(inputStream *IOStream, inputErr *ErrorPasser, pred func(Datapack) bool) (
+	matched *IOStream, matchedErr *ErrorPasser, rest *IOStream, restErr *ErrorPasser) {
+
+	if inputStream == nil || inputErr == nil {
+		return nil, nil, nil, nil
+	}
+
+	matched, rest = NewIOStream(), NewIOStream()
+	matchedErr, restErr = NewErrorPasserWithCap(inputErr.Cap()+1), NewErrorPasserWithCap(inputErr.Cap()+1)
+
+	putErr := func(err error) {
+		matchedErr.Put(err)
+		restErr.Put(err)
+	}
+
+	go func() {
+
+		defer func() {
+			if r := recover(); r != nil {
+				inputStream.Close()
+				putErr(newPanicError("Partition", r))
+			}
+			matchedErr.Close()
+			matched.Close()
+			restErr.Close()
+			rest.Close()
+		}()
+
+		matchedClosed, restClosed := false, false
+		for {
+			datapack, closed := inputStream.Read()
+			if closed {
+				break
+			}
+
+			output, outputClosed := rest, &restClosed
+			if pred(datapack) {
+				output, outputClosed = matched, &matchedClosed
+			}
+			if *outputClosed || output.Write(datapack) {
+				*outputClosed = true
+				discard(datapack)
+			}
+
+			if matchedClosed && restClosed {
+				inputStream.Close()
+				break
+			}
+		}
+
+		for _, err := range inputErr.Drain() {
+			if err != nil {
+				putErr(err)
+			}
+		}
+
+	}()
+
+	return matched, matchedErr, rest, restErr
+
+}
+
+// Route dispatches every datapack from inputStream to the output stream of the key returned by router,
+// an output is created for each of keys, plus the default one under "" for the unknown keys.
+// Errors from inputErr are put into all the output ErrorPassers, while the errors from router (whose datapacks are
+// discarded) only go into the default one, errs[""], and all the outputs are closed after inputStream is closed.
+// NOTE: a panic in router is recovered and put into all the output ErrorPassers as an error, the datapacks routed to
+// an output closed by its consumer are discarded, and a slow consumer blocks the others,
+// so all the outputs (including errs[""]) should be consumed concurrently.
+func Route(inputStream *IOStream, inputErr *ErrorPasser, router func(Datapack) (string, error), keys []string) (
+	map[string]*IOStream, map[string]*ErrorPasser) {
+
+	if inputStream == nil || inputErr == nil {
+		return nil, nil
+	}
+
+	streams := map[string]*IOStream{"": NewIOStream()}
+	errs := map[string]*ErrorPasser{"": NewErrorPasserWithCap(inputErr.Cap() + 1)}
+	for _, key := range keys {
+		if _, ok := streams[key]; !ok {
+			streams[key] = NewIOStream()
+			errs[key] = NewErrorPasserWithCap(inputErr.Cap() + 1)
+		}
+	}
+
+	putErr := func(err error) {
+		for key := range errs {
+			errs[key].Put(err)
+		}
+	}
+
+	go func() {
+
+		defer func() {
+			if r := recover(); r != nil {
+				inputStream.Close()
+				putErr(newPanicError("Route", r))
+			}
+			for key := range streams {
+				errs[key].Close()
+				streams[key].Close()
+			}
+		}()
+
+		// each output is counted once, whether it's found closed before writing or by the write
+		closedOutputs := make(map[string]bool, len(streams))
+		for len(closedOutputs) < len(streams) {
+			datapack, closed := inputStream.Read()
+			if closed {
+				break
+			}
+
+			key, err := router(datapack)
+			if err != nil {
+				discard(datapack)
+				errs[""].Put(err)
+				continue
+			}
+			output, ok := streams[key]
+			if !ok {
+				key, output = "", streams[""]
+			}
+			if output.Closed() || output.Write(datapack) {
+				discard(datapack)
+				closedOutputs[key] = true
+			}
+		}
+
+		// all the consumers are gone
+		inputStream.Close()
+
+		for _, err := range inputErr.Drain() {
+			if err != nil {
+				putErr(err)
+			}
+		}
+
+	}()
+
+	return streams, errs
+
+}
@@ -0,0 +1,309 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFanOut(t *testing.T) {
+
+	const total, n = 30, 3
+
+	datapacks := make([]Datapack, 0, total)
+	for i := 0; i < total; i++ {
+		datapacks = append(datapacks, newStringDatapack(fmt.Sprintf("%d", i)))
+	}
+
+	upstreamErr := errors.New("upstream err")
+	outputStreams, outputErrs := FanOut(NewClosedIOStream(datapacks...), NewClosedErrorPasser(upstreamErr), n)
+	assert.Len(t, outputStreams, n)
+	assert.Len(t, outputErrs, n)
+
+	results := make([][]string, n)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = readStrings(t, outputStreams[i])
+		}(i)
+	}
+	wg.Wait()
+
+	cnt := 0
+	for i := 0; i < n; i++ {
+		t.Logf("output %d got %v", i, results[i])
+		assert.InDelta(t, total/n, len(results[i]), 1)
+		cnt += len(results[i])
+
+		// all outputs are closed
+		_, closed := outputStreams[i].Read()
+		assert.True(t, closed)
+		assert.Equal(t, []error{upstreamErr}, outputErrs[i].Drain())
+	}
+	assert.Equal(t, total, cnt)
+
+}
+
+func TestFanIn(t *testing.T) {
+
+	fast, fastErr := NewSafeIOStreamWriter(newStringProducer("a", "b", "c", "d", "e")).Start()
+	slow, slowErr := NewSafeIOStreamWriter(&slowProducer{
+		p:        newStringProducer("x", "y"),
+		interval: time.Millisecond * 50,
+	}).Start()
+	upstreamErr := errors.New("upstream err")
+
+	outputStream, outputErr := FanIn(
+		[]*IOStream{fast, nil, slow, NewClosedIOStream()},
+		[]*ErrorPasser{fastErr, slowErr, nil, NewClosedErrorPasser(upstreamErr)},
+	)
+
+	strs := readStrings(t, outputStream)
+	sort.Strings(strs)
+	assert.Equal(t, []string{"a", "b", "c", "d", "e", "x", "y"}, strs)
+	assert.Equal(t, []error{upstreamErr}, outputErr.Drain())
+
+}
+
+type slowProducer struct {
+	p        DatapackProducer
+	interval time.Duration
+}
+
+func (s *slowProducer) Next() (datapack Datapack, hasNext bool, err error) {
+	time.Sleep(s.interval)
+	return s.p.Next()
+}
+
+func TestTee(t *testing.T) {
+
+	upstreamErr := errors.New("upstream err")
+	first := newStringDatapack("a")
+	s1, e1, s2, e2 := Tee(NewClosedIOStream(first), NewClosedErrorPasser(upstreamErr))
+
+	wg := &sync.WaitGroup{}
+	results := make([][]Datapack, 2)
+	for i, s := range []*IOStream{s1, s2} {
+		wg.Add(1)
+		go func(i int, s *IOStream) {
+			defer wg.Done()
+			for {
+				datapack, closed := s.Read()
+				if closed {
+					return
+				}
+				results[i] = append(results[i], datapack)
+			}
+		}(i, s)
+	}
+	wg.Wait()
+
+	// the very same datapack
+	assert.Equal(t, []Datapack{first}, results[0])
+	assert.Equal(t, []Datapack{first}, results[1])
+	assert.Equal(t, []error{upstreamErr}, e1.Drain())
+	assert.Equal(t, []error{upstreamErr}, e2.Drain())
+
+}
+
+func TestTeeBuffered(t *testing.T) {
+
+	stream, ep := NewSafeIOStreamWriter(newStringProducer("a", "b", "c")).Start()
+	s1, e1, s2, e2 := TeeBuffered(stream, ep)
+
+	wg := &sync.WaitGroup{}
+	results := make([][]string, 2)
+	for i, s := range []*IOStream{s1, s2} {
+		wg.Add(1)
+		go func(i int, s *IOStream) {
+			defer wg.Done()
+			results[i] = readStrings(t, s)
+		}(i, s)
+	}
+	wg.Wait()
+
+	assert.Equal(t, []string{"a", "b", "c"}, results[0])
+	assert.Equal(t, results[0], results[1])
+	assert.Empty(t, e1.Drain())
+	assert.Empty(t, e2.Drain())
+
+}
+
+func TestPartition(t *testing.T) {
+
+	isDigit := func(datapack Datapack) bool {
+		bs, _ := ReadAllAndClose(datapack)
+		return len(bs) > 0 && bs[0] >= '0' && bs[0] <= '9'
+	}
+
+	cases := []struct {
+		name          string
+		input         []string
+		matched, rest []string
+	}{
+		{name: "all match", input: []string{"1", "2", "3"}, matched: []string{"1", "2", "3"}, rest: []string{}},
+		{name: "all rest", input: []string{"a", "b"}, matched: []string{}, rest: []string{"a", "b"}},
+		{name: "mixed", input: []string{"1", "a", "2", "b"}, matched: []string{"1", "2"}, rest: []string{"a", "b"}},
+		{name: "empty", input: nil, matched: []string{}, rest: []string{}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// a BytesDatapack can still be read after pred has read it
+			packs := make([]Datapack, 0, len(c.input))
+			for _, str := range c.input {
+				packs = append(packs, NewBytesDatapack(context.Background(), []byte(str)))
+			}
+			upstreamErr := errors.New("upstream err")
+			m, me, r, re := Partition(NewClosedIOStream(packs...), NewClosedErrorPasser(upstreamErr), isDigit)
+
+			wg := &sync.WaitGroup{}
+			results := make([][]string, 2)
+			for i, s := range []*IOStream{m, r} {
+				wg.Add(1)
+				go func(i int, s *IOStream) {
+					defer wg.Done()
+					results[i] = readStrings(t, s)
+				}(i, s)
+			}
+			wg.Wait()
+
+			assert.Equal(t, c.matched, results[0])
+			assert.Equal(t, c.rest, results[1])
+			assert.Equal(t, []error{upstreamErr}, me.Drain())
+			assert.Equal(t, []error{upstreamErr}, re.Drain())
+		})
+	}
+
+}
+
+func TestPartitionPanic(t *testing.T) {
+
+	inputStream := NewClosedIOStream(newStringDatapack("a"), newStringDatapack("b"))
+	m, me, r, re := Partition(inputStream, NewClosedErrorPasser(), func(Datapack) bool {
+		panic("bad pred")
+	})
+
+	_, closed := m.Read()
+	assert.True(t, closed)
+	_, closed = r.Read()
+	assert.True(t, closed)
+	for _, ep := range []*ErrorPasser{me, re} {
+		errs := ep.Drain()
+		assert.Len(t, errs, 1)
+		assert.Equal(t, "Partition panicked, err = bad pred", errs[0].Error())
+	}
+	// the input is closed as well
+	assert.True(t, inputStream.Closed())
+
+	m, me, r, re = Partition(nil, nil, nil)
+	assert.Nil(t, m)
+	assert.Nil(t, me)
+	assert.Nil(t, r)
+	assert.Nil(t, re)
+
+}
+
+func TestRoute(t *testing.T) {
+
+	routeErr := errors.New("empty datapack")
+	router := func(datapack Datapack) (string, error) {
+		bs, _ := ReadAllAndClose(datapack)
+		if len(bs) == 0 {
+			return "", routeErr
+		}
+		return string(bs[:1]), nil
+	}
+
+	packs := make([]Datapack, 0)
+	for _, str := range []string{"a1", "b1", "", "c1", "a2", "d1", "b2"} {
+		packs = append(packs, NewBytesDatapack(context.Background(), []byte(str)))
+	}
+	upstreamErr := errors.New("upstream err")
+	streams, errs := Route(NewClosedIOStream(packs...), NewClosedErrorPasser(upstreamErr), router, []string{"a", "b", "a"})
+	assert.Len(t, streams, 3)
+	assert.Len(t, errs, 3)
+
+	mu, wg := &sync.Mutex{}, &sync.WaitGroup{}
+	results, errResults := make(map[string][]string), make(map[string][]error)
+	for key := range streams {
+		wg.Add(2)
+		go func(key string) {
+			defer wg.Done()
+			strs := readStrings(t, streams[key])
+			mu.Lock()
+			results[key] = strs
+			mu.Unlock()
+		}(key)
+		go func(key string) {
+			defer wg.Done()
+			errs := errs[key].Drain()
+			mu.Lock()
+			errResults[key] = errs
+			mu.Unlock()
+		}(key)
+	}
+	wg.Wait()
+
+	assert.Equal(t, map[string][]string{
+		"a": {"a1", "a2"},
+		"b": {"b1", "b2"},
+		// the unknown keys fall through
+		"": {"c1", "d1"},
+	}, results)
+	assert.Equal(t, map[string][]error{
+		"a": {upstreamErr},
+		"b": {upstreamErr},
+		"":  {routeErr, upstreamErr},
+	}, errResults)
+
+	streams, errs = Route(nil, nil, router, nil)
+	assert.Nil(t, streams)
+	assert.Nil(t, errs)
+
+}
+
+func TestRouteAllConsumersGone(t *testing.T) {
+
+	writer := NewSafeIOStreamWriter(&countProducer{cnt: math.MaxInt32})
+	stream, ep := writer.Start()
+	streams, errs := Route(stream, ep, func(datapack Datapack) (string, error) {
+		bs, _ := ReadAllAndClose(datapack)
+		if n, _ := strconv.Atoi(string(bs)); n%2 == 1 {
+			return "odd", nil
+		}
+		return "even", nil
+	}, []string{"odd"})
+
+	// the consumers are gone before any datapack is routed
+	for key := range streams {
+		streams[key].Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for key := range errs {
+			errs[key].Drain()
+		}
+		writer.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Route should stop the upstream once all the outputs are closed")
+	}
+	t.Logf("produced = %d", writer.Produced())
+	assert.True(t, stream.Closed())
+
+}
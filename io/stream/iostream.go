@@ -8,27 +8,33 @@ import (
 
 // IOStream is a stream of Datapack.
 type IOStream struct {
-	mu     *sync.Mutex
-	dataCh chan Datapack
-	ctrlCh chan struct{}
+	mu      *sync.Mutex
+	writers *sync.WaitGroup
+	dataCh  chan Datapack
+	ctrlCh  chan struct{}
+	readCh  chan struct{}
+	drained *drainSignal
 }
 
+// NewIOStream creates an IOStream which can buffer one datapack.
 func NewIOStream() *IOStream {
-	return &IOStream{
-		mu:     &sync.Mutex{},
-		dataCh: make(chan Datapack, 1),
-		ctrlCh: make(chan struct{}),
-	}
+	return NewIOStreamWithCap(1)
 }
 
+// NewIOStreamWithCap creates an IOStream which can buffer at most maxDatapackCnt datapacks,
+// Write only blocks when the buffer is full.
+// NOTE: datapacks buffered before Close can still be read, Read reports streamClosed after they're drained.
 func NewIOStreamWithCap(maxDatapackCnt int) *IOStream {
 	if maxDatapackCnt < 0 {
 		maxDatapackCnt = 0
 	}
 	return &IOStream{
-		mu:     &sync.Mutex{},
-		dataCh: make(chan Datapack, maxDatapackCnt),
-		ctrlCh: make(chan struct{}),
+		mu:      &sync.Mutex{},
+		writers: &sync.WaitGroup{},
+		dataCh:  make(chan Datapack, maxDatapackCnt),
+		ctrlCh:  make(chan struct{}),
+		readCh:  make(chan struct{}, 1),
+		drained: newDrainSignal(),
 	}
 }
 
@@ -42,42 +48,208 @@ func NewClosedIOStream(datapacks ...Datapack) *IOStream {
 }
 
 func (s *IOStream) Write(data Datapack) (streamClosed bool) {
+	streamClosed, _ = s.WriteContext(context.Background(), data)
+	return
+}
+
+// WriteContext is the same as Write, but gives up writing once ctx is done.
+// There're three outcomes:
+//  1. written: streamClosed = false, canceled = false
+//  2. the stream is closed before or while writing: streamClosed = true, canceled = false
+//  3. ctx is done before data is written: streamClosed = false, canceled = true
+func (s *IOStream) WriteContext(ctx context.Context, data Datapack) (streamClosed bool, canceled bool) {
+
 	s.mu.Lock()
-	streamClosed = s.isClosed()
+	if s.isClosed() {
+		s.mu.Unlock()
+		return true, false
+	}
+	// Close waits for all the in-flight writers before closing dataCh
+	s.writers.Add(1)
 	s.mu.Unlock()
-	if streamClosed {
-		return
+	defer s.writers.Done()
+
+	select {
+	case s.dataCh <- data:
+		return false, false
+	case <-s.ctrlCh:
+		return true, false
+	case <-ctx.Done():
+		return false, true
 	}
-	s.dataCh <- data
-	return false
+
 }
 
+// Read blocks until a datapack is read or the stream is closed and drained.
+// NOTE: it's safe to call Read from multiple goroutines, each datapack is delivered to exactly one of them.
 func (s *IOStream) Read() (data Datapack, streamClosed bool) {
 	dp, ok := <-s.dataCh
+	s.onRead(ok)
 	return dp, !ok
 }
 
+// ReadContext is the same as Read, but gives up reading once ctx is done.
+// There're three outcomes:
+//  1. read: data is the datapack, streamClosed = false, canceled = false
+//  2. the stream is closed and drained: data = nil, streamClosed = true, canceled = false
+//  3. ctx is done before any datapack is read: data = nil, streamClosed = false, canceled = true
+//
+// NOTE: a canceled ReadContext never takes a datapack out of the stream, so nothing is lost,
+// and it reports canceled at once if ctx is already done, even when there're datapacks buffered.
+func (s *IOStream) ReadContext(ctx context.Context) (data Datapack, streamClosed bool, canceled bool) {
+	if ctx.Err() != nil {
+		return nil, false, true
+	}
+	select {
+	case dp, ok := <-s.dataCh:
+		s.onRead(ok)
+		return dp, !ok, false
+	case <-ctx.Done():
+		return nil, false, true
+	}
+}
+
+// readUntil is the same as Read, but closes the stream and reports streamClosed once downstream is closed,
+// so an operator blocked on reading stops its upstream as soon as its consumer is gone.
+func (s *IOStream) readUntil(downstream *IOStream) (data Datapack, streamClosed bool) {
+	select {
+	case <-downstream.ctrlCh:
+		s.Close()
+		return nil, true
+	default:
+	}
+	select {
+	case dp, ok := <-s.dataCh:
+		s.onRead(ok)
+		return dp, !ok
+	case <-downstream.ctrlCh:
+		s.Close()
+		return nil, true
+	}
+}
+
 // TryRead try read datapack in a non-block way.
 // NOTE: if streamClosed, data is nil
 func (s *IOStream) TryRead() (data Datapack, streamClosed bool) {
 	select {
 	case data, ok := <-s.dataCh:
+		s.onRead(ok)
 		return data, !ok
 	default:
 		return nil, false
 	}
 }
 
+// Close closes the stream, it's safe to call Close more than once, even from multiple goroutines.
+// NOTE: the datapacks already buffered are not discarded, Read still delivers them before reporting streamClosed,
+// while Write / WriteContext after Close returns streamClosed = true without writing.
 func (s *IOStream) Close() {
 	s.mu.Lock()
-	defer s.mu.Unlock()
 	if s.isClosed() {
+		s.mu.Unlock()
 		return
 	}
 	close(s.ctrlCh)
+	s.mu.Unlock()
+
+	// the blocked writers will return since ctrlCh is closed
+	s.writers.Wait()
 	close(s.dataCh)
 }
 
+// Reset makes the stream open and empty again with its original capacity, so it can be reused,
+// the datapacks still buffered are dropped without closing their ReadClosers.
+// WARN: Reset must not be called while the stream is being used by any reader or writer,
+// and the channels got from CloseChan before Reset are not affected by it.
+func (s *IOStream) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dataCh = make(chan Datapack, cap(s.dataCh))
+	s.ctrlCh = make(chan struct{})
+	s.readCh = make(chan struct{}, 1)
+	s.drained = newDrainSignal()
+}
+
+// WaitWritable blocks until there's room in the buffer of the stream, so the next Write won't block on a full buffer.
+// NOTE: it returns immediately for an unbuffered stream, and the room may be taken by another writer before Write.
+func (s *IOStream) WaitWritable(ctx context.Context) (streamClosed bool, canceled bool) {
+	for {
+		if s.isClosed() {
+			return true, false
+		}
+		if s.Cap() == 0 || s.Len() < s.Cap() {
+			return false, false
+		}
+		select {
+		case <-s.readCh:
+		case <-s.ctrlCh:
+			return true, false
+		case <-ctx.Done():
+			return false, true
+		}
+	}
+}
+
+// onRead should be called after receiving from dataCh, it wakes up WaitWritable,
+// and marks the stream drained once the receiving reports the channel is closed.
+func (s *IOStream) onRead(ok bool) {
+	if !ok {
+		s.drained.fire()
+		return
+	}
+	select {
+	case s.readCh <- struct{}{}:
+	default:
+	}
+}
+
+// drainedChan returns a channel which is closed once a reader gets streamClosed,
+// which means the stream is closed and all the datapacks buffered have been read out.
+func (s *IOStream) drainedChan() <-chan struct{} {
+	return s.drained.ch
+}
+
+// drainSignal is a channel which is closed once.
+type drainSignal struct {
+	once *sync.Once
+	ch   chan struct{}
+}
+
+func newDrainSignal() *drainSignal {
+	return &drainSignal{
+		once: &sync.Once{},
+		ch:   make(chan struct{}),
+	}
+}
+
+func (d *drainSignal) fire() {
+	d.once.Do(func() {
+		close(d.ch)
+	})
+}
+
+// Len returns the number of datapacks buffered in the stream.
+func (s *IOStream) Len() int {
+	return len(s.dataCh)
+}
+
+// Cap returns the max number of datapacks the stream can buffer, 0 means unbuffered.
+func (s *IOStream) Cap() int {
+	return cap(s.dataCh)
+}
+
+// Closed reports whether the stream is closed.
+// NOTE: datapacks buffered before Close may still be readable even if Closed returns true.
+func (s *IOStream) Closed() bool {
+	return s.isClosed()
+}
+
+// CloseChan returns a channel which is closed once the stream is closed,
+// so it can be used in select to react to a downstream consumer closing the stream early.
+func (s *IOStream) CloseChan() <-chan struct{} {
+	return s.ctrlCh
+}
+
 func (s *IOStream) isClosed() bool {
 	select {
 	case <-s.ctrlCh:
@@ -87,6 +259,108 @@ func (s *IOStream) isClosed() bool {
 	}
 }
 
+// StreamReader is the read-only view of an IOStream for the consumers, see IOStream.Reader.
+// NOTE: Close is kept, since a consumer closes the stream to stop its upstream early.
+type StreamReader interface {
+	Read() (data Datapack, streamClosed bool)
+	ReadContext(ctx context.Context) (data Datapack, streamClosed bool, canceled bool)
+	TryRead() (data Datapack, streamClosed bool)
+	Close()
+	Closed() bool
+	Len() int
+	Cap() int
+}
+
+// StreamWriter is the write-only view of an IOStream for the producers, see IOStream.Writer.
+type StreamWriter interface {
+	Write(data Datapack) (streamClosed bool)
+	WriteContext(ctx context.Context, data Datapack) (streamClosed bool, canceled bool)
+	WaitWritable(ctx context.Context) (streamClosed bool, canceled bool)
+	CloseChan() <-chan struct{}
+	Close()
+	Closed() bool
+	Len() int
+	Cap() int
+}
+
+// Reader returns the read-only view of the stream, which can't be converted back to the stream or a StreamWriter.
+func (s *IOStream) Reader() StreamReader {
+	return streamReader{stream: s}
+}
+
+// Writer returns the write-only view of the stream, which can't be converted back to the stream or a StreamReader.
+func (s *IOStream) Writer() StreamWriter {
+	return streamWriter{stream: s}
+}
+
+type streamReader struct {
+	stream *IOStream
+}
+
+func (r streamReader) Read() (Datapack, bool) {
+	return r.stream.Read()
+}
+
+func (r streamReader) ReadContext(ctx context.Context) (Datapack, bool, bool) {
+	return r.stream.ReadContext(ctx)
+}
+
+func (r streamReader) TryRead() (Datapack, bool) {
+	return r.stream.TryRead()
+}
+
+func (r streamReader) Close() {
+	r.stream.Close()
+}
+
+func (r streamReader) Closed() bool {
+	return r.stream.Closed()
+}
+
+func (r streamReader) Len() int {
+	return r.stream.Len()
+}
+
+func (r streamReader) Cap() int {
+	return r.stream.Cap()
+}
+
+type streamWriter struct {
+	stream *IOStream
+}
+
+func (w streamWriter) Write(data Datapack) bool {
+	return w.stream.Write(data)
+}
+
+func (w streamWriter) WriteContext(ctx context.Context, data Datapack) (bool, bool) {
+	return w.stream.WriteContext(ctx, data)
+}
+
+func (w streamWriter) WaitWritable(ctx context.Context) (bool, bool) {
+	return w.stream.WaitWritable(ctx)
+}
+
+func (w streamWriter) CloseChan() <-chan struct{} {
+	return w.stream.CloseChan()
+}
+
+func (w streamWriter) Close() {
+	w.stream.Close()
+}
+
+func (w streamWriter) Closed() bool {
+	return w.stream.Closed()
+}
+
+func (w streamWriter) Len() int {
+	return w.stream.Len()
+}
+
+func (w streamWriter) Cap() int {
+	return w.stream.Cap()
+}
+
 // Datapack is a io.ReadCloser with some extra info.
 type Datapack interface {
 	Context() context.Context
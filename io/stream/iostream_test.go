@@ -2,6 +2,7 @@ package stream
 
 import (
 	"context"
+	"sync"
 	"testing"
 	"time"
 
@@ -66,3 +67,406 @@ func TestTryRead(t *testing.T) {
 	t.Logf("try read for the last time, result: data is nil = %v, closed = %v", data == nil, closed)
 
 }
+
+func TestWriteWithCap(t *testing.T) {
+
+	const n = 10
+	stream := NewIOStreamWithCap(n)
+
+	// should not block without a concurrent reader
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < n; i++ {
+			stream.Write(NewSimpleDatapack(context.WithValue(context.Background(), "idx", i), nil))
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("write to a stream with enough capacity should not block")
+	}
+
+	stream.Close()
+
+	// buffered datapacks should be drained before closed
+	for i := 0; i < n; i++ {
+		data, closed := stream.Read()
+		assert.False(t, closed)
+		assert.Equal(t, i, data.Context().Value("idx").(int))
+	}
+
+	data, closed := stream.Read()
+	assert.Nil(t, data)
+	assert.True(t, closed)
+
+}
+
+func TestLenAndCap(t *testing.T) {
+
+	assert.Equal(t, 1, NewIOStream().Cap())
+	assert.Equal(t, 0, NewIOStreamWithCap(-1).Cap())
+
+	stream := NewIOStreamWithCap(3)
+	assert.Equal(t, 3, stream.Cap())
+	assert.Equal(t, 0, stream.Len())
+
+	stream.Write(NewSimpleDatapack(context.Background(), nil))
+	stream.Write(NewSimpleDatapack(context.Background(), nil))
+	assert.Equal(t, 2, stream.Len())
+
+	stream.Read()
+	assert.Equal(t, 1, stream.Len())
+
+	stream.Close()
+	assert.Equal(t, 1, stream.Len())
+	assert.Equal(t, 3, stream.Cap())
+
+}
+
+func TestWriteContext(t *testing.T) {
+
+	stream := NewIOStreamWithCap(0)
+
+	// written
+	go stream.Read()
+	streamClosed, canceled := stream.WriteContext(context.Background(), NewSimpleDatapack(context.Background(), nil))
+	assert.False(t, streamClosed)
+	assert.False(t, canceled)
+
+	// canceled
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	streamClosed, canceled = stream.WriteContext(ctx, NewSimpleDatapack(context.Background(), nil))
+	assert.False(t, streamClosed)
+	assert.True(t, canceled)
+
+	// closed
+	stream.Close()
+	streamClosed, canceled = stream.WriteContext(context.Background(), NewSimpleDatapack(context.Background(), nil))
+	assert.True(t, streamClosed)
+	assert.False(t, canceled)
+
+}
+
+func TestCloseWhileWriting(t *testing.T) {
+
+	stream := NewIOStreamWithCap(0)
+
+	results := make(chan bool, 2)
+	go func() {
+		results <- stream.Write(NewSimpleDatapack(context.Background(), nil))
+	}()
+	go func() {
+		streamClosed, _ := stream.WriteContext(context.Background(), NewSimpleDatapack(context.Background(), nil))
+		results <- streamClosed
+	}()
+
+	time.Sleep(time.Millisecond * 100)
+	stream.Close()
+
+	assert.True(t, <-results)
+	assert.True(t, <-results)
+
+	_, closed := stream.Read()
+	assert.True(t, closed)
+
+}
+
+func TestConcurrentRead(t *testing.T) {
+
+	const total, readers = 10000, 16
+
+	stream := NewIOStreamWithCap(8)
+	go func() {
+		for i := 0; i < total; i++ {
+			stream.Write(NewSimpleDatapack(context.WithValue(context.Background(), "idx", i), nil))
+		}
+		stream.Close()
+	}()
+
+	mu := &sync.Mutex{}
+	delivered := make(map[int]int, total)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				data, closed := stream.Read()
+				if closed {
+					return
+				}
+				mu.Lock()
+				delivered[data.Context().Value("idx").(int)]++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Len(t, delivered, total)
+	for idx, cnt := range delivered {
+		assert.Equal(t, 1, cnt, "datapack %d is delivered %d times", idx, cnt)
+	}
+
+}
+
+func TestCloseDrain(t *testing.T) {
+
+	stream := NewIOStreamWithCap(2)
+	assert.False(t, stream.Write(NewSimpleDatapack(context.WithValue(context.Background(), "idx", 0), nil)))
+	assert.False(t, stream.Write(NewSimpleDatapack(context.WithValue(context.Background(), "idx", 1), nil)))
+	stream.Close()
+
+	// write after close
+	assert.NotPanics(t, func() {
+		assert.True(t, stream.Write(NewSimpleDatapack(context.Background(), nil)))
+	})
+
+	// buffered datapacks are still delivered
+	for i := 0; i < 2; i++ {
+		data, closed := stream.Read()
+		assert.False(t, closed)
+		assert.Equal(t, i, data.Context().Value("idx").(int))
+	}
+	data, closed := stream.Read()
+	assert.Nil(t, data)
+	assert.True(t, closed)
+
+}
+
+func TestWaitWritable(t *testing.T) {
+
+	stream := NewIOStreamWithCap(1)
+	streamClosed, canceled := stream.WaitWritable(context.Background())
+	assert.False(t, streamClosed)
+	assert.False(t, canceled)
+
+	stream.Write(NewSimpleDatapack(context.Background(), nil))
+
+	// full
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	streamClosed, canceled = stream.WaitWritable(ctx)
+	assert.False(t, streamClosed)
+	assert.True(t, canceled)
+
+	// room made by a reader
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		stream.Read()
+	}()
+	streamClosed, canceled = stream.WaitWritable(context.Background())
+	assert.False(t, streamClosed)
+	assert.False(t, canceled)
+
+	// closed
+	stream.Write(NewSimpleDatapack(context.Background(), nil))
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		stream.Close()
+	}()
+	streamClosed, canceled = stream.WaitWritable(context.Background())
+	assert.True(t, streamClosed)
+	assert.False(t, canceled)
+
+}
+
+func TestReadContext(t *testing.T) {
+
+	// read
+	stream := NewIOStreamWithCap(1)
+	stream.Write(newStringDatapack("a"))
+	datapack, streamClosed, canceled := stream.ReadContext(context.Background())
+	assert.False(t, streamClosed)
+	assert.False(t, canceled)
+	bs, err := ReadAllAndClose(datapack)
+	assert.Nil(t, err)
+	assert.Equal(t, "a", string(bs))
+
+	// canceled while blocking on an empty stream
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	datapack, streamClosed, canceled = stream.ReadContext(ctx)
+	assert.Nil(t, datapack)
+	assert.False(t, streamClosed)
+	assert.True(t, canceled)
+
+	// a done ctx doesn't take the buffered datapack away
+	stream.Write(newStringDatapack("b"))
+	datapack, streamClosed, canceled = stream.ReadContext(ctx)
+	assert.Nil(t, datapack)
+	assert.False(t, streamClosed)
+	assert.True(t, canceled)
+	assert.Equal(t, 1, stream.Len())
+
+	// closed, after the buffered one is read
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		stream.Close()
+	}()
+	datapack, streamClosed, canceled = stream.ReadContext(context.Background())
+	assert.NotNil(t, datapack)
+	assert.False(t, streamClosed)
+	datapack, streamClosed, canceled = stream.ReadContext(context.Background())
+	assert.Nil(t, datapack)
+	assert.True(t, streamClosed)
+	assert.False(t, canceled)
+
+}
+
+func TestClosedAndCloseChan(t *testing.T) {
+
+	stream := NewIOStream()
+	assert.False(t, stream.Closed())
+	select {
+	case <-stream.CloseChan():
+		t.Fatal("CloseChan should not be closed")
+	default:
+	}
+
+	// hammer Close from multiple goroutines
+	wg := &sync.WaitGroup{}
+	start := make(chan struct{})
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			stream.Close()
+			assert.True(t, stream.Closed())
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	assert.True(t, stream.Closed())
+	select {
+	case <-stream.CloseChan():
+	case <-time.After(time.Second):
+		t.Fatal("CloseChan should be closed")
+	}
+
+}
+
+func TestConcurrentCloseAndWrite(t *testing.T) {
+
+	for round := 0; round < 100; round++ {
+		stream := NewIOStreamWithCap(round % 3)
+
+		// keep reading so that some of the writes succeed
+		go func() {
+			for {
+				if _, closed := stream.Read(); closed {
+					return
+				}
+			}
+		}()
+
+		wg := &sync.WaitGroup{}
+		start := make(chan struct{})
+		for i := 0; i < 8; i++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				<-start
+				for j := 0; j < 10; j++ {
+					assert.NotPanics(t, func() {
+						stream.Write(NewSimpleDatapack(context.Background(), nil))
+					})
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				<-start
+				assert.NotPanics(t, stream.Close)
+			}()
+		}
+		close(start)
+		wg.Wait()
+
+		assert.True(t, stream.Write(NewSimpleDatapack(context.Background(), nil)))
+	}
+
+}
+
+func TestIOStreamReset(t *testing.T) {
+
+	stream := NewIOStreamWithCap(2)
+	for round := 0; round < 3; round++ {
+		assert.False(t, stream.Closed())
+		assert.Equal(t, 0, stream.Len())
+		assert.Equal(t, 2, stream.Cap())
+
+		assert.False(t, stream.Write(newStringDatapack("a")))
+		assert.False(t, stream.Write(newStringDatapack("b")))
+		stream.Close()
+		assert.True(t, stream.Closed())
+		assert.True(t, stream.Write(newStringDatapack("c")))
+		assert.Equal(t, []string{"a", "b"}, readStrings(t, stream))
+
+		stream.Reset()
+	}
+
+	// the buffered datapacks are dropped
+	stream.Write(newStringDatapack("dropped"))
+	stream.Reset()
+	data, closed := stream.TryRead()
+	assert.Nil(t, data)
+	assert.False(t, closed)
+	select {
+	case <-stream.CloseChan():
+		t.Fatal("CloseChan should not be closed")
+	default:
+	}
+
+}
+
+func TestReaderAndWriterViews(t *testing.T) {
+
+	// compile checks, the stream satisfies both views
+	var _ StreamReader = NewIOStream()
+	var _ StreamWriter = NewIOStream()
+
+	stream := NewIOStreamWithCap(2)
+	r, w := stream.Reader(), stream.Writer()
+
+	// the views can't be converted back to the stream or to each other
+	_, ok := r.(StreamWriter)
+	assert.False(t, ok)
+	_, ok = r.(*IOStream)
+	assert.False(t, ok)
+	_, ok = w.(StreamReader)
+	assert.False(t, ok)
+	_, ok = w.(*IOStream)
+	assert.False(t, ok)
+	_, ok = w.(interface{ TryRead() (Datapack, bool) })
+	assert.False(t, ok)
+
+	assert.False(t, w.Write(newStringDatapack("a")))
+	streamClosed, canceled := w.WriteContext(context.Background(), newStringDatapack("b"))
+	assert.False(t, streamClosed)
+	assert.False(t, canceled)
+	assert.Equal(t, 2, r.Len())
+	assert.Equal(t, 2, w.Cap())
+
+	datapack, closed := r.Read()
+	assert.False(t, closed)
+	bs, err := ReadAllAndClose(datapack)
+	assert.Nil(t, err)
+	assert.Equal(t, "a", string(bs))
+
+	// the consumer closes the stream through its view, the producer sees it
+	r.Close()
+	assert.True(t, w.Closed())
+	select {
+	case <-w.CloseChan():
+	default:
+		t.Fatal("CloseChan should be closed")
+	}
+	assert.True(t, w.Write(newStringDatapack("c")))
+	assert.Equal(t, []string{"b"}, readStrings(t, stream))
+
+}
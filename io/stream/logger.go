@@ -0,0 +1,13 @@
+package stream
+
+// Logger is used by the stages of a stream to log the events happened in their goroutines.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+type noopLogger struct{}
+
+func (noopLogger) Debugf(string, ...interface{}) {}
+
+func (noopLogger) Errorf(string, ...interface{}) {}
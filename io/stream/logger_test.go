@@ -0,0 +1,52 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogger(t *testing.T) {
+
+	l := &mockLogger{mu: &sync.Mutex{}}
+	stream, ep := NewSafeIOStreamWriter(&countProducer{cnt: 3}, WithLogger(l)).Start()
+	safeHandler := NewSafeIOStreamHandler(stream, ep, func(ctx context.Context, rc io.ReadCloser) error {
+		return errors.New("handler failed")
+	}, nil, WithLogger(l))
+	safeHandler.BuildStream()
+	safeHandler.Start()
+	safeHandler.Wait()
+
+	assert.Len(t, l.errors, 1)
+	assert.Contains(t, l.errors[0], "handler failed")
+
+	// writer
+	l = &mockLogger{mu: &sync.Mutex{}}
+	_, ep = NewSafeIOStreamWriter(&failAtProducer{p: newStringProducer(), err: errors.New("producer failed")}, WithLogger(l)).Start()
+	assert.NotNil(t, ep.Get())
+	assert.Len(t, l.errors, 1)
+	assert.Contains(t, l.errors[0], "producer failed")
+
+}
+
+type mockLogger struct {
+	mu             *sync.Mutex
+	debugs, errors []string
+}
+
+func (m *mockLogger) Debugf(format string, args ...interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.debugs = append(m.debugs, fmt.Sprintf(format, args...))
+}
+
+func (m *mockLogger) Errorf(format string, args ...interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.errors = append(m.errors, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,21 @@
+package stream
+
+import "time"
+
+// StreamMetrics collects the metrics of a SafeIOStreamHandler, it should be safe for concurrent use.
+type StreamMetrics interface {
+	// IncProcessed is called after each datapackHandler call, no matter it succeeded or not.
+	IncProcessed()
+	// IncErrors is called when a datapackHandler call returned an error or panicked.
+	IncErrors()
+	// ObserveHandlerDuration is called with the duration of each datapackHandler call.
+	ObserveHandlerDuration(d time.Duration)
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) IncProcessed() {}
+
+func (noopMetrics) IncErrors() {}
+
+func (noopMetrics) ObserveHandlerDuration(time.Duration) {}
@@ -0,0 +1,52 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+
+	m := &mockMetrics{}
+	stream, ep := NewSafeIOStreamWriter(&countProducer{cnt: 5}).Start()
+	safeHandler := NewSafeIOStreamHandler(stream, ep, func(ctx context.Context, rc io.ReadCloser) error {
+		time.Sleep(time.Millisecond)
+		if atomic.LoadInt64(&m.processed) == 3 {
+			return errors.New("handler failed")
+		}
+		return nil
+	}, nil, WithMetrics(m))
+	_, outputErr := safeHandler.BuildStream()
+	safeHandler.Start()
+	safeHandler.Wait()
+
+	assert.NotNil(t, outputErr.Get())
+	assert.Equal(t, int64(4), atomic.LoadInt64(&m.processed))
+	assert.Equal(t, int64(1), atomic.LoadInt64(&m.errors))
+	assert.Equal(t, int64(4), atomic.LoadInt64(&m.observed))
+	assert.True(t, time.Duration(atomic.LoadInt64(&m.duration)) >= 4*time.Millisecond)
+
+}
+
+type mockMetrics struct {
+	processed, errors, observed, duration int64
+}
+
+func (m *mockMetrics) IncProcessed() {
+	atomic.AddInt64(&m.processed, 1)
+}
+
+func (m *mockMetrics) IncErrors() {
+	atomic.AddInt64(&m.errors, 1)
+}
+
+func (m *mockMetrics) ObserveHandlerDuration(d time.Duration) {
+	atomic.AddInt64(&m.observed, 1)
+	atomic.AddInt64(&m.duration, int64(d))
+}
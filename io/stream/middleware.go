@@ -0,0 +1,19 @@
+package stream
+
+// Handler handles a datapack in SafeIOStreamHandler, it's the common shape of the handler, transformer and mapper,
+// the returned datapack is emitted into the outputStream, and it's always nil for a side-effect-only handler.
+type Handler func(datapack Datapack) (Datapack, error)
+
+// HandlerMiddleware wraps a Handler with cross-cutting concerns (logging, timing, auth, etc.), like the net/http ones,
+// a middleware can short-circuit by returning without calling next, see WithMiddleware.
+type HandlerMiddleware func(next Handler) Handler
+
+// chainMiddlewares wraps handler with the middlewares, the first one is the outermost.
+func chainMiddlewares(handler Handler, middlewares []HandlerMiddleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		if middlewares[i] != nil {
+			handler = middlewares[i](handler)
+		}
+	}
+	return handler
+}
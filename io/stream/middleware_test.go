@@ -0,0 +1,95 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMiddlewareOrder(t *testing.T) {
+
+	var trace []string
+	tag := func(name string) HandlerMiddleware {
+		return func(next Handler) Handler {
+			return func(datapack Datapack) (Datapack, error) {
+				trace = append(trace, name+" before")
+				result, err := next(datapack)
+				trace = append(trace, name+" after")
+				return result, err
+			}
+		}
+	}
+
+	safeHandler := NewTransformIOStreamHandler(
+		NewClosedIOStream(newStringDatapack("a")),
+		NewClosedErrorPasser(),
+		func(ctx context.Context, rc io.ReadCloser) (Datapack, error) {
+			bs, _ := ioutil.ReadAll(rc)
+			trace = append(trace, "handler")
+			return NewBytesDatapack(ctx, []byte(strings.ToUpper(string(bs)))), nil
+		},
+		nil,
+		WithMiddleware(tag("1"), tag("2")),
+		WithMiddleware(tag("3")),
+	)
+	outputStream, outputErr := safeHandler.BuildStream()
+	safeHandler.Start()
+
+	assert.Equal(t, []string{"A"}, readStrings(t, outputStream))
+	assert.Empty(t, outputErr.Drain())
+	safeHandler.Wait()
+	t.Logf("trace = %v", trace)
+	assert.Equal(t, []string{
+		"1 before", "2 before", "3 before", "handler", "3 after", "2 after", "1 after",
+	}, trace)
+
+}
+
+func TestMiddlewareShortCircuit(t *testing.T) {
+
+	errDenied := errors.New("denied")
+	auth := func(next Handler) Handler {
+		return func(datapack Datapack) (Datapack, error) {
+			if MetaOf(datapack)["token"] != "secret" {
+				datapack.ReadCloser().Close()
+				return nil, errDenied
+			}
+			return next(datapack)
+		}
+	}
+
+	var handled []string
+	safeHandler := NewSafeIOStreamHandler(
+		NewClosedIOStream(
+			newMetaDatapack("1", map[string]string{"token": "secret"}),
+			newMetaDatapack("2", map[string]string{"token": "guess"}),
+			newStringDatapack("3"),
+		),
+		NewClosedErrorPasser(),
+		func(ctx context.Context, rc io.ReadCloser) error {
+			bs, _ := ioutil.ReadAll(rc)
+			handled = append(handled, string(bs))
+			return nil
+		},
+		nil,
+		WithMiddleware(auth),
+		WithContinueOnError(true),
+	)
+	_, outputErr := safeHandler.BuildStream()
+	safeHandler.Start()
+	safeHandler.Wait()
+
+	errs := outputErr.Drain()
+	t.Logf("handled = %v, errs = %v", handled, errs)
+	assert.Equal(t, []string{"1"}, handled)
+	assert.Len(t, errs, 2)
+	for _, err := range errs {
+		assert.True(t, errors.Is(err, errDenied))
+	}
+
+}
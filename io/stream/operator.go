@@ -0,0 +1,574 @@
+package stream
+
+import (
+	"container/list"
+)
+
+// Map transforms every datapack from inputStream with fn and writes the result into outputStream,
+// if fn returns a nil datapack without error, the datapack will be dropped.
+// the datapack passed to fn implements Metadata if the input does, and its metadata is attached to the result of fn
+// unless the result carries its own.
+// opts configure the underlying SafeIOStreamHandler.
+// NOTE: datapacks with a nil ReadCloser are skipped by SafeIOStreamHandler, so fn won't see them.
+func Map(inputStream *IOStream, inputErr *ErrorPasser, fn func(Datapack) (Datapack, error), opts ...Option) (
+	*IOStream, *ErrorPasser) {
+
+	safeHandler := NewTransformIOStreamHandler(inputStream, inputErr, nil, nil, opts...)
+	safeHandler.mapper = func(datapack Datapack) (Datapack, error) {
+		result, err := fn(datapack)
+		if err != nil || result == nil {
+			return result, err
+		}
+		if meta := MetaOf(datapack); meta != nil && MetaOf(result) == nil {
+			result = NewMetaDatapack(result.Context(), result.ReadCloser(), meta)
+		}
+		return result, nil
+	}
+
+	outputStream, outputErr := safeHandler.BuildStream()
+	if outputStream == nil || outputErr == nil {
+		return nil, nil
+	}
+
+	safeHandler.Start()
+
+	return outputStream, outputErr
+
+}
+
+// MapWithErrors is a combined operator which handles both the datapacks and the errors from upstream, as they arrive,
+// so that an upstream error can be turned into data, e.g. an "error marker" datapack for the downstream.
+// onData is the same as the fn of Map (a nil onData forwards the datapacks as they are), an error from it is put into
+// outputErr as a StreamError, after which the rest datapacks are discarded, while the errors are still handled.
+// onErr is called for every non-nil error from inputErr, its non-nil datapack is written into outputStream,
+// and its non-nil error is put into outputErr, so returning the error as is forwards it, and returning nil swallows it,
+// a nil onErr forwards all the errors.
+// NOTE: the datapacks and errors are handled in a single goroutine, so onData and onErr are never called concurrently,
+// while the order between the datapacks and the errors is the order of arrival, which is not deterministic.
+func MapWithErrors(inputStream *IOStream, inputErr *ErrorPasser, onData func(Datapack) (Datapack, error),
+	onErr func(error) (Datapack, error)) (*IOStream, *ErrorPasser) {
+
+	if inputStream == nil || inputErr == nil {
+		return nil, nil
+	}
+
+	outputStream := NewIOStream()
+	// each error from inputErr gives at most one error, plus the StreamError of onData
+	outputErr := NewErrorPasserWithCap(inputErr.Cap() + 1)
+
+	go func() {
+
+		defer func() {
+			if r := recover(); r != nil {
+				inputStream.Close()
+				outputErr.Put(newPanicError("MapWithErrors", r))
+			}
+			outputErr.Close()
+			outputStream.Close()
+		}()
+
+		write := func(datapack Datapack) (streamClosed bool) {
+			if datapack == nil {
+				return false
+			}
+			if streamClosed = outputStream.Write(datapack); streamClosed {
+				// the consumer is gone, stop the upstream as well
+				inputStream.Close()
+			}
+			return streamClosed
+		}
+
+		dataCh, errCh := inputStream.dataCh, inputErr.errCh
+		failed := false
+	loop:
+		for idx := 0; dataCh != nil || errCh != nil; {
+			select {
+			case datapack, ok := <-dataCh:
+				inputStream.onRead(ok)
+				if !ok {
+					dataCh = nil
+					continue
+				}
+				if failed {
+					discard(datapack)
+					continue
+				}
+				result, err := datapack, error(nil)
+				if onData != nil {
+					result, err = onData(datapack)
+				}
+				if err != nil {
+					failed = true
+					inputStream.Close()
+					outputErr.Put(NewStreamError(StageHandler, idx, err))
+					continue
+				}
+				idx++
+				if meta := MetaOf(datapack); result != nil && meta != nil && MetaOf(result) == nil {
+					result = NewMetaDatapack(result.Context(), result.ReadCloser(), meta)
+				}
+				if write(result) {
+					break loop
+				}
+			case err, ok := <-errCh:
+				if !ok {
+					errCh = nil
+					continue
+				}
+				if err == nil {
+					continue
+				}
+				if onErr == nil {
+					outputErr.Put(err)
+					continue
+				}
+				marker, err := onErr(err)
+				if err != nil {
+					outputErr.Put(err)
+				}
+				if write(marker) {
+					break loop
+				}
+			case <-outputStream.CloseChan():
+				inputStream.Close()
+				break loop
+			}
+		}
+
+		// only reached with errors left if the consumer is gone, in which case they're passed as is
+		if errCh != nil {
+			passErrors(inputErr, outputErr)
+		}
+
+	}()
+
+	return outputStream, outputErr
+
+}
+
+// FlatMap explodes every datapack from inputStream into zero or more datapacks with fn and writes them into outputStream
+// in order, it's the inverse of Batch, a nil or empty result drops the datapack, errors from inputErr are passed through.
+// Like Map, the metadata of the input is attached to the results without their own.
+// NOTE: an error from fn is put into outputErr as a StreamError, and stops FlatMap as well as its upstream,
+// a panic in fn is recovered and put into outputErr as an error.
+func FlatMap(inputStream *IOStream, inputErr *ErrorPasser, fn func(Datapack) ([]Datapack, error)) (*IOStream, *ErrorPasser) {
+
+	if inputStream == nil || inputErr == nil {
+		return nil, nil
+	}
+
+	outputStream := NewIOStream()
+	outputErr := NewErrorPasserWithCap(inputErr.Cap() + 1)
+
+	go func() {
+
+		defer func() {
+			if r := recover(); r != nil {
+				inputStream.Close()
+				outputErr.Put(newPanicError("FlatMap", r))
+			}
+			outputErr.Close()
+			outputStream.Close()
+		}()
+
+		for idx, closed := 0, false; !closed; idx++ {
+			var datapack Datapack
+			if datapack, closed = inputStream.readUntil(outputStream); closed {
+				break
+			}
+
+			results, err := fn(datapack)
+			if err != nil {
+				inputStream.Close()
+				outputErr.Put(NewStreamError(StageHandler, idx, err))
+				break
+			}
+
+			meta := MetaOf(datapack)
+			for _, result := range results {
+				if result == nil {
+					continue
+				}
+				if closed {
+					// the consumer is gone, release the rest results
+					discard(result)
+					continue
+				}
+				if meta != nil && MetaOf(result) == nil {
+					result = NewMetaDatapack(result.Context(), result.ReadCloser(), meta)
+				}
+				if closed = outputStream.Write(result); closed {
+					inputStream.Close()
+				}
+			}
+		}
+
+		passErrors(inputErr, outputErr)
+
+	}()
+
+	return outputStream, outputErr
+
+}
+
+// Filter only forwards the datapacks which keep returns true, errors from inputErr are passed through.
+// The datapacks are forwarded as they are, so their metadata is kept.
+// NOTE: a panic in keep is recovered and put into outputErr as an error, only WithStageName in opts is used.
+func Filter(inputStream *IOStream, inputErr *ErrorPasser, keep func(Datapack) bool, opts ...Option) (
+	*IOStream, *ErrorPasser) {
+
+	if inputStream == nil || inputErr == nil {
+		return nil, nil
+	}
+
+	o := newOptions(opts...)
+
+	outputStream := NewIOStream()
+	outputErr := NewErrorPasserWithCap(inputErr.Cap() + 1)
+
+	go func() {
+
+		defer func() {
+			if r := recover(); r != nil {
+				inputStream.Close()
+				outputErr.Put(o.named(newPanicError("Filter", r)))
+			}
+			outputErr.Close()
+			outputStream.Close()
+		}()
+
+		for {
+			datapack, closed := inputStream.readUntil(outputStream)
+			if closed {
+				break
+			}
+			if !keep(datapack) {
+				continue
+			}
+			if streamClosed := outputStream.Write(datapack); streamClosed {
+				inputStream.Close()
+				break
+			}
+		}
+
+		passErrors(inputErr, outputErr)
+
+	}()
+
+	return outputStream, outputErr
+
+}
+
+// Inspect calls fn for every datapack from inputStream in order, then forwards it unchanged, e.g. for logging or metrics,
+// errors from inputErr are passed through.
+// WARN: fn gets the very datapack being forwarded, so it must not read or close its ReadCloser,
+// use InspectBuffered if fn needs the content.
+// NOTE: a panic in fn is recovered and put into outputErr as an error, and stops Inspect as well as its upstream.
+func Inspect(inputStream *IOStream, inputErr *ErrorPasser, fn func(Datapack)) (*IOStream, *ErrorPasser) {
+	return inspect("Inspect", inputStream, inputErr, fn, false)
+}
+
+// InspectBuffered is the same as Inspect, but fn gets a copy made by CloneDatapack, which fn may read freely,
+// while the other copy is forwarded, so every datapack is held in memory as a whole.
+// NOTE: an error of reading the datapack is put into outputErr as a StreamError, and stops InspectBuffered
+// as well as its upstream.
+func InspectBuffered(inputStream *IOStream, inputErr *ErrorPasser, fn func(Datapack)) (*IOStream, *ErrorPasser) {
+	return inspect("InspectBuffered", inputStream, inputErr, fn, true)
+}
+
+func inspect(name string, inputStream *IOStream, inputErr *ErrorPasser, fn func(Datapack), buffered bool) (
+	*IOStream, *ErrorPasser) {
+
+	if inputStream == nil || inputErr == nil {
+		return nil, nil
+	}
+
+	outputStream := NewIOStream()
+	outputErr := NewErrorPasserWithCap(inputErr.Cap() + 1)
+
+	go func() {
+
+		defer func() {
+			if r := recover(); r != nil {
+				inputStream.Close()
+				outputErr.Put(newPanicError(name, r))
+			}
+			outputErr.Close()
+			outputStream.Close()
+		}()
+
+		for idx := 0; ; idx++ {
+			datapack, closed := inputStream.readUntil(outputStream)
+			if closed {
+				break
+			}
+
+			inspected := datapack
+			if buffered {
+				var err error
+				if inspected, datapack, err = CloneDatapack(datapack); err != nil {
+					inputStream.Close()
+					outputErr.Put(NewStreamError(StageHandler, idx, err))
+					break
+				}
+			}
+			fn(inspected)
+
+			if streamClosed := outputStream.Write(datapack); streamClosed {
+				inputStream.Close()
+				break
+			}
+		}
+
+		passErrors(inputErr, outputErr)
+
+	}()
+
+	return outputStream, outputErr
+
+}
+
+// Dedup only forwards the first datapack of each key, errors returned by key are put into outputErr and the datapack is skipped.
+// NOTE: all the keys seen are kept in memory, use DedupWithMaxSize to bound it.
+func Dedup(inputStream *IOStream, inputErr *ErrorPasser, key func(Datapack) (string, error)) (*IOStream, *ErrorPasser) {
+	return DedupWithMaxSize(inputStream, inputErr, key, 0)
+}
+
+// DedupWithMaxSize is the same as Dedup, but keeps at most maxSize keys, the least recently seen key is evicted first,
+// so a datapack with an evicted key will be forwarded again, maxSize <= 0 means no limit.
+func DedupWithMaxSize(inputStream *IOStream, inputErr *ErrorPasser, key func(Datapack) (string, error), maxSize int) (
+	*IOStream, *ErrorPasser) {
+
+	if inputStream == nil || inputErr == nil {
+		return nil, nil
+	}
+
+	outputStream := NewIOStream()
+	outputErr := NewErrorPasserWithCap(inputErr.Cap() + 1)
+
+	go func() {
+
+		defer func() {
+			if r := recover(); r != nil {
+				inputStream.Close()
+				outputErr.Put(newPanicError("Dedup", r))
+			}
+			outputErr.Close()
+			outputStream.Close()
+		}()
+
+		seen := newKeyLRU(maxSize)
+
+		for {
+			datapack, closed := inputStream.readUntil(outputStream)
+			if closed {
+				break
+			}
+
+			k, err := key(datapack)
+			if err != nil {
+				outputErr.Put(err)
+				continue
+			}
+			if seen.touch(k) {
+				continue
+			}
+
+			if streamClosed := outputStream.Write(datapack); streamClosed {
+				inputStream.Close()
+				break
+			}
+		}
+
+		passErrors(inputErr, outputErr)
+
+	}()
+
+	return outputStream, outputErr
+
+}
+
+// Sample only forwards every Nth datapack (the Nth, the 2Nth ...) and discards the rest, errors from inputErr are passed
+// through, everyNth < 1 is treated as 1.
+// NOTE: the ReadClosers of the discarded datapacks are closed.
+func Sample(inputStream *IOStream, inputErr *ErrorPasser, everyNth int) (*IOStream, *ErrorPasser) {
+
+	if inputStream == nil || inputErr == nil {
+		return nil, nil
+	}
+
+	if everyNth < 1 {
+		everyNth = 1
+	}
+
+	outputStream := NewIOStream()
+	outputErr := NewErrorPasserWithCap(inputErr.Cap() + 1)
+
+	go func() {
+
+		defer func() {
+			if r := recover(); r != nil {
+				inputStream.Close()
+				outputErr.Put(newPanicError("Sample", r))
+			}
+			outputErr.Close()
+			outputStream.Close()
+		}()
+
+		for cnt := 1; ; cnt++ {
+			datapack, closed := inputStream.readUntil(outputStream)
+			if closed {
+				break
+			}
+			if cnt%everyNth != 0 {
+				discard(datapack)
+				continue
+			}
+			if streamClosed := outputStream.Write(datapack); streamClosed {
+				inputStream.Close()
+				break
+			}
+		}
+
+		passErrors(inputErr, outputErr)
+
+	}()
+
+	return outputStream, outputErr
+
+}
+
+// Take only forwards the first n datapacks, then closes outputStream, and closes inputStream to stop the upstream,
+// errors from inputErr are passed through. n <= 0 makes an empty and closed outputStream immediately.
+// NOTE: the datapacks still buffered in inputStream after the first n are neither forwarded nor closed.
+func Take(inputStream *IOStream, inputErr *ErrorPasser, n int) (*IOStream, *ErrorPasser) {
+
+	if inputStream == nil || inputErr == nil {
+		return nil, nil
+	}
+
+	outputStream := NewIOStream()
+	outputErr := NewErrorPasserWithCap(inputErr.Cap() + 1)
+
+	if n <= 0 {
+		inputStream.Close()
+		outputStream.Close()
+	}
+
+	go func() {
+
+		defer func() {
+			if r := recover(); r != nil {
+				inputStream.Close()
+				outputErr.Put(newPanicError("Take", r))
+			}
+			outputErr.Close()
+			outputStream.Close()
+		}()
+
+		for taken := 0; taken < n; taken++ {
+			datapack, closed := inputStream.readUntil(outputStream)
+			if closed {
+				break
+			}
+			if streamClosed := outputStream.Write(datapack); streamClosed {
+				break
+			}
+		}
+
+		// the consumer doesn't have to wait for the upstream errors
+		inputStream.Close()
+		outputStream.Close()
+
+		passErrors(inputErr, outputErr)
+
+	}()
+
+	return outputStream, outputErr
+
+}
+
+// Skip discards the first n datapacks and forwards the rest, errors from inputErr are passed through.
+// NOTE: the ReadClosers of the discarded datapacks are closed.
+func Skip(inputStream *IOStream, inputErr *ErrorPasser, n int) (*IOStream, *ErrorPasser) {
+
+	if inputStream == nil || inputErr == nil {
+		return nil, nil
+	}
+
+	outputStream := NewIOStream()
+	outputErr := NewErrorPasserWithCap(inputErr.Cap() + 1)
+
+	go func() {
+
+		defer func() {
+			if r := recover(); r != nil {
+				inputStream.Close()
+				outputErr.Put(newPanicError("Skip", r))
+			}
+			outputErr.Close()
+			outputStream.Close()
+		}()
+
+		for skipped := 0; ; skipped++ {
+			datapack, closed := inputStream.readUntil(outputStream)
+			if closed {
+				break
+			}
+			if skipped < n {
+				discard(datapack)
+				continue
+			}
+			if streamClosed := outputStream.Write(datapack); streamClosed {
+				inputStream.Close()
+				break
+			}
+		}
+
+		passErrors(inputErr, outputErr)
+
+	}()
+
+	return outputStream, outputErr
+
+}
+
+// discard closes the ReadCloser of datapack if there's one.
+func discard(datapack Datapack) {
+	if datapack == nil {
+		return
+	}
+	if rc := datapack.ReadCloser(); rc != nil {
+		rc.Close()
+	}
+}
+
+// keyLRU is a set of keys which evicts the least recently used key when it's full.
+type keyLRU struct {
+	maxSize int
+	order   *list.List
+	keys    map[string]*list.Element
+}
+
+func newKeyLRU(maxSize int) *keyLRU {
+	return &keyLRU{
+		maxSize: maxSize,
+		order:   list.New(),
+		keys:    make(map[string]*list.Element),
+	}
+}
+
+// touch adds k into the set, and returns whether k was already in it.
+func (l *keyLRU) touch(k string) (existed bool) {
+	if elem, ok := l.keys[k]; ok {
+		l.order.MoveToFront(elem)
+		return true
+	}
+	l.keys[k] = l.order.PushFront(k)
+	if l.maxSize > 0 && l.order.Len() > l.maxSize {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.keys, oldest.Value.(string))
+	}
+	return false
+}
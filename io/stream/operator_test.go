@@ -0,0 +1,460 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMap(t *testing.T) {
+
+	stream, ep := NewSafeIOStreamWriter(newStringProducer("a", "b", "c")).Start()
+
+	outputStream, outputErr := Map(stream, ep, func(datapack Datapack) (Datapack, error) {
+		bs, err := ioutil.ReadAll(datapack.ReadCloser())
+		if err != nil {
+			return nil, err
+		}
+		return newStringDatapack(strings.ToUpper(string(bs))), nil
+	})
+
+	assert.Equal(t, []string{"A", "B", "C"}, readStrings(t, outputStream))
+	assert.Nil(t, outputErr.Get())
+
+}
+
+func TestMapDrop(t *testing.T) {
+
+	stream, ep := NewSafeIOStreamWriter(newStringProducer("a", "b", "c")).Start()
+
+	outputStream, outputErr := Map(stream, ep, func(datapack Datapack) (Datapack, error) {
+		bs, err := ioutil.ReadAll(datapack.ReadCloser())
+		if err != nil || string(bs) == "b" {
+			return nil, err
+		}
+		return newStringDatapack(string(bs)), nil
+	})
+
+	assert.Equal(t, []string{"a", "c"}, readStrings(t, outputStream))
+	assert.Nil(t, outputErr.Get())
+
+}
+
+func TestMapErr(t *testing.T) {
+
+	stream, ep := NewSafeIOStreamWriter(newStringProducer("a", "b", "c")).Start()
+
+	mapErr := errors.New("map failed")
+	outputStream, outputErr := Map(stream, ep, func(datapack Datapack) (Datapack, error) {
+		bs, err := ioutil.ReadAll(datapack.ReadCloser())
+		if err != nil {
+			return nil, err
+		}
+		if string(bs) == "b" {
+			return nil, mapErr
+		}
+		return newStringDatapack(string(bs)), nil
+	})
+
+	assert.Equal(t, []string{"a"}, readStrings(t, outputStream))
+	assert.True(t, errors.Is(outputErr.Get(), mapErr))
+
+}
+
+func newStringDatapack(str string) Datapack {
+	return NewSimpleDatapack(context.Background(), ioutil.NopCloser(bytes.NewBufferString(str)))
+}
+
+func newStringProducer(strs ...string) DatapackProducer {
+	packs := make([]Datapack, 0, len(strs))
+	for _, str := range strs {
+		packs = append(packs, newStringDatapack(str))
+	}
+	return NewSliceDatapackProducer(packs)
+}
+
+// readStrings reads all datapacks from stream until it's closed.
+func readStrings(t *testing.T, stream *IOStream) []string {
+	strs := make([]string, 0)
+	for {
+		datapack, closed := stream.Read()
+		if closed {
+			return strs
+		}
+		bs, err := ioutil.ReadAll(datapack.ReadCloser())
+		assert.Nil(t, err)
+		strs = append(strs, string(bs))
+	}
+}
+
+func TestMapWithErrors(t *testing.T) {
+
+	// unbuffered, so the datapacks and the errors arrive in the order they're written: a, boom, b
+	upstream := func() (*IOStream, *ErrorPasser) {
+		stream, ep := NewIOStreamWithCap(0), NewErrorPasserWithCap(0)
+		go func() {
+			stream.Write(newStringDatapack("a"))
+			ep.Put(errors.New("boom"))
+			stream.Write(newStringDatapack("b"))
+			stream.Close()
+			ep.Close()
+		}()
+		return stream, ep
+	}
+	upper := func(datapack Datapack) (Datapack, error) {
+		bs, err := ReadAllAndClose(datapack)
+		return newStringDatapack(strings.ToUpper(string(bs))), err
+	}
+	marker := func(err error) (Datapack, error) {
+		return newStringDatapack("error marker: " + err.Error()), nil
+	}
+
+	// the error is turned into a marker datapack and swallowed
+	stream, ep := upstream()
+	outputStream, outputErr := MapWithErrors(stream, ep, upper, marker)
+	assert.Equal(t, []string{"A", "error marker: boom", "B"}, readStrings(t, outputStream))
+	assert.Empty(t, outputErr.Drain())
+
+	// the marker is emitted and the error is forwarded as well, with the datapacks as they are
+	stream, ep = upstream()
+	outputStream, outputErr = MapWithErrors(stream, ep, nil, func(err error) (Datapack, error) {
+		marker, _ := marker(err)
+		return marker, err
+	})
+	datapacks, errs := Collect(outputStream, outputErr)
+	assert.Len(t, datapacks, 3)
+	assert.Equal(t, []error{errors.New("boom")}, errs)
+
+	// an error from onData stops the data, while the upstream errors are still handled
+	stream, ep = upstream()
+	outputStream, outputErr = MapWithErrors(stream, ep, func(Datapack) (Datapack, error) {
+		return nil, errors.New("bad data")
+	}, marker)
+	strs := readStrings(t, outputStream)
+	errs = outputErr.Drain()
+	t.Logf("strs = %v, errs = %v", strs, errs)
+	assert.Equal(t, []string{"error marker: boom"}, strs)
+	assert.Len(t, errs, 1)
+	var streamErr *StreamError
+	assert.True(t, errors.As(errs[0], &streamErr))
+	assert.Equal(t, 0, streamErr.Index)
+
+}
+
+func TestFlatMap(t *testing.T) {
+
+	// "a,b,c" -> "a", "b", "c", and "" -> nothing
+	split := func(datapack Datapack) ([]Datapack, error) {
+		bs, err := ReadAllAndClose(datapack)
+		if err != nil {
+			return nil, err
+		}
+		if len(bs) == 0 {
+			return nil, nil
+		}
+		results := make([]Datapack, 0)
+		for _, str := range strings.Split(string(bs), ",") {
+			results = append(results, newStringDatapack(str))
+		}
+		return results, nil
+	}
+
+	stream, ep := NewSafeIOStreamWriter(newStringProducer("a,b,c", "", "d", "e,f")).Start()
+	outputStream, outputErr := FlatMap(stream, ep, split)
+	assert.Equal(t, []string{"a", "b", "c", "d", "e", "f"}, readStrings(t, outputStream))
+	assert.Empty(t, outputErr.Drain())
+
+	// the metadata of the input is kept
+	outputStream, outputErr = FlatMap(NewClosedIOStream(newMetaDatapack("x,y", map[string]string{"k": "v"})),
+		NewClosedErrorPasser(), split)
+	datapacks, errs := Collect(outputStream, outputErr)
+	assert.Empty(t, errs)
+	assert.Len(t, datapacks, 2)
+	for _, datapack := range datapacks {
+		assert.Equal(t, map[string]string{"k": "v"}, MetaOf(datapack))
+	}
+
+}
+
+func TestFlatMapErr(t *testing.T) {
+
+	flatErr := errors.New("flat failed")
+	inputStream := NewClosedIOStream(newStringDatapack("a"), newStringDatapack("b"), newStringDatapack("c"))
+	outputStream, outputErr := FlatMap(inputStream, NewClosedErrorPasser(errors.New("upstream err")),
+		func(datapack Datapack) ([]Datapack, error) {
+			bs, _ := ReadAllAndClose(datapack)
+			if string(bs) == "b" {
+				return nil, flatErr
+			}
+			return []Datapack{newStringDatapack(string(bs)), nil}, nil
+		})
+
+	assert.Equal(t, []string{"a"}, readStrings(t, outputStream))
+	errs := outputErr.Drain()
+	assert.Len(t, errs, 2)
+	streamErr := &StreamError{}
+	assert.True(t, errors.As(errs[0], &streamErr))
+	assert.Equal(t, 1, streamErr.Index)
+	assert.True(t, errors.Is(errs[0], flatErr))
+	assert.Equal(t, "upstream err", errs[1].Error())
+
+	// a panic is recovered
+	outputStream, outputErr = FlatMap(NewClosedIOStream(newStringDatapack("a")), NewClosedErrorPasser(),
+		func(Datapack) ([]Datapack, error) {
+			panic("bad fn")
+		})
+	_, closed := outputStream.Read()
+	assert.True(t, closed)
+	assert.Equal(t, "FlatMap panicked, err = bad fn", outputErr.Get().Error())
+
+}
+
+func TestFilter(t *testing.T) {
+
+	upstreamErr := errors.New("upstream err")
+
+	cases := []struct {
+		keep     func(Datapack) bool
+		expected []string
+	}{
+		{
+			keep:     func(Datapack) bool { return false },
+			expected: []string{},
+		},
+		{
+			keep:     func(Datapack) bool { return true },
+			expected: []string{"a", "b", "c"},
+		},
+	}
+
+	for _, c := range cases {
+		outputStream, outputErr := Filter(
+			NewClosedIOStream(newStringDatapack("a"), newStringDatapack("b"), newStringDatapack("c")),
+			NewClosedErrorPasser(upstreamErr),
+			c.keep,
+		)
+		assert.Equal(t, c.expected, readStrings(t, outputStream))
+		assert.Equal(t, upstreamErr, outputErr.Get())
+		assert.Nil(t, outputErr.Get())
+	}
+
+}
+
+func TestFilterPanic(t *testing.T) {
+
+	stream, ep := NewSafeIOStreamWriter(newStringProducer("a", "b", "c")).Start()
+
+	outputStream, outputErr := Filter(stream, ep, func(Datapack) bool {
+		panic("filter panic")
+	})
+
+	assert.Equal(t, []string{}, readStrings(t, outputStream))
+	err := outputErr.Get()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "filter panic")
+
+}
+
+func TestFilterKeepsDatapack(t *testing.T) {
+
+	batch := NewBatchDatapack([]Datapack{newStringDatapack("a"), newStringDatapack("b")})
+	empty := NewSimpleDatapack(context.Background(), nil)
+
+	seen := make([]Datapack, 0)
+	outputStream, outputErr := Filter(NewClosedIOStream(batch, empty), NewClosedErrorPasser(), func(datapack Datapack) bool {
+		seen = append(seen, datapack)
+		return true
+	})
+
+	datapacks, errs := Collect(outputStream, outputErr)
+	assert.Empty(t, errs)
+	assert.Equal(t, []Datapack{batch, empty}, seen)
+	assert.Equal(t, []Datapack{batch, empty}, datapacks)
+	assert.Len(t, datapacks[0].(*BatchDatapack).Datapacks(), 2)
+
+}
+
+func TestInspect(t *testing.T) {
+
+	inputs := []Datapack{newStringDatapack("a"), newMetaDatapack("b", map[string]string{"k": "v"}), newStringDatapack("c")}
+	seen := make([]Datapack, 0)
+	outputStream, outputErr := Inspect(NewClosedIOStream(inputs...), NewClosedErrorPasser(errors.New("upstream err")),
+		func(datapack Datapack) {
+			seen = append(seen, datapack)
+		})
+
+	datapacks, errs := Collect(outputStream, outputErr)
+	assert.Equal(t, inputs, seen)
+	assert.Equal(t, inputs, datapacks)
+	assert.Equal(t, []error{errors.New("upstream err")}, errs)
+	for i, str := range []string{"a", "b", "c"} {
+		bs, err := ReadAllAndClose(datapacks[i])
+		assert.Nil(t, err)
+		assert.Equal(t, str, string(bs))
+	}
+
+	// a panic in fn stops the stage
+	outputStream, outputErr = Inspect(NewClosedIOStream(newStringDatapack("a")), NewClosedErrorPasser(), func(Datapack) {
+		panic("inspect panic")
+	})
+	assert.Equal(t, []string{}, readStrings(t, outputStream))
+	err := outputErr.Get()
+	assert.NotNil(t, err)
+	t.Logf("err = %v", err)
+	assert.Contains(t, err.Error(), "inspect panic")
+
+}
+
+func TestInspectBuffered(t *testing.T) {
+
+	inspected := make([]string, 0)
+	outputStream, outputErr := InspectBuffered(
+		NewClosedIOStream(newStringDatapack("a"), newMetaDatapack("b", map[string]string{"k": "v"}), newStringDatapack("c")),
+		NewClosedErrorPasser(),
+		func(datapack Datapack) {
+			// the copy can be consumed
+			bs, _ := ReadAllAndClose(datapack)
+			inspected = append(inspected, string(bs))
+		})
+
+	datapacks, errs := Collect(outputStream, outputErr)
+	assert.Empty(t, errs)
+	assert.Equal(t, []string{"a", "b", "c"}, inspected)
+	assert.Equal(t, map[string]string{"k": "v"}, MetaOf(datapacks[1]))
+	for i, str := range inspected {
+		bs, err := ReadAllAndClose(datapacks[i])
+		assert.Nil(t, err)
+		assert.Equal(t, str, string(bs))
+	}
+
+}
+
+func TestDedup(t *testing.T) {
+
+	content := func(datapack Datapack) (string, error) {
+		bs, err := ioutil.ReadAll(datapack.ReadCloser())
+		if err != nil {
+			return "", err
+		}
+		if string(bs) == "bad" {
+			return "", errors.New("bad key")
+		}
+		return string(bs), nil
+	}
+
+	stream, ep := NewSafeIOStreamWriter(newStringProducer("a", "b", "a", "bad", "c", "b")).Start()
+	outputStream, outputErr := Dedup(stream, ep, content)
+
+	// the content is consumed by key, so check the count only
+	datapacks, errs := Collect(outputStream, outputErr)
+	assert.Len(t, datapacks, 3)
+	assert.Equal(t, []error{errors.New("bad key")}, errs)
+
+}
+
+func TestDedupEviction(t *testing.T) {
+
+	key := func(datapack Datapack) (string, error) {
+		return datapack.Context().Value("key").(string), nil
+	}
+
+	datapacks := make([]Datapack, 0)
+	for _, k := range []string{"a", "b", "a", "c", "b", "a"} {
+		datapacks = append(datapacks, NewSimpleDatapack(context.WithValue(context.Background(), "key", k), nil))
+	}
+
+	// a b (a hit) c -> evicts b, b -> evicts a, a
+	outputStream, outputErr := DedupWithMaxSize(NewClosedIOStream(datapacks...), NewClosedErrorPasser(), key, 2)
+	forwarded, errs := Collect(outputStream, outputErr)
+	assert.Empty(t, errs)
+
+	forwardedKeys := make([]string, 0)
+	for _, datapack := range forwarded {
+		forwardedKeys = append(forwardedKeys, datapack.Context().Value("key").(string))
+	}
+	assert.Equal(t, []string{"a", "b", "c", "b", "a"}, forwardedKeys)
+
+}
+
+func TestSample(t *testing.T) {
+
+	rcs := make([]*closeRecorder, 0)
+	datapacks := make([]Datapack, 0)
+	for i := 1; i <= 10; i++ {
+		rc := &closeRecorder{Reader: bytes.NewBufferString(strings.Repeat("x", i))}
+		rcs = append(rcs, rc)
+		datapacks = append(datapacks, NewSimpleDatapack(context.Background(), rc))
+	}
+
+	inputErr := errors.New("upstream error")
+	outputStream, outputErr := Sample(NewClosedIOStream(datapacks...), NewClosedErrorPasser(inputErr), 3)
+
+	assert.Equal(t, []string{"xxx", "xxxxxx", "xxxxxxxxx"}, readStrings(t, outputStream))
+	assert.Equal(t, []error{inputErr}, outputErr.Drain())
+	for i, rc := range rcs {
+		// the forwarded ones are read but not closed by readStrings
+		assert.Equal(t, (i+1)%3 != 0, rc.closed, "datapack %d", i+1)
+	}
+
+	// everyNth < 1 forwards all
+	stream, ep := NewSafeIOStreamWriter(newStringProducer("a", "b")).Start()
+	outputStream, _ = Sample(stream, ep, 0)
+	assert.Equal(t, []string{"a", "b"}, readStrings(t, outputStream))
+
+}
+
+func TestTake(t *testing.T) {
+
+	// the producer never ends, Take stops it
+	stream, ep := NewSafeIOStreamWriter(&countProducer{cnt: math.MaxInt32}).Start()
+	outputStream, outputErr := Take(stream, ep, 3)
+	assert.Equal(t, []string{"1", "2", "3"}, readStrings(t, outputStream))
+	assert.Empty(t, outputErr.Drain())
+	assert.True(t, stream.Closed())
+
+	// fewer than n
+	stream, ep = NewSafeIOStreamWriter(newStringProducer("a", "b")).Start()
+	outputStream, outputErr = Take(stream, ep, 3)
+	assert.Equal(t, []string{"a", "b"}, readStrings(t, outputStream))
+	assert.Empty(t, outputErr.Drain())
+
+	// take 0
+	inputStream := NewIOStream()
+	outputStream, outputErr = Take(inputStream, NewClosedErrorPasser(errors.New("e")), 0)
+	assert.True(t, outputStream.Closed())
+	assert.True(t, inputStream.Closed())
+	assert.Empty(t, readStrings(t, outputStream))
+	assert.Len(t, outputErr.Drain(), 1)
+
+}
+
+func TestSkip(t *testing.T) {
+
+	rcs := make([]*closeRecorder, 0)
+	datapacks := make([]Datapack, 0)
+	for _, str := range []string{"a", "b", "c", "d"} {
+		rc := &closeRecorder{Reader: bytes.NewBufferString(str)}
+		rcs = append(rcs, rc)
+		datapacks = append(datapacks, NewSimpleDatapack(context.Background(), rc))
+	}
+
+	outputStream, outputErr := Skip(NewClosedIOStream(datapacks...), NewClosedErrorPasser(), 2)
+	assert.Equal(t, []string{"c", "d"}, readStrings(t, outputStream))
+	assert.Empty(t, outputErr.Drain())
+	assert.True(t, rcs[0].closed)
+	assert.True(t, rcs[1].closed)
+	assert.False(t, rcs[2].closed)
+
+	// fewer than n
+	stream, ep := NewSafeIOStreamWriter(newStringProducer("a", "b")).Start()
+	outputStream, outputErr = Skip(stream, ep, 3)
+	assert.Empty(t, readStrings(t, outputStream))
+	assert.Empty(t, outputErr.Drain())
+
+}
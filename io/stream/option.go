@@ -0,0 +1,242 @@
+package stream
+
+import "time"
+
+// Option configures the stages (SafeIOStreamHandler etc.) of a stream.
+type Option func(*options)
+
+type options struct {
+	handlerTimeout  time.Duration
+	metrics         StreamMetrics
+	tracer          Tracer
+	clock           Clock
+	logger          Logger
+	outputStreamCap int
+	outputErrCap    int
+	backpressure    bool
+	continueOnPanic bool
+	continueOnError bool
+	bestEffortErrs  bool
+	timeout         time.Duration
+	finalizeLate    bool
+	keepExpired     bool
+	panicFilter     func(r interface{}) (rethrow bool)
+	retry           *handlerRetry
+	middlewares     []HandlerMiddleware
+	stageName       string
+}
+
+type handlerRetry struct {
+	maxAttempts int
+	backoff     func(attempt int) time.Duration
+	retryable   func(err error) bool
+}
+
+func newOptions(opts ...Option) options {
+	o := options{
+		metrics: noopMetrics{},
+		tracer:  noopTracer{},
+		clock:   realClock{},
+		logger:  noopLogger{},
+	}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(&o)
+		}
+	}
+	return o
+}
+
+// WithHandlerTimeout limits the duration of each datapackHandler call, d <= 0 means no limit.
+// NOTE: the deadline is derived from the context of the datapack, when it fires the handler call is abandoned:
+// its ctx is done and the ReadCloser is closed, but the call keeps running in its own goroutine until it returns,
+// so the handler should respect ctx to avoid goroutine leaks.
+func WithHandlerTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.handlerTimeout = d
+	}
+}
+
+// WithTimeout limits the whole run of SafeIOStreamWriter or SafeIOStreamHandler, d <= 0 means no limit.
+// Once the limit is hit, the stage stops and puts a single context.DeadlineExceeded into its outputErr.
+// The datapacks written by SafeIOStreamWriter carry the deadline, so the in-flight handlers of the downstream stages
+// observe it through their ctx, and the errors caused by it are not reported again by SafeIOStreamHandler.
+func WithTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.timeout = d
+	}
+}
+
+// WithHandlerRetry makes SafeIOStreamHandler call the handler (or transformer) at most maxAttempts times for a datapack,
+// as long as the error is retryable, nil retryable means IsRetryable, and maxAttempts <= 1 means no retry.
+// backoff returns the duration to wait before the given retry (starts from 1), nil backoff means no waiting,
+// only the error of the last attempt is put into outputErr, and a panic is never retried.
+// WARN: the ReadCloser of the datapack can only be read once, so the whole content is read into memory before
+// the first attempt, and every attempt reads a copy of it.
+func WithHandlerRetry(maxAttempts int, backoff func(attempt int) time.Duration, retryable func(err error) bool) Option {
+	return func(o *options) {
+		if maxAttempts <= 1 {
+			o.retry = nil
+			return
+		}
+		o.retry = &handlerRetry{
+			maxAttempts: maxAttempts,
+			backoff:     backoff,
+			retryable:   retryable,
+		}
+	}
+}
+
+// WithMiddleware wraps the handler (or transformer, mapper) of SafeIOStreamHandler with the middlewares in order,
+// the first one is the outermost, and the middlewares of multiple WithMiddleware calls are appended.
+// NOTE: the middlewares run inside WithHandlerTimeout and WithHandlerRetry, so every attempt goes through them,
+// and a panic in a middleware is treated the same as a panic in the handler.
+func WithMiddleware(middlewares ...HandlerMiddleware) Option {
+	return func(o *options) {
+		o.middlewares = append(o.middlewares, middlewares...)
+	}
+}
+
+// WithSkipExpired controls whether SafeIOStreamHandler skips the datapacks whose context is already done when they're
+// read, which is the default, the ReadCloser of a skipped datapack is closed and its ctx.Err() is handled like
+// a handler error, so WithContinueOnError decides whether the handler goes on.
+// NOTE: the datapacks expired because of the context of an upstream SafeIOStreamWriter are skipped silently,
+// since the writer reports it.
+func WithSkipExpired(skip bool) Option {
+	return func(o *options) {
+		o.keepExpired = !skip
+	}
+}
+
+// WithFinalizerAfterConsumed makes SafeIOStreamHandler run the finalizer only after a consumer of outputStream has got
+// streamClosed from it, which means all the emitted datapacks have been read out, so the finalizer can release
+// the resources referenced by them, as long as the consumer is done with each datapack before reading the next one.
+// WARN: the finalizer never runs (and Wait blocks) if nobody reads outputStream until it's closed.
+func WithFinalizerAfterConsumed(afterConsumed bool) Option {
+	return func(o *options) {
+		o.finalizeLate = afterConsumed
+	}
+}
+
+// WithPanicFilter lets filter decide whether a panic recovered by SafeIOStreamWriter or SafeIOStreamHandler
+// should be converted into an error (the default), or re-panicked to crash, e.g. for the programming bugs in development.
+// NOTE: the re-panic happens in the goroutine of the stage, so it can't be recovered by the caller.
+func WithPanicFilter(filter func(r interface{}) (rethrow bool)) Option {
+	return func(o *options) {
+		o.panicFilter = filter
+	}
+}
+
+// WithClock makes the time-based stages (Batch, TimeWindow, WithHandlerTimeout and LastActivity of SafeIOStreamHandler) tell the time
+// by c instead of the wall clock, e.g. a FakeClock in tests, a nil c is ignored.
+// NOTE: with a clock other than the wall clock, the ctx of a timed out handler call is canceled without a deadline.
+func WithClock(c Clock) Option {
+	return func(o *options) {
+		if c != nil {
+			o.clock = c
+		}
+	}
+}
+
+// WithMetrics attaches m to SafeIOStreamHandler, a nil m is ignored.
+func WithMetrics(m StreamMetrics) Option {
+	return func(o *options) {
+		if m != nil {
+			o.metrics = m
+		}
+	}
+}
+
+// WithTracer attaches t to SafeIOStreamHandler, so each datapackHandler call runs under its own span, a nil t is ignored.
+func WithTracer(t Tracer) Option {
+	return func(o *options) {
+		if t != nil {
+			o.tracer = t
+		}
+	}
+}
+
+// WithContinueOnPanic makes SafeIOStreamHandler skip the datapack whose handler call panicked and go on with the next one,
+// the recovered panic is still put into outputErr as an error.
+func WithContinueOnPanic(continueOnPanic bool) Option {
+	return func(o *options) {
+		o.continueOnPanic = continueOnPanic
+	}
+}
+
+// WithContinueOnError makes SafeIOStreamHandler go on with the next datapack when a handler call returned an error,
+// the error is still put into outputErr, and the errors from inputErr are passed through after inputStream is drained.
+// NOTE: a fatal error (see MarkFatal) still stops the handler.
+func WithContinueOnError(continueOnError bool) Option {
+	return func(o *options) {
+		o.continueOnError = continueOnError
+	}
+}
+
+// WithLogger attaches l to SafeIOStreamWriter or SafeIOStreamHandler, a nil l is ignored.
+func WithLogger(l Logger) Option {
+	return func(o *options) {
+		if l != nil {
+			o.logger = l
+		}
+	}
+}
+
+// WithOutputStreamCap sets the capacity of the stream returned by SafeIOStreamWriter, n <= 0 means the default one.
+func WithOutputStreamCap(n int) Option {
+	return func(o *options) {
+		o.outputStreamCap = n
+	}
+}
+
+// WithOutputErrCap sets the capacity of the outputErr built by SafeIOStreamHandler, n <= 0 means the default one,
+// which only has room for the errors of inputErr plus the few errors a handler puts before it stops.
+// NOTE: with WithContinueOnError or WithContinueOnPanic, the errors beyond the capacity block the workers until
+// outputErr is read, so give it room for all the expected errors if outputErr is only read after the stream is done.
+func WithOutputErrCap(n int) Option {
+	return func(o *options) {
+		o.outputErrCap = n
+	}
+}
+
+// WithBackpressure makes SafeIOStreamWriter wait until there's room in its output stream before calling Next,
+// so expensive fetches are not done ahead of a slow consumer.
+func WithBackpressure(backpressure bool) Option {
+	return func(o *options) {
+		o.backpressure = backpressure
+	}
+}
+
+// WithBestEffortErrors makes SafeIOStreamHandler report errors with ErrorPasser.TryPut,
+// so a stuck error consumer can't block the workers.
+// NOTE: errors are dropped (and logged) when the error buffer is full.
+func WithBestEffortErrors(bestEffort bool) Option {
+	return func(o *options) {
+		o.bestEffortErrs = bestEffort
+	}
+}
+
+// WithStageName names the stage (SafeIOStreamWriter, SafeIOStreamHandler, Map, Filter, Batch, TimeWindow),
+// so the errors raised by the stage itself are wrapped into a NamedError, while those passed through are untouched,
+// which tells the stage of an error apart in a long pipeline, an empty name means no wrapping.
+func WithStageName(name string) Option {
+	return func(o *options) {
+		o.stageName = name
+	}
+}
+
+// named wraps err into a NamedError if the stage is named.
+func (o options) named(err error) error {
+	if o.stageName == "" || err == nil {
+		return err
+	}
+	return &NamedError{
+		Name: o.stageName,
+		Err:  err,
+	}
+}
+
+// rethrow reports whether the recovered r should be re-panicked.
+func (o options) rethrow(r interface{}) bool {
+	return o.panicFilter != nil && o.panicFilter(r)
+}
@@ -0,0 +1,49 @@
+// Package otel provides an OpenTelemetry implementation of stream.Tracer,
+// it's a separate package so that the users of stream who don't need it won't import OpenTelemetry.
+package otel
+
+import (
+	"context"
+
+	"github.com/sshelll/sinfra/io/stream"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// DefaultSpanName is the name of the spans if it's not specified.
+const DefaultSpanName = "stream.handle"
+
+var _ stream.Tracer = (*Tracer)(nil)
+
+// Tracer implements stream.Tracer, it starts a span with the context of the datapack as parent for each handler call,
+// the span has a "datapack.index" attribute, and records the error of the call.
+type Tracer struct {
+	tracer   trace.Tracer
+	spanName string
+}
+
+// NewTracer creates a Tracer with t, an empty spanName means DefaultSpanName.
+func NewTracer(t trace.Tracer, spanName string) *Tracer {
+	if spanName == "" {
+		spanName = DefaultSpanName
+	}
+	return &Tracer{
+		tracer:   t,
+		spanName: spanName,
+	}
+}
+
+func (t *Tracer) StartSpan(ctx context.Context, idx int) (context.Context, func(error)) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, span := t.tracer.Start(ctx, t.spanName, trace.WithAttributes(attribute.Int("datapack.index", idx)))
+	return ctx, func(err error) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
@@ -0,0 +1,72 @@
+package otel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/sshelll/sinfra/io/stream"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracer(t *testing.T) {
+
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defer provider.Shutdown(context.Background())
+
+	// the datapacks share a parent span
+	parentCtx, parent := provider.Tracer("test").Start(context.Background(), "parent")
+	datapacks := make([]stream.Datapack, 0)
+	for _, str := range []string{"a", "bad", "c"} {
+		datapacks = append(datapacks, stream.NewSimpleDatapack(parentCtx, ioutil.NopCloser(strings.NewReader(str))))
+	}
+
+	safeHandler := stream.NewSafeIOStreamHandler(stream.NewClosedIOStream(datapacks...), stream.NewClosedErrorPasser(),
+		func(ctx context.Context, rc io.ReadCloser) error {
+			assert.True(t, trace.SpanFromContext(ctx).SpanContext().IsValid())
+			bs, _ := ioutil.ReadAll(rc)
+			if string(bs) == "bad" {
+				return errors.New("bad datapack")
+			}
+			return nil
+		}, nil, stream.WithTracer(NewTracer(provider.Tracer("test"), "")), stream.WithContinueOnError(true))
+	_, outputErr := safeHandler.BuildStream()
+	safeHandler.Start()
+	outputErr.Drain()
+	parent.End()
+
+	spans := exporter.GetSpans()
+	handled := make(tracetest.SpanStubs, 0)
+	for _, span := range spans {
+		if span.Name == DefaultSpanName {
+			handled = append(handled, span)
+		}
+	}
+	assert.Len(t, handled, 3)
+
+	sort.Slice(handled, func(i, j int) bool {
+		return handled[i].StartTime.Before(handled[j].StartTime)
+	})
+	for i, span := range handled {
+		assert.Equal(t, parent.SpanContext().SpanID(), span.Parent.SpanID())
+		assert.Contains(t, span.Attributes, attribute.Int("datapack.index", i))
+		if i == 1 {
+			assert.Equal(t, codes.Error, span.Status.Code)
+			assert.Equal(t, "bad datapack", span.Status.Description)
+			assert.Len(t, span.Events, 1)
+		} else {
+			assert.Equal(t, codes.Unset, span.Status.Code)
+		}
+	}
+
+}
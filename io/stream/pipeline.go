@@ -0,0 +1,114 @@
+package stream
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Pipeline chains a SafeIOStreamWriter and a series of Processors fluently, e.g.
+//
+//	NewPipeline(producer).Map(fn).Filter(keep).Batch(10, time.Second).Run()
+//
+// NOTE: the stages are not started until Run is called, and a Pipeline should only be run once, see Shutdown for
+// stopping it.
+type Pipeline struct {
+	writer *SafeIOStreamWriter
+	procs  []Processor
+	mu     *sync.Mutex
+	// outputs of the writer and every stage, in order, set by Run
+	outputs []*IOStream
+}
+
+func NewPipeline(producer DatapackProducer, opts ...Option) *Pipeline {
+	return &Pipeline{
+		writer: NewSafeIOStreamWriter(producer, opts...),
+		procs:  make([]Processor, 0),
+		mu:     &sync.Mutex{},
+	}
+}
+
+// Then appends a custom Processor to the pipeline.
+func (p *Pipeline) Then(proc Processor) *Pipeline {
+	if proc != nil {
+		p.procs = append(p.procs, proc)
+	}
+	return p
+}
+
+// Map appends a Map stage, opts (e.g. WithStageName) only apply to this stage.
+func (p *Pipeline) Map(fn func(Datapack) (Datapack, error), opts ...Option) *Pipeline {
+	return p.Then(func(inputStream *IOStream, inputErr *ErrorPasser) (*IOStream, *ErrorPasser) {
+		return Map(inputStream, inputErr, fn, opts...)
+	})
+}
+
+// Filter appends a Filter stage, opts (e.g. WithStageName) only apply to this stage.
+func (p *Pipeline) Filter(keep func(Datapack) bool, opts ...Option) *Pipeline {
+	return p.Then(func(inputStream *IOStream, inputErr *ErrorPasser) (*IOStream, *ErrorPasser) {
+		return Filter(inputStream, inputErr, keep, opts...)
+	})
+}
+
+// Batch appends a Batch stage, opts (e.g. WithStageName) only apply to this stage.
+func (p *Pipeline) Batch(size int, flush time.Duration, opts ...Option) *Pipeline {
+	return p.Then(func(inputStream *IOStream, inputErr *ErrorPasser) (*IOStream, *ErrorPasser) {
+		return Batch(inputStream, inputErr, size, flush, opts...)
+	})
+}
+
+// Run starts the writer and all the stages, and returns the output of the last stage.
+func (p *Pipeline) Run() (*IOStream, *ErrorPasser) {
+
+	outputStream, outputErr := p.writer.Start()
+	outputs := []*IOStream{outputStream}
+
+	// run the stages one by one instead of by BuildProcChain, so that Shutdown can watch each of them
+	for _, proc := range p.procs {
+		outputStream, outputErr = proc(outputStream, outputErr)
+		outputs = append(outputs, outputStream)
+	}
+
+	p.mu.Lock()
+	p.outputs = outputs
+	p.mu.Unlock()
+
+	return outputStream, outputErr
+
+}
+
+// Shutdown stops the writer, then waits for the writer and the stages to finish in order,
+// a stage is finished once its output stream is closed, which happens after its upstream is closed and drained.
+// If ctx is done before all of them finish, the output streams of the unfinished ones are closed to tear them down,
+// and an error wrapping ctx.Err() is returned. Shutdown returns nil at once if Run has not been called.
+// NOTE: the output of the last stage (both the stream and the ErrorPasser) should still be consumed during Shutdown,
+// otherwise the stages may block on writing and end up being torn down when ctx is done.
+func (p *Pipeline) Shutdown(ctx context.Context) error {
+
+	p.mu.Lock()
+	outputs := p.outputs
+	p.mu.Unlock()
+
+	p.writer.Stop()
+	for i, stream := range outputs {
+		if stream == nil {
+			continue
+		}
+		select {
+		case <-stream.CloseChan():
+		case <-ctx.Done():
+			for _, unfinished := range outputs[i:] {
+				if unfinished != nil {
+					unfinished.Close()
+				}
+			}
+			if i == 0 {
+				return fmt.Errorf("pipeline shutdown: writer not finished: %w", ctx.Err())
+			}
+			return fmt.Errorf("pipeline shutdown: stage %d not finished: %w", i, ctx.Err())
+		}
+	}
+	return nil
+
+}
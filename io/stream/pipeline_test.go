@@ -0,0 +1,246 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPipeline(t *testing.T) {
+
+	upper := func(datapack Datapack) (Datapack, error) {
+		bs, err := ioutil.ReadAll(datapack.ReadCloser())
+		if err != nil {
+			return nil, err
+		}
+		return newStringDatapack(strings.ToUpper(string(bs))), nil
+	}
+
+	skipped := 0
+	keep := func(Datapack) bool {
+		skipped++
+		return skipped%2 == 1
+	}
+
+	outputStream, outputErr := NewPipeline(newStringProducer("a", "b", "c", "d", "e")).
+		Map(upper).
+		Filter(keep).
+		Batch(2, 0).
+		Run()
+
+	assert.Equal(t, []string{"AC", "E"}, readStrings(t, outputStream))
+	assert.Empty(t, outputErr.Drain())
+
+}
+
+func TestTakeStopsUpstream(t *testing.T) {
+
+	goroutineCnt := runtime.NumGoroutine()
+
+	writer := NewSafeIOStreamWriter(&countProducer{cnt: math.MaxInt32})
+	stream, ep := writer.Start()
+	stream, ep = Map(stream, ep, func(datapack Datapack) (Datapack, error) {
+		bs, err := ReadAllAndClose(datapack)
+		if err != nil {
+			return nil, err
+		}
+		return NewBytesDatapack(datapack.Context(), bs), nil
+	})
+	// nothing passes the filter after the first 3, so it never writes again to find its consumer gone
+	var kept int32
+	stream, ep = Filter(stream, ep, func(Datapack) bool {
+		return atomic.AddInt32(&kept, 1) <= 3
+	})
+	stream, ep = Sample(stream, ep, 1)
+	outputStream, outputErr := Take(stream, ep, 3)
+
+	datapacks, errs := Collect(outputStream, outputErr)
+	assert.Len(t, datapacks, 3)
+	assert.Empty(t, errs)
+
+	stopped := make(chan struct{})
+	go func() {
+		writer.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second * 3):
+		t.Fatal("the producer is not stopped")
+	}
+	assertNoGoroutineLeak(t, goroutineCnt)
+
+}
+
+func TestPipelineStageName(t *testing.T) {
+
+	mapErr := errors.New("map failed")
+	mapFn := func(datapack Datapack) (Datapack, error) {
+		bs, _ := ReadAllAndClose(datapack)
+		if string(bs) == "b" {
+			return nil, mapErr
+		}
+		return NewBytesDatapack(datapack.Context(), bs), nil
+	}
+	keepAll := func(Datapack) bool {
+		return true
+	}
+
+	outputStream, outputErr := NewPipeline(newStringProducer("a", "b", "c"), WithStageName("source")).
+		Map(mapFn, WithStageName("map"), WithContinueOnError(true)).
+		Filter(keepAll, WithStageName("filter")).
+		Batch(2, 0, WithStageName("batch")).
+		Run()
+
+	assert.Equal(t, []string{"ac"}, readStrings(t, outputStream))
+	errs := outputErr.Drain()
+	assert.Len(t, errs, 1)
+	assert.Equal(t, "map", StageName(errs[0]))
+	assert.True(t, strings.HasPrefix(errs[0].Error(), `stage="map": `))
+
+	// the name composes with StreamError
+	streamErr := &StreamError{}
+	assert.True(t, errors.As(errs[0], &streamErr))
+	assert.Equal(t, 1, streamErr.Index)
+	assert.True(t, errors.Is(errs[0], mapErr))
+
+	// a panic of Filter
+	outputStream, outputErr = NewPipeline(newStringProducer("a")).
+		Filter(func(Datapack) bool { panic("filter panic") }, WithStageName("filter")).
+		Run()
+	_, errs = Collect(outputStream, outputErr)
+	assert.Len(t, errs, 1)
+	assert.Equal(t, `stage="filter": Filter panicked, err = filter panic`, errs[0].Error())
+
+	// a producer error is named by the writer
+	outputStream, outputErr = NewPipeline(&failAtProducer{p: newStringProducer("a"), err: errors.New("producer err")},
+		WithStageName("source")).Map(mapFn, WithStageName("map")).Run()
+	_, errs = Collect(outputStream, outputErr)
+	assert.Len(t, errs, 1)
+	assert.Equal(t, "source", StageName(errs[0]))
+	assert.Equal(t, "", StageName(mapErr))
+
+}
+
+func TestPipelineErr(t *testing.T) {
+
+	mapErr := errors.New("map failed")
+	outputStream, outputErr := NewPipeline(newStringProducer("a", "b")).
+		Map(func(Datapack) (Datapack, error) { return nil, mapErr }).
+		Then(nil).
+		Batch(2, 0).
+		Run()
+
+	datapacks, errs := Collect(outputStream, outputErr)
+	assert.Empty(t, datapacks)
+	assert.Len(t, errs, 1)
+	assert.True(t, errors.Is(errs[0], mapErr))
+
+}
+
+func TestPipelineTimeout(t *testing.T) {
+
+	goroutineCnt := runtime.NumGoroutine()
+
+	slow := func(datapack Datapack) (Datapack, error) {
+		select {
+		case <-time.After(time.Millisecond * 30):
+			return datapack, nil
+		case <-datapack.Context().Done():
+			return nil, datapack.Context().Err()
+		}
+	}
+
+	start := time.Now()
+	producer := &slowProducer{p: &countProducer{cnt: math.MaxInt32}, interval: time.Millisecond * 10}
+	outputStream, outputErr := NewPipeline(producer, WithTimeout(time.Millisecond*200)).Map(slow).Map(slow).Run()
+
+	datapacks, errs := Collect(outputStream, outputErr)
+	elapsed := time.Since(start)
+	t.Logf("collected %d datapacks in %v, errs = %v", len(datapacks), elapsed, errs)
+
+	assert.True(t, len(datapacks) > 0)
+	assert.Equal(t, []error{context.DeadlineExceeded}, errs)
+	assert.True(t, elapsed < time.Millisecond*400, "elapsed = %v", elapsed)
+
+	assertNoGoroutineLeak(t, goroutineCnt)
+
+}
+
+func TestHandlerRunTimeout(t *testing.T) {
+
+	var handled int32
+	stream, ep := NewSafeIOStreamWriter(&countProducer{cnt: math.MaxInt32}).Start()
+	safeHandler := NewSafeIOStreamHandler(stream, ep, func(ctx context.Context, rc io.ReadCloser) error {
+		atomic.AddInt32(&handled, 1)
+		select {
+		case <-time.After(time.Millisecond * 30):
+			return nil
+		case <-ctx.Done():
+			// in-flight handler observes the deadline
+			return ctx.Err()
+		}
+	}, nil, WithTimeout(time.Millisecond*100))
+	_, outputErr := safeHandler.BuildStream()
+	safeHandler.Start()
+
+	assert.Equal(t, []error{context.DeadlineExceeded}, outputErr.Drain())
+	assert.True(t, atomic.LoadInt32(&handled) <= 4)
+
+}
+
+func TestPipelineShutdown(t *testing.T) {
+
+	goroutineCnt := runtime.NumGoroutine()
+
+	upper := func(datapack Datapack) (Datapack, error) {
+		bs, err := ReadAllAndClose(datapack)
+		return newStringDatapack(strings.ToUpper(string(bs))), err
+	}
+	keep := func(Datapack) bool {
+		return true
+	}
+
+	// nothing to shut down before Run
+	assert.Nil(t, NewPipeline(&countProducer{cnt: 1}).Shutdown(context.Background()))
+
+	// writer -> Map -> Filter, with the output consumed
+	p := NewPipeline(&countProducer{cnt: math.MaxInt32}).Map(upper).Filter(keep)
+	outputStream, outputErr := p.Run()
+	collected := make(chan int, 1)
+	go func() {
+		datapacks, errs := Collect(outputStream, outputErr)
+		assert.Empty(t, errs)
+		collected <- len(datapacks)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Nil(t, p.Shutdown(ctx))
+	t.Logf("collected %d datapacks before shutdown", <-collected)
+	assertNoGoroutineLeak(t, goroutineCnt)
+
+	// the output is not consumed, so the last stage is stuck until it's torn down
+	p = NewPipeline(&countProducer{cnt: math.MaxInt32}).Map(upper).Filter(keep)
+	outputStream, _ = p.Run()
+	// the buffers of the stages are full and both stages hold a datapack
+	for outputStream.Len() < 1 || p.writer.Produced() < 5 {
+		runtime.Gosched()
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := p.Shutdown(ctx)
+	t.Logf("shutdown err = %v", err)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Contains(t, err.Error(), "stage 1")
+	assertNoGoroutineLeak(t, goroutineCnt)
+
+}
@@ -0,0 +1,428 @@
+package stream
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+type sliceDatapackProducer struct {
+	idx   int
+	packs []Datapack
+}
+
+// NewSliceDatapackProducer creates a DatapackProducer which produces the given datapacks in order.
+func NewSliceDatapackProducer(packs []Datapack) DatapackProducer {
+	return &sliceDatapackProducer{
+		idx:   0,
+		packs: packs,
+	}
+}
+
+func (p *sliceDatapackProducer) Next() (datapack Datapack, hasNext bool, err error) {
+	if p.idx >= len(p.packs) {
+		return nil, false, nil
+	}
+	datapack = p.packs[p.idx]
+	p.idx++
+	hasNext = p.idx < len(p.packs)
+	return
+}
+
+// SeekTo makes the next Next return the datapack at offset, an offset beyond the end makes the producer done.
+func (p *sliceDatapackProducer) SeekTo(offset int64) error {
+	if offset < 0 {
+		return fmt.Errorf("invalid offset: %d", offset)
+	}
+	if offset > int64(len(p.packs)) {
+		offset = int64(len(p.packs))
+	}
+	p.idx = int(offset)
+	return nil
+}
+
+type readerDatapackProducer struct {
+	r         *bufio.Reader
+	chunkSize int
+	err       error
+}
+
+// NewReaderDatapackProducer creates a DatapackProducer which splits r into chunks of chunkSize bytes,
+// the last chunk may be smaller, io.EOF won't be treated as an error.
+// NOTE: when a read error occurs, the bytes read before it are still produced as a chunk, and the error is returned by the next call.
+func NewReaderDatapackProducer(r io.Reader, chunkSize int) DatapackProducer {
+	if chunkSize < 1 {
+		chunkSize = 1
+	}
+	return &readerDatapackProducer{
+		r:         bufio.NewReader(r),
+		chunkSize: chunkSize,
+	}
+}
+
+func (p *readerDatapackProducer) Next() (datapack Datapack, hasNext bool, err error) {
+
+	if p.err != nil {
+		return nil, false, p.err
+	}
+
+	chunk := make([]byte, p.chunkSize)
+	n, err := io.ReadFull(p.r, chunk)
+
+	switch err {
+	case nil:
+		// peek to find out whether this is the last chunk
+		_, err = p.r.Peek(1)
+		if err != nil && err != io.EOF {
+			p.err = err
+		}
+		hasNext = err != io.EOF
+	case io.EOF:
+		return nil, false, nil
+	case io.ErrUnexpectedEOF:
+		hasNext = false
+	default:
+		if n == 0 {
+			return nil, false, err
+		}
+		p.err, hasNext = err, true
+	}
+
+	rc := ioutil.NopCloser(bytes.NewReader(chunk[:n]))
+	return NewSimpleDatapack(context.Background(), rc), hasNext, nil
+
+}
+
+type retryDatapackProducer struct {
+	p          DatapackProducer
+	maxRetries int
+	backoff    func(attempt int) time.Duration
+}
+
+// NewRetryDatapackProducer creates a DatapackProducer which retries p.Next at most maxRetries times on error,
+// backoff returns the duration to wait before the given attempt (starts from 1), nil backoff means no waiting.
+func NewRetryDatapackProducer(p DatapackProducer, maxRetries int, backoff func(attempt int) time.Duration) DatapackProducer {
+	if maxRetries < 0 {
+		maxRetries = 0
+	}
+	return &retryDatapackProducer{
+		p:          p,
+		maxRetries: maxRetries,
+		backoff:    backoff,
+	}
+}
+
+func (r *retryDatapackProducer) Next() (datapack Datapack, hasNext bool, err error) {
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && r.backoff != nil {
+			time.Sleep(r.backoff(attempt))
+		}
+		datapack, hasNext, err = r.p.Next()
+		if err == nil || attempt >= r.maxRetries {
+			return
+		}
+	}
+}
+
+type rateLimitedProducer struct {
+	ctx     context.Context
+	p       DatapackProducer
+	limiter *rate.Limiter
+}
+
+// NewRateLimitedProducer creates a DatapackProducer which calls p.Next at most perSecond times per second,
+// Next blocks until it's allowed to produce, perSecond <= 0 means no limit.
+func NewRateLimitedProducer(p DatapackProducer, perSecond float64) DatapackProducer {
+	return NewRateLimitedProducerWithContext(context.Background(), p, perSecond)
+}
+
+// NewRateLimitedProducerWithContext is the same as NewRateLimitedProducer,
+// but the waiting in Next is interrupted once ctx is done, in which case the error of ctx is returned.
+func NewRateLimitedProducerWithContext(ctx context.Context, p DatapackProducer, perSecond float64) DatapackProducer {
+	limit := rate.Limit(perSecond)
+	if perSecond <= 0 {
+		limit = rate.Inf
+	}
+	return &rateLimitedProducer{
+		ctx:     ctx,
+		p:       p,
+		limiter: rate.NewLimiter(limit, 1),
+	}
+}
+
+func (r *rateLimitedProducer) Next() (datapack Datapack, hasNext bool, err error) {
+	if err := r.limiter.Wait(r.ctx); err != nil {
+		return nil, false, err
+	}
+	return r.p.Next()
+}
+
+type channelDatapackProducer struct {
+	ch <-chan Datapack
+}
+
+// NewChannelDatapackProducer creates a DatapackProducer which receives datapacks from ch,
+// hasNext is false after ch is closed and drained.
+// NOTE: a nil datapack received from ch is returned as is, so SafeIOStreamWriter will skip it.
+func NewChannelDatapackProducer(ch <-chan Datapack) DatapackProducer {
+	return &channelDatapackProducer{
+		ch: ch,
+	}
+}
+
+func (c *channelDatapackProducer) Next() (datapack Datapack, hasNext bool, err error) {
+	datapack, ok := <-c.ch
+	return datapack, ok, nil
+}
+
+type ctxKeyFilePath struct{}
+
+// FilePathFromContext returns the file path carried by the context of a datapack produced by FileDatapackProducer.
+func FilePathFromContext(ctx context.Context) (string, bool) {
+	if ctx == nil {
+		return "", false
+	}
+	path, ok := ctx.Value(ctxKeyFilePath{}).(string)
+	return path, ok
+}
+
+type fileDatapackProducer struct {
+	idx   int
+	paths []string
+	onErr func(path string, err error) error
+}
+
+// NewFileDatapackProducer creates a DatapackProducer which opens the files one by one lazily,
+// the ReadCloser of each datapack is the opened *os.File, which should be closed by the handler,
+// and the path can be got by FilePathFromContext.
+// NOTE: an opening error is returned by Next with hasNext telling whether there're paths left, and calling Next again
+// carries on with the next path, but SafeIOStreamWriter stops on the first error, use NewFileDatapackProducerWithErrFn to skip.
+func NewFileDatapackProducer(paths []string) DatapackProducer {
+	return NewFileDatapackProducerWithErrFn(paths, nil)
+}
+
+// NewFileDatapackProducerWithErrFn is the same as NewFileDatapackProducer, but calls onErr when a file fails to open,
+// the file is skipped if onErr returns nil, otherwise the returned error is returned by Next.
+func NewFileDatapackProducerWithErrFn(paths []string, onErr func(path string, err error) error) DatapackProducer {
+	return &fileDatapackProducer{
+		idx:   0,
+		paths: paths,
+		onErr: onErr,
+	}
+}
+
+func (p *fileDatapackProducer) Next() (datapack Datapack, hasNext bool, err error) {
+
+	for p.idx < len(p.paths) {
+		path := p.paths[p.idx]
+		p.idx++
+		hasNext = p.idx < len(p.paths)
+
+		f, err := os.Open(path)
+		if err == nil {
+			ctx := context.WithValue(context.Background(), ctxKeyFilePath{}, path)
+			return NewSimpleDatapack(ctx, f), hasNext, nil
+		}
+
+		if p.onErr != nil {
+			err = p.onErr(path, err)
+		}
+		if err != nil {
+			return nil, hasNext, err
+		}
+	}
+
+	return nil, false, nil
+
+}
+
+type ndjsonDatapackProducer struct {
+	r     *bufio.Reader
+	idx   int
+	onErr func(line []byte, err error) error
+	done  bool
+}
+
+// NewNDJSONDatapackProducer creates a DatapackProducer which reads r line by line, and produces one *BytesDatapack
+// for each JSON record (the raw line without the line break), blank lines are skipped.
+// NOTE: hasNext is false only at EOF, in which case the datapack is nil. A malformed line is returned as an error by Next,
+// and calling Next again carries on with the next line, but SafeIOStreamWriter stops on the first error,
+// use NewNDJSONDatapackProducerWithErrFn to skip.
+func NewNDJSONDatapackProducer(r io.Reader) DatapackProducer {
+	return NewNDJSONDatapackProducerWithErrFn(r, nil)
+}
+
+// NewNDJSONDatapackProducerWithErrFn is the same as NewNDJSONDatapackProducer, but calls onErr with a malformed line,
+// the line is skipped if onErr returns nil, otherwise the returned error is returned by Next.
+func NewNDJSONDatapackProducerWithErrFn(r io.Reader, onErr func(line []byte, err error) error) DatapackProducer {
+	return &ndjsonDatapackProducer{
+		r:     bufio.NewReader(r),
+		onErr: onErr,
+	}
+}
+
+// ErrMalformedJSON is returned by the NDJSON producer when a line is not a valid JSON record.
+var ErrMalformedJSON = errors.New("malformed JSON record")
+
+func (p *ndjsonDatapackProducer) Next() (datapack Datapack, hasNext bool, err error) {
+
+	for !p.done {
+		line, err := p.r.ReadBytes('\n')
+		if err == io.EOF {
+			p.done = true
+		} else if err != nil {
+			p.done = true
+			return nil, false, err
+		}
+		p.idx++
+
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		if json.Valid(line) {
+			return NewBytesDatapack(context.Background(), line), true, nil
+		}
+
+		err = fmt.Errorf("%w at line %d", ErrMalformedJSON, p.idx)
+		if p.onErr != nil {
+			err = p.onErr(line, err)
+		}
+		if err != nil {
+			return nil, true, err
+		}
+	}
+
+	return nil, false, nil
+
+}
+
+type delimitedDatapackProducer struct {
+	scanner      *bufio.Scanner
+	maxTokenSize int
+}
+
+// NewDelimitedDatapackProducer creates a DatapackProducer which splits r by delim, and produces one *BytesDatapack
+// for each token (without the delimiter), empty tokens are skipped.
+// maxTokenSize limits the size of a token, maxTokenSize <= 0 means bufio.MaxScanTokenSize.
+// NOTE: hasNext is false only at the end of r, in which case the datapack is nil. A token longer than maxTokenSize
+// fails Next with an error wrapping bufio.ErrTooLong, after which the producer is done, so is a read error of r.
+func NewDelimitedDatapackProducer(r io.Reader, delim byte, maxTokenSize int) DatapackProducer {
+
+	if maxTokenSize <= 0 {
+		maxTokenSize = bufio.MaxScanTokenSize
+	}
+
+	initSize := 4096
+	if maxTokenSize < initSize {
+		initSize = maxTokenSize
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, initSize), maxTokenSize)
+	scanner.Split(func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+		if i := bytes.IndexByte(data, delim); i >= 0 {
+			return i + 1, data[:i], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	})
+
+	return &delimitedDatapackProducer{
+		scanner:      scanner,
+		maxTokenSize: maxTokenSize,
+	}
+
+}
+
+func (p *delimitedDatapackProducer) Next() (datapack Datapack, hasNext bool, err error) {
+
+	for p.scanner.Scan() {
+		token := p.scanner.Bytes()
+		if len(token) == 0 {
+			continue
+		}
+		// the buffer of the scanner is reused by the next Scan
+		bs := make([]byte, len(token))
+		copy(bs, token)
+		return NewBytesDatapack(context.Background(), bs), true, nil
+	}
+
+	if err = p.scanner.Err(); err == bufio.ErrTooLong {
+		err = fmt.Errorf("%w, max token size = %d", err, p.maxTokenSize)
+	}
+	return nil, false, err
+
+}
+
+// Seekable is a DatapackProducer which can skip ahead, offset is the number of datapacks from the beginning,
+// e.g. the one returned by NewSliceDatapackProducer.
+type Seekable interface {
+	DatapackProducer
+	SeekTo(offset int64) error
+}
+
+// Checkpoint stores the offset of a checkpointing producer, see NewCheckpointingProducer.
+type Checkpoint interface {
+	Save(offset int64)
+	Load() int64
+}
+
+type checkpointingProducer struct {
+	p        Seekable
+	cp       Checkpoint
+	interval int64
+	offset   int64
+	loaded   bool
+}
+
+// NewCheckpointingProducer creates a DatapackProducer which produces the datapacks of p, and saves the number of
+// datapacks produced so far into cp every interval datapacks (interval <= 0 means every datapack) and once p is done.
+// On the first Next, p seeks to the offset loaded from cp, so a restarted producer resumes where it left off,
+// a SeekTo error is returned by the first Next with hasNext = false.
+// NOTE: the offset counts the datapacks returned by Next rather than the handled ones, so the datapacks produced but
+// not handled before a crash are not produced again, and the ones after the last saving are produced again,
+// also, the producer must not be shared by multiple SafeIOStreamWriters since it's not safe for concurrent use.
+func NewCheckpointingProducer(p Seekable, cp Checkpoint, interval int) DatapackProducer {
+	if interval <= 0 {
+		interval = 1
+	}
+	return &checkpointingProducer{
+		p:        p,
+		cp:       cp,
+		interval: int64(interval),
+	}
+}
+
+func (c *checkpointingProducer) Next() (datapack Datapack, hasNext bool, err error) {
+	if !c.loaded {
+		c.loaded = true
+		if c.offset = c.cp.Load(); c.offset > 0 {
+			if err = c.p.SeekTo(c.offset); err != nil {
+				return nil, false, fmt.Errorf("failed to seek to checkpoint %d: %w", c.offset, err)
+			}
+		}
+	}
+
+	datapack, hasNext, err = c.p.Next()
+	if datapack != nil {
+		c.offset++
+		if c.offset%c.interval == 0 || !hasNext {
+			c.cp.Save(c.offset)
+		}
+	} else if !hasNext && err == nil {
+		c.cp.Save(c.offset)
+	}
+	return
+}
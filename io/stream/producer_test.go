@@ -0,0 +1,443 @@
+package stream
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSliceDatapackProducer(t *testing.T) {
+
+	packs := []Datapack{
+		NewSimpleDatapack(context.Background(), ioutil.NopCloser(bytes.NewBufferString("1st"))),
+		NewSimpleDatapack(context.Background(), ioutil.NopCloser(bytes.NewBufferString("2nd"))),
+		NewSimpleDatapack(context.Background(), ioutil.NopCloser(bytes.NewBufferString("3rd"))),
+	}
+	p := NewSliceDatapackProducer(packs)
+
+	for i := range packs {
+		datapack, hasNext, err := p.Next()
+		assert.Nil(t, err)
+		assert.Equal(t, packs[i], datapack)
+		assert.Equal(t, i < len(packs)-1, hasNext)
+	}
+
+	datapack, hasNext, err := p.Next()
+	assert.Nil(t, datapack)
+	assert.False(t, hasNext)
+	assert.Nil(t, err)
+
+	// work with SafeIOStreamWriter
+	stream, ep := NewSafeIOStreamWriter(NewSliceDatapackProducer(packs)).Start()
+	for i := 0; ; i++ {
+		data, closed := stream.Read()
+		if closed {
+			assert.Equal(t, len(packs), i)
+			break
+		}
+		assert.Equal(t, packs[i], data)
+	}
+	assert.Nil(t, ep.Get())
+
+}
+
+func TestEmptySliceDatapackProducer(t *testing.T) {
+
+	for _, packs := range [][]Datapack{nil, {}} {
+		datapack, hasNext, err := NewSliceDatapackProducer(packs).Next()
+		assert.Nil(t, datapack)
+		assert.False(t, hasNext)
+		assert.Nil(t, err)
+
+		stream, ep := NewSafeIOStreamWriter(NewSliceDatapackProducer(packs)).Start()
+		data, closed := stream.Read()
+		assert.Nil(t, data)
+		assert.True(t, closed)
+		assert.Nil(t, ep.Get())
+	}
+
+}
+
+func TestReaderDatapackProducer(t *testing.T) {
+
+	cases := []struct {
+		input    string
+		expected []string
+	}{
+		{input: "abcdefgh", expected: []string{"abc", "def", "gh"}},
+		{input: "abcdef", expected: []string{"abc", "def"}},
+		{input: "", expected: []string{}},
+	}
+
+	for _, c := range cases {
+		stream, ep := NewSafeIOStreamWriter(NewReaderDatapackProducer(bytes.NewBufferString(c.input), 3)).Start()
+		assert.Equal(t, c.expected, readStrings(t, stream))
+		assert.Nil(t, ep.Get())
+	}
+
+}
+
+func TestReaderDatapackProducerErr(t *testing.T) {
+
+	readErr := errors.New("read failed")
+
+	cases := []struct {
+		input    string
+		expected []string
+	}{
+		// the error lands inside a chunk
+		{input: "abcd", expected: []string{"abc", "d"}},
+		// the error is found by peeking after a full chunk
+		{input: "abc", expected: []string{"abc"}},
+		{input: "", expected: []string{}},
+	}
+
+	for _, c := range cases {
+		r := io.MultiReader(bytes.NewBufferString(c.input), iotest.ErrReader(readErr))
+		p := NewReaderDatapackProducer(r, 3)
+
+		for _, expected := range c.expected {
+			datapack, hasNext, err := p.Next()
+			assert.Nil(t, err)
+			assert.True(t, hasNext)
+			bs, _ := ioutil.ReadAll(datapack.ReadCloser())
+			assert.Equal(t, expected, string(bs))
+		}
+
+		datapack, hasNext, err := p.Next()
+		assert.Nil(t, datapack)
+		assert.False(t, hasNext)
+		assert.Equal(t, readErr, err)
+	}
+
+}
+
+func TestRetryDatapackProducer(t *testing.T) {
+
+	attempts := make([]int, 0)
+	backoff := func(attempt int) time.Duration {
+		attempts = append(attempts, attempt)
+		return time.Millisecond
+	}
+
+	// succeed after retries
+	flaky := &flakyProducer{p: newStringProducer("a", "b"), failures: 2}
+	stream, ep := NewSafeIOStreamWriter(NewRetryDatapackProducer(flaky, 3, backoff)).Start()
+	assert.Equal(t, []string{"a", "b"}, readStrings(t, stream))
+	assert.Nil(t, ep.Get())
+	assert.Equal(t, []int{1, 2}, attempts)
+
+	// give up
+	flaky = &flakyProducer{p: newStringProducer("a", "b"), failures: 5}
+	datapack, hasNext, err := NewRetryDatapackProducer(flaky, 3, nil).Next()
+	assert.Nil(t, datapack)
+	assert.False(t, hasNext)
+	assert.Equal(t, "flaky err 4", err.Error())
+
+}
+
+// flakyProducer fails the first `failures` calls.
+type flakyProducer struct {
+	p        DatapackProducer
+	calls    int
+	failures int
+}
+
+func (f *flakyProducer) Next() (datapack Datapack, hasNext bool, err error) {
+	f.calls++
+	if f.calls <= f.failures {
+		return nil, false, fmt.Errorf("flaky err %d", f.calls)
+	}
+	return f.p.Next()
+}
+
+func TestRateLimitedProducer(t *testing.T) {
+
+	strs := make([]string, 10)
+	for i := range strs {
+		strs[i] = fmt.Sprintf("%d", i)
+	}
+
+	start := time.Now()
+	stream, ep := NewSafeIOStreamWriter(NewRateLimitedProducer(newStringProducer(strs...), 5)).Start()
+	assert.Equal(t, strs, readStrings(t, stream))
+	assert.Nil(t, ep.Get())
+
+	// the 1st datapack is produced immediately, the other 9 take 9 * 200ms
+	elapsed := time.Since(start)
+	t.Logf("elapsed = %v", elapsed)
+	assert.InDelta(t, 1800, elapsed.Milliseconds(), 300)
+
+}
+
+func TestChannelDatapackProducer(t *testing.T) {
+
+	ch := make(chan Datapack)
+	go func() {
+		ch <- newStringDatapack("a")
+		ch <- nil
+		ch <- newStringDatapack("b")
+		close(ch)
+	}()
+
+	stream, ep := NewSafeIOStreamWriter(NewChannelDatapackProducer(ch)).Start()
+	assert.Equal(t, []string{"a", "b"}, readStrings(t, stream))
+	assert.Nil(t, ep.Get())
+
+	datapack, hasNext, err := NewChannelDatapackProducer(ch).Next()
+	assert.Nil(t, datapack)
+	assert.False(t, hasNext)
+	assert.Nil(t, err)
+
+}
+
+func TestRateLimitedProducerUnlimited(t *testing.T) {
+
+	for _, perSecond := range []float64{0, -1} {
+		stream, ep := NewSafeIOStreamWriter(NewRateLimitedProducer(newStringProducer("a", "b", "c"), perSecond)).Start()
+		assert.Equal(t, []string{"a", "b", "c"}, readStrings(t, stream))
+		assert.Nil(t, ep.Get())
+	}
+
+}
+
+func TestRateLimitedProducerWithContext(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := NewRateLimitedProducerWithContext(ctx, newStringProducer("a", "b", "c"), 0.1)
+
+	// the 1st token is available immediately
+	_, hasNext, err := p.Next()
+	assert.Nil(t, err)
+	assert.True(t, hasNext)
+
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		cancel()
+	}()
+
+	start := time.Now()
+	_, _, err = p.Next()
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(start) < time.Second)
+
+}
+
+func TestFileDatapackProducer(t *testing.T) {
+
+	dir := t.TempDir()
+	foo, bar, missing := filepath.Join(dir, "foo.txt"), filepath.Join(dir, "bar.txt"), filepath.Join(dir, "missing.txt")
+	assert.Nil(t, ioutil.WriteFile(foo, []byte("foo"), 0644))
+	assert.Nil(t, ioutil.WriteFile(bar, []byte("bar"), 0644))
+
+	// an opening error doesn't abort the remaining paths
+	p := NewFileDatapackProducer([]string{foo, missing, bar})
+	contents := make([]string, 0)
+	errs := make([]error, 0)
+	for {
+		datapack, hasNext, err := p.Next()
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if datapack != nil {
+			path, ok := FilePathFromContext(datapack.Context())
+			assert.True(t, ok)
+			bs, err := ioutil.ReadAll(datapack.ReadCloser())
+			assert.Nil(t, err)
+			assert.Nil(t, datapack.ReadCloser().Close())
+			assert.Equal(t, filepath.Base(path), string(bs)+".txt")
+			contents = append(contents, string(bs))
+		}
+		if !hasNext {
+			break
+		}
+	}
+	assert.Equal(t, []string{"foo", "bar"}, contents)
+	assert.Len(t, errs, 1)
+	assert.True(t, os.IsNotExist(errs[0]))
+
+	// skip with SafeIOStreamWriter
+	skipped := make([]string, 0)
+	stream, ep := NewSafeIOStreamWriter(NewFileDatapackProducerWithErrFn([]string{foo, missing, bar}, func(path string, err error) error {
+		skipped = append(skipped, path)
+		return nil
+	})).Start()
+	assert.Equal(t, []string{"foo", "bar"}, readStrings(t, stream))
+	assert.Nil(t, ep.Get())
+	assert.Equal(t, []string{missing}, skipped)
+
+}
+
+const ndjsonInput = `{"id": 1}
+{"id": 2}
+
+not json
+{"id": 3}`
+
+func TestNDJSONDatapackProducer(t *testing.T) {
+
+	p := NewNDJSONDatapackProducer(bytes.NewBufferString(ndjsonInput))
+	records := make([]string, 0)
+	for {
+		datapack, hasNext, err := p.Next()
+		if err != nil {
+			assert.True(t, errors.Is(err, ErrMalformedJSON))
+			assert.Contains(t, err.Error(), "line 4")
+			assert.True(t, hasNext)
+			continue
+		}
+		if datapack != nil {
+			bs, _ := ioutil.ReadAll(datapack.ReadCloser())
+			records = append(records, string(bs))
+		}
+		if !hasNext {
+			break
+		}
+	}
+	assert.Equal(t, []string{`{"id": 1}`, `{"id": 2}`, `{"id": 3}`}, records)
+
+	// stops on the malformed line in a stream
+	stream, ep := NewSafeIOStreamWriter(NewNDJSONDatapackProducer(bytes.NewBufferString(ndjsonInput))).Start()
+	assert.Equal(t, []string{`{"id": 1}`, `{"id": 2}`}, readStrings(t, stream))
+	errs := ep.Drain()
+	assert.Len(t, errs, 1)
+	assert.True(t, errors.Is(errs[0], ErrMalformedJSON))
+
+}
+
+func TestNDJSONDatapackProducerSkip(t *testing.T) {
+
+	skipped := make([]string, 0)
+	p := NewNDJSONDatapackProducerWithErrFn(bytes.NewBufferString(ndjsonInput+"\n"), func(line []byte, err error) error {
+		skipped = append(skipped, string(line))
+		return nil
+	})
+	stream, ep := NewSafeIOStreamWriter(p).Start()
+	assert.Equal(t, []string{`{"id": 1}`, `{"id": 2}`, `{"id": 3}`}, readStrings(t, stream))
+	assert.Empty(t, ep.Drain())
+	assert.Equal(t, []string{"not json"}, skipped)
+
+	// read error
+	readErr := errors.New("read failed")
+	_, hasNext, err := NewNDJSONDatapackProducer(iotest.ErrReader(readErr)).Next()
+	assert.Equal(t, readErr, err)
+	assert.False(t, hasNext)
+
+}
+
+func TestDelimitedDatapackProducer(t *testing.T) {
+
+	stream, ep := NewSafeIOStreamWriter(NewDelimitedDatapackProducer(bytes.NewBufferString("a;bb;;ccc;"), ';', 0)).Start()
+	assert.Equal(t, []string{"a", "bb", "ccc"}, readStrings(t, stream))
+	assert.Empty(t, ep.Drain())
+
+	// the last token without the delimiter
+	stream, ep = NewSafeIOStreamWriter(NewDelimitedDatapackProducer(bytes.NewBufferString("x|y|z"), '|', 0)).Start()
+	assert.Equal(t, []string{"x", "y", "z"}, readStrings(t, stream))
+	assert.Empty(t, ep.Drain())
+
+	// a token exceeding the max size
+	p := NewDelimitedDatapackProducer(bytes.NewBufferString("short,"+strings.Repeat("x", 100)+",next"), ',', 16)
+	datapack, hasNext, err := p.Next()
+	assert.Nil(t, err)
+	assert.True(t, hasNext)
+	bs, _ := ReadAllAndClose(datapack)
+	assert.Equal(t, "short", string(bs))
+	datapack, hasNext, err = p.Next()
+	assert.Nil(t, datapack)
+	assert.False(t, hasNext)
+	assert.True(t, errors.Is(err, bufio.ErrTooLong))
+	assert.Contains(t, err.Error(), "max token size = 16")
+
+	// read error
+	readErr := errors.New("read failed")
+	_, hasNext, err = NewDelimitedDatapackProducer(iotest.ErrReader(readErr), '\n', 0).Next()
+	assert.Equal(t, readErr, err)
+	assert.False(t, hasNext)
+
+}
+
+type memCheckpoint struct {
+	offset int64
+	saves  []int64
+}
+
+func (m *memCheckpoint) Save(offset int64) {
+	m.offset = offset
+	m.saves = append(m.saves, offset)
+}
+
+func (m *memCheckpoint) Load() int64 {
+	return m.offset
+}
+
+type failingSeekable struct {
+	DatapackProducer
+	err error
+}
+
+func (f *failingSeekable) SeekTo(int64) error {
+	return f.err
+}
+
+func TestCheckpointingProducer(t *testing.T) {
+
+	newSource := func() Seekable {
+		packs := make([]Datapack, 0, 10)
+		for i := 0; i < 10; i++ {
+			packs = append(packs, newStringDatapack(fmt.Sprintf("%d", i)))
+		}
+		return NewSliceDatapackProducer(packs).(Seekable)
+	}
+	cp := &memCheckpoint{}
+
+	// crashes after producing 4 datapacks, only the first 3 are checkpointed
+	p := NewCheckpointingProducer(newSource(), cp, 3)
+	for i := 0; i < 4; i++ {
+		datapack, hasNext, err := p.Next()
+		assert.Nil(t, err)
+		assert.True(t, hasNext)
+		bs, _ := ReadAllAndClose(datapack)
+		assert.Equal(t, fmt.Sprintf("%d", i), string(bs))
+	}
+	assert.Equal(t, []int64{3}, cp.saves)
+
+	// restarts, and resumes from the checkpoint
+	stream, ep := NewSafeIOStreamWriter(NewCheckpointingProducer(newSource(), cp, 3)).Start()
+	datapacks, errs := Collect(stream, ep)
+	assert.Empty(t, errs)
+	strs := make([]string, 0, len(datapacks))
+	for _, datapack := range datapacks {
+		bs, _ := ReadAllAndClose(datapack)
+		strs = append(strs, string(bs))
+	}
+	t.Logf("resumed = %v, saves = %v", strs, cp.saves)
+	assert.Equal(t, []string{"3", "4", "5", "6", "7", "8", "9"}, strs)
+	assert.Equal(t, []int64{3, 6, 9, 10}, cp.saves)
+
+	// restarts after done, nothing left
+	datapack, hasNext, err := NewCheckpointingProducer(newSource(), cp, 3).Next()
+	assert.Nil(t, datapack)
+	assert.False(t, hasNext)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), cp.Load())
+
+	// seek error
+	seekErr := errors.New("not seekable")
+	_, hasNext, err = NewCheckpointingProducer(&failingSeekable{newStringProducer("a"), seekErr}, cp, 1).Next()
+	assert.False(t, hasNext)
+	assert.True(t, errors.Is(err, seekErr))
+
+}
@@ -0,0 +1,74 @@
+// Package prom provides a Prometheus implementation of stream.StreamMetrics,
+// it's a separate package so that the users of stream who don't need it won't import Prometheus.
+package prom
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sshelll/sinfra/io/stream"
+)
+
+var _ stream.StreamMetrics = (*StreamMetrics)(nil)
+
+// StreamMetrics implements stream.StreamMetrics with Prometheus counters and a histogram:
+//  1. <namespace>_stream_processed_total
+//  2. <namespace>_stream_errors_total
+//  3. <namespace>_stream_handler_duration_seconds
+type StreamMetrics struct {
+	processed prometheus.Counter
+	errors    prometheus.Counter
+	duration  prometheus.Histogram
+}
+
+// NewPrometheusStreamMetrics creates a StreamMetrics and registers its collectors to reg,
+// a nil reg means prometheus.DefaultRegisterer, the error of registering is returned as is.
+func NewPrometheusStreamMetrics(reg prometheus.Registerer, namespace string) (*StreamMetrics, error) {
+
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+
+	m := &StreamMetrics{
+		processed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "stream",
+			Name:      "processed_total",
+			Help:      "The number of datapack handler calls, no matter they succeeded or not.",
+		}),
+		errors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "stream",
+			Name:      "errors_total",
+			Help:      "The number of datapack handler calls which returned an error or panicked.",
+		}),
+		duration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "stream",
+			Name:      "handler_duration_seconds",
+			Help:      "The duration of datapack handler calls.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+	}
+
+	for _, c := range []prometheus.Collector{m.processed, m.errors, m.duration} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+
+}
+
+func (m *StreamMetrics) IncProcessed() {
+	m.processed.Inc()
+}
+
+func (m *StreamMetrics) IncErrors() {
+	m.errors.Inc()
+}
+
+func (m *StreamMetrics) ObserveHandlerDuration(d time.Duration) {
+	m.duration.Observe(d.Seconds())
+}
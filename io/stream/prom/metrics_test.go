@@ -0,0 +1,61 @@
+package prom
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sshelll/sinfra/io/stream"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrometheusStreamMetrics(t *testing.T) {
+
+	reg := prometheus.NewRegistry()
+	m, err := NewPrometheusStreamMetrics(reg, "test")
+	assert.Nil(t, err)
+
+	datapacks := make([]stream.Datapack, 0)
+	for _, str := range []string{"a", "bad", "c"} {
+		datapacks = append(datapacks, stream.NewSimpleDatapack(context.Background(), ioutil.NopCloser(strings.NewReader(str))))
+	}
+	safeHandler := stream.NewSafeIOStreamHandler(stream.NewClosedIOStream(datapacks...), stream.NewClosedErrorPasser(),
+		func(ctx context.Context, rc io.ReadCloser) error {
+			bs, _ := ioutil.ReadAll(rc)
+			if string(bs) == "bad" {
+				return errors.New("bad datapack")
+			}
+			return nil
+		}, nil, stream.WithMetrics(m), stream.WithContinueOnError(true))
+	_, outputErr := safeHandler.BuildStream()
+	safeHandler.Start()
+	outputErr.Drain()
+
+	families, err := reg.Gather()
+	assert.Nil(t, err)
+	got := make(map[string]float64)
+	for _, f := range families {
+		metric := f.GetMetric()[0]
+		switch {
+		case metric.GetCounter() != nil:
+			got[f.GetName()] = metric.GetCounter().GetValue()
+		case metric.GetHistogram() != nil:
+			got[f.GetName()] = float64(metric.GetHistogram().GetSampleCount())
+		}
+	}
+	t.Logf("got = %v", got)
+	assert.Equal(t, map[string]float64{
+		"test_stream_processed_total":          3,
+		"test_stream_errors_total":             1,
+		"test_stream_handler_duration_seconds": 3,
+	}, got)
+
+	// registered twice
+	_, err = NewPrometheusStreamMetrics(reg, "test")
+	assert.NotNil(t, err)
+
+}
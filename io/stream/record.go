@@ -0,0 +1,121 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// recordHeaderSize is the size of the big-endian uint64 length prefixing the content of each recorded datapack.
+const recordHeaderSize = 8
+
+// ErrTruncatedRecord is returned by the replay producer when the recording ends in the middle of a frame.
+var ErrTruncatedRecord = errors.New("truncated record")
+
+// Record writes the content of every datapack from inputStream into w as a frame (the length in a big-endian uint64,
+// then the content), and passes an in-memory copy of the datapack with the same context (and metadata) through,
+// errors from inputErr are passed through, use NewReplayDatapackProducer to replay the recording.
+// NOTE: the content of each datapack is read into memory, and its ReadCloser is closed.
+// A read or write error is put into outputErr as a StreamError, and stops Record as well as its upstream.
+func Record(inputStream *IOStream, inputErr *ErrorPasser, w io.Writer) (*IOStream, *ErrorPasser) {
+
+	if inputStream == nil || inputErr == nil {
+		return nil, nil
+	}
+
+	outputStream := NewIOStream()
+	outputErr := NewErrorPasserWithCap(inputErr.Cap() + 1)
+
+	go func() {
+
+		defer func() {
+			if r := recover(); r != nil {
+				inputStream.Close()
+				outputErr.Put(newPanicError("Record", r))
+			}
+			outputErr.Close()
+			outputStream.Close()
+		}()
+
+		header := make([]byte, recordHeaderSize)
+		for idx := 0; ; idx++ {
+			datapack, closed := inputStream.readUntil(outputStream)
+			if closed {
+				break
+			}
+			if datapack == nil {
+				continue
+			}
+
+			bs, err := ReadAllAndClose(datapack)
+			if err == nil {
+				binary.BigEndian.PutUint64(header, uint64(len(bs)))
+				if _, err = w.Write(header); err == nil {
+					_, err = w.Write(bs)
+				}
+			}
+			if err != nil {
+				inputStream.Close()
+				outputErr.Put(NewStreamError(StageHandler, idx, err))
+				break
+			}
+
+			var copied Datapack = NewBytesDatapack(datapack.Context(), bs)
+			if meta := MetaOf(datapack); meta != nil {
+				copied = NewMetaDatapack(datapack.Context(), ioutil.NopCloser(bytes.NewReader(bs)), meta)
+			}
+			if streamClosed := outputStream.Write(copied); streamClosed {
+				inputStream.Close()
+				break
+			}
+		}
+
+		passErrors(inputErr, outputErr)
+
+	}()
+
+	return outputStream, outputErr
+
+}
+
+type replayDatapackProducer struct {
+	r      io.Reader
+	header []byte
+}
+
+// NewReplayDatapackProducer creates a DatapackProducer which produces one *BytesDatapack for each frame written by Record.
+// NOTE: hasNext is false only at the end of r, in which case the datapack is nil,
+// a recording which ends in the middle of a frame fails Next with ErrTruncatedRecord.
+func NewReplayDatapackProducer(r io.Reader) DatapackProducer {
+	return &replayDatapackProducer{
+		r:      r,
+		header: make([]byte, recordHeaderSize),
+	}
+}
+
+func (p *replayDatapackProducer) Next() (datapack Datapack, hasNext bool, err error) {
+
+	if _, err = io.ReadFull(p.r, p.header); err == io.EOF {
+		return nil, false, nil
+	} else if err == io.ErrUnexpectedEOF {
+		return nil, false, fmt.Errorf("%w, incomplete header", ErrTruncatedRecord)
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	size := binary.BigEndian.Uint64(p.header)
+	bs, err := ioutil.ReadAll(io.LimitReader(p.r, int64(size)))
+	if err != nil {
+		return nil, false, err
+	}
+	if uint64(len(bs)) < size {
+		return nil, false, fmt.Errorf("%w, expect %d bytes, got %d", ErrTruncatedRecord, size, len(bs))
+	}
+
+	return NewBytesDatapack(context.Background(), bs), true, nil
+
+}
@@ -0,0 +1,72 @@
+package stream
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+
+	inputs := []string{"hello", "", "world", string(bytes.Repeat([]byte{0, 1, 2}, 1000))}
+
+	buf := &bytes.Buffer{}
+	stream, ep := NewSafeIOStreamWriter(newStringProducer(inputs...)).Start()
+	stream, ep = Record(stream, ep, buf)
+	assert.Equal(t, inputs, readStrings(t, stream))
+	assert.Empty(t, ep.Drain())
+
+	// replay the recording
+	stream, ep = NewSafeIOStreamWriter(NewReplayDatapackProducer(bytes.NewReader(buf.Bytes()))).Start()
+	assert.Equal(t, inputs, readStrings(t, stream))
+	assert.Empty(t, ep.Drain())
+
+	// the metadata is passed through
+	stream, _ = Record(NewClosedIOStream(newMetaDatapack("a", map[string]string{"k": "v"})), NewClosedErrorPasser(),
+		&bytes.Buffer{})
+	datapack, _ := stream.Read()
+	assert.Equal(t, map[string]string{"k": "v"}, MetaOf(datapack))
+
+}
+
+func TestRecordWriteErr(t *testing.T) {
+
+	writeErr := errors.New("disk full")
+	inputStream := NewClosedIOStream(newStringDatapack("a"), newStringDatapack("b"))
+	stream, ep := Record(inputStream, NewClosedErrorPasser(), &failingWriter{err: writeErr})
+
+	assert.Empty(t, readStrings(t, stream))
+	errs := ep.Drain()
+	assert.Len(t, errs, 1)
+	assert.True(t, errors.Is(errs[0], writeErr))
+	assert.True(t, inputStream.Closed())
+
+}
+
+func TestReplayTruncated(t *testing.T) {
+
+	buf := &bytes.Buffer{}
+	stream, ep := Record(NewClosedIOStream(newStringDatapack("hello"), newStringDatapack("world")),
+		NewClosedErrorPasser(), buf)
+	readStrings(t, stream)
+	assert.Empty(t, ep.Drain())
+	recording := buf.Bytes()
+
+	// cut in the middle of the content, then in the middle of the header
+	for _, size := range []int{len(recording) - 2, recordHeaderSize + 5 + 3} {
+		p := NewReplayDatapackProducer(bytes.NewReader(recording[:size]))
+		datapack, hasNext, err := p.Next()
+		assert.Nil(t, err)
+		assert.True(t, hasNext)
+		bs, _ := ReadAllAndClose(datapack)
+		assert.Equal(t, "hello", string(bs))
+
+		datapack, hasNext, err = p.Next()
+		assert.Nil(t, datapack)
+		assert.False(t, hasNext)
+		assert.True(t, errors.Is(err, ErrTruncatedRecord))
+	}
+
+}
@@ -1,77 +1,309 @@
 package stream
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// ErrHandlerTimeout is returned when a datapackHandler call exceeds the limit set by WithHandlerTimeout.
+var ErrHandlerTimeout = errors.New("SafeIOStreamHandler datapack handler timeout")
+
+// DatapackProducer produces the datapacks for SafeIOStreamWriter.
+// NOTE: if it implements io.Closer, Close is called when SafeIOStreamWriter stops before hasNext becomes false,
+// e.g. the consumer closed the stream early, ctx is done, Next returned an error or panicked, so that it can clean up.
 type DatapackProducer interface {
 	Next() (datapack Datapack, hasNext bool, err error)
 }
 
 type SafeIOStreamWriter struct {
-	datapackProducer DatapackProducer
+	// produced is accessed atomically, and kept first for the 64-bit alignment
+	produced          int64
+	ctx               context.Context
+	datapackProducers []DatapackProducer
+	opts              options
+	stopper           *stopper
+	mu                *sync.Mutex
+	done              chan struct{}
+}
+
+func NewSafeIOStreamWriter(p DatapackProducer, opts ...Option) *SafeIOStreamWriter {
+	return NewSafeIOStreamWriterMulti([]DatapackProducer{p}, opts...)
 }
 
-func NewSafeIOStreamWriter(p DatapackProducer) *SafeIOStreamWriter {
+// NewSafeIOStreamWriterMulti creates a SafeIOStreamWriter which runs each producer in its own goroutine,
+// all of them write into the same stream and put errors into the same ErrorPasser,
+// the stream is closed after every producer has reported hasNext = false or failed.
+// NOTE: the ordering of the datapacks across producers is nondeterministic, while the ones from the same producer keep
+// their order, a failed producer doesn't stop the others, and the nil producers are ignored.
+func NewSafeIOStreamWriterMulti(producers []DatapackProducer, opts ...Option) *SafeIOStreamWriter {
 	return &SafeIOStreamWriter{
-		datapackProducer: p,
+		datapackProducers: producers,
+		opts:              newOptions(opts...),
+		stopper:           newStopper(),
+		mu:                &sync.Mutex{},
 	}
 }
 
+// NewSafeIOStreamWriterWithContext creates a SafeIOStreamWriter which merges ctx into the context of every datapack,
+// so the downstream handlers inherit the values and the deadline of ctx, see MergeContext for the merge semantics.
+// NOTE: the datapacks are wrapped, so type assertions on them (e.g. Sized, *BatchDatapack) no longer work,
+// and Start stops producing once ctx is done as well. Once a datapack has been handled by a SafeIOStreamHandler,
+// its merged context is released and no longer done by ctx, so it doesn't keep a goroutine alive until ctx is done.
+func NewSafeIOStreamWriterWithContext(ctx context.Context, p DatapackProducer, opts ...Option) *SafeIOStreamWriter {
+	w := NewSafeIOStreamWriter(p, opts...)
+	w.ctx = ctx
+	return w
+}
+
 func (s *SafeIOStreamWriter) Start() (*IOStream, *ErrorPasser) {
+	if s.ctx != nil {
+		return s.StartWithContext(s.ctx)
+	}
+	return s.StartWithContext(context.Background())
+}
+
+// StartWithContext is the same as Start, but stops producing once ctx is done,
+// in which case ctx.Err() will be put into the returned ErrorPasser.
+func (s *SafeIOStreamWriter) StartWithContext(ctx context.Context) (*IOStream, *ErrorPasser) {
 
 	outputStream := NewIOStream()
-	outputErr := NewErrorPasser()
+	if s.opts.outputStreamCap > 0 {
+		outputStream = NewIOStreamWithCap(s.opts.outputStreamCap)
+	}
+	// every producer puts at most one error before it stops, plus the error of ctx
+	outputErr := NewErrorPasserWithCap(len(s.datapackProducers) + 1)
 
+	// the datapacks carry runCtx if it has a deadline
+	var runCtx context.Context
+	if s.opts.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.opts.timeout)
+		// not canceled when the writer returns since the datapacks are still in use,
+		// while the resources are released when the deadline is hit
+		_ = cancel
+		runCtx = context.WithValue(ctx, ctxKeyStreamCtx{}, ctx)
+	}
+
+	done := make(chan struct{})
+	s.mu.Lock()
+	s.done = done
+	s.mu.Unlock()
+
+	// stopCtx is done once ctx is done or Stop is called
+	stopCtx, cancel := context.WithCancel(ctx)
+	if s.stopper.stopped() {
+		cancel()
+	}
 	go func() {
+		select {
+		case <-s.stopper.ch:
+			cancel()
+		case <-done:
+		}
+	}()
 
-		defer func() {
-			if r := recover(); r != nil {
-				err := fmt.Errorf("SafeIOStreamWriter panicked, panic info = %v", r)
-				outputErr.Put(err)
-			}
+	go func() {
 
+		defer func() {
+			cancel()
 			outputErr.Close()
 			outputStream.Close()
+			close(done)
 		}()
 
-		for {
-			datapack, hasNext, err := s.datapackProducer.Next()
-			if err != nil {
-				outputErr.Put(err)
-				break
+		// ctx.Err() is reported once no matter how many producers there're
+		canceled := newStopper()
+		reportCanceled := func() {
+			if ctx.Err() == nil {
+				// stopped by Stop
+				return
+			}
+			if canceled.stop() {
+				s.opts.logger.Debugf("SafeIOStreamWriter canceled, err = %v", ctx.Err())
+				outputErr.Put(s.opts.named(ctx.Err()))
 			}
+		}
 
-			if datapack == nil {
+		wg := &sync.WaitGroup{}
+		for _, p := range s.datapackProducers {
+			if p == nil {
 				continue
 			}
+			wg.Add(1)
+			go func(p DatapackProducer) {
+				defer wg.Done()
+				s.produce(stopCtx, runCtx, p, outputStream, outputErr, reportCanceled)
+			}(p)
+		}
+		wg.Wait()
+
+	}()
+
+	return outputStream, outputErr
+
+}
+
+// Stop asks the running producers to stop after their current Next call, the datapacks returned by these calls may be
+// dropped (and closed) if they can't be written at once, then the stream and the ErrorPasser are closed without any error, calling Stop more than once is safe.
+// NOTE: Stop doesn't wait, call Wait for that, and a writer stopped before Start produces nothing.
+func (s *SafeIOStreamWriter) Stop() {
+	s.stopper.stop()
+}
 
-			streamClosed := outputStream.Write(datapack)
-			if !hasNext || streamClosed {
-				break
+// Wait blocks until the goroutines started by Start return, and the stream and the ErrorPasser are closed.
+// NOTE: Wait returns immediately if Start has not been called.
+func (s *SafeIOStreamWriter) Wait() {
+	s.mu.Lock()
+	done := s.done
+	s.mu.Unlock()
+	if done != nil {
+		<-done
+	}
+}
+
+// produce writes the datapacks from p into outputStream until p is exhausted, fails, or the stream is closed.
+func (s *SafeIOStreamWriter) produce(ctx, runCtx context.Context, p DatapackProducer,
+	outputStream *IOStream, outputErr *ErrorPasser, reportCanceled func()) {
+
+	exhausted := false
+
+	defer func() {
+		if r := recover(); r != nil {
+			if s.opts.rethrow(r) {
+				panic(r)
 			}
+			err := newPanicError("SafeIOStreamWriter", r)
+			s.opts.logger.Errorf("%v", err)
+			outputErr.Put(s.opts.named(err))
 		}
 
+		if !exhausted {
+			s.abortProducer(p)
+		}
 	}()
 
-	return outputStream, outputErr
+	for idx := 0; ; idx++ {
+		select {
+		case <-ctx.Done():
+			reportCanceled()
+			return
+		default:
+		}
+
+		if s.opts.backpressure {
+			// don't call Next until there's room for the datapack
+			streamClosed, canceled := outputStream.WaitWritable(ctx)
+			if canceled {
+				reportCanceled()
+				return
+			}
+			if streamClosed {
+				return
+			}
+		}
+
+		datapack, hasNext, err := p.Next()
+		if err != nil {
+			err := NewStreamError(StageProducer, idx, err)
+			s.opts.logger.Errorf("SafeIOStreamWriter got an error from producer, %v", err)
+			outputErr.Put(s.opts.named(err))
+			return
+		}
+
+		if datapack == nil {
+			if !hasNext {
+				exhausted = true
+				return
+			}
+			continue
+		}
+		if s.ctx != nil {
+			datapack = withMergedContext(datapack, s.ctx)
+		}
+		if runCtx != nil {
+			datapack = withMergedContext(datapack, runCtx)
+		}
+
+		streamClosed, canceled := outputStream.WriteContext(ctx, datapack)
+		if canceled {
+			discard(datapack)
+			reportCanceled()
+			return
+		}
+		if !streamClosed {
+			atomic.AddInt64(&s.produced, 1)
+		}
+		if !hasNext || streamClosed {
+			exhausted = !hasNext
+			return
+		}
+	}
 
 }
 
+// Produced returns the number of datapacks written into the output stream so far, it's safe to call it concurrently,
+// e.g. for reporting the progress.
+func (s *SafeIOStreamWriter) Produced() int64 {
+	return atomic.LoadInt64(&s.produced)
+}
+
+// abortProducer closes p if it implements io.Closer, the error of Close is logged only.
+func (s *SafeIOStreamWriter) abortProducer(p DatapackProducer) {
+	c, ok := p.(io.Closer)
+	if !ok {
+		return
+	}
+	if err := c.Close(); err != nil {
+		s.opts.logger.Errorf("SafeIOStreamWriter failed to close the producer, err = %v", err)
+	}
+}
+
+// SafeIOStreamHandler reads the datapacks from inputStream and handles them one by one (or in parallel) safely.
+// There're two kinds of handler:
+//  1. a side-effect-only handler (NewSafeIOStreamHandler, NewParallelIOStreamHandler) consumes the datapacks,
+//     its outputStream never gets any datapack, and is closed once the handling is done,
+//     so it's only useful for waiting, while outputErr carries the errors.
+//  2. a transformer (NewTransformIOStreamHandler etc.) writes the datapacks it returns into outputStream.
 type SafeIOStreamHandler struct {
+	// handled and lastActivity (in UnixNano) are accessed atomically, and kept first for the 64-bit alignment
+	handled                   int64
+	lastActivity              int64
 	inputStream, outputStream *IOStream
 	inputErr, outputErr       *ErrorPasser
 	datapackHandler           func(ctx context.Context, rc io.ReadCloser) error
+	transformer               func(ctx context.Context, rc io.ReadCloser) (Datapack, error)
+	mapper                    func(datapack Datapack) (Datapack, error)
 	finalizer                 func()
+	chained                   Handler
+	workers                   int
+	ordered                   bool
+	opts                      options
+	mu                        *sync.Mutex
+	done                      chan struct{}
+	gate                      *pauseGate
+	// spawn starts a worker of the running handler, alive is the number of the running workers,
+	// and retiring is the number of them to retire, all of them are guarded by mu
+	spawn           func()
+	alive, retiring int
 }
 
+// NewSafeIOStreamHandler creates a SafeIOStreamHandler with a side-effect-only handler,
+// the outputStream built by BuildStream is always empty, use NewTransformIOStreamHandler to emit datapacks.
 func NewSafeIOStreamHandler(
 	inputStream *IOStream,
 	inputErr *ErrorPasser,
 	handler func(context.Context, io.ReadCloser) error,
 	finalizer func(),
+	opts ...Option,
 ) *SafeIOStreamHandler {
 
 	return &SafeIOStreamHandler{
@@ -79,79 +311,818 @@ func NewSafeIOStreamHandler(
 		inputErr:        inputErr,
 		datapackHandler: handler,
 		finalizer:       finalizer,
+		workers:         1,
+		opts:            newOptions(opts...),
+		mu:              &sync.Mutex{},
+		gate:            newPauseGate(),
+	}
+
+}
+
+// NewParallelIOStreamHandler creates a SafeIOStreamHandler which runs handler in `workers` goroutines concurrently.
+// NOTE: datapacks are dispatched to whichever worker is free, so there's no ordering guarantee between handler calls,
+// the first error (or panic) closes inputStream and stops all the workers, while the in-flight calls are allowed to finish
+// before outputStream / outputErr get closed.
+func NewParallelIOStreamHandler(
+	inputStream *IOStream,
+	inputErr *ErrorPasser,
+	handler func(context.Context, io.ReadCloser) error,
+	finalizer func(),
+	workers int,
+	opts ...Option,
+) *SafeIOStreamHandler {
+
+	if workers < 1 {
+		workers = 1
 	}
 
+	h := NewSafeIOStreamHandler(inputStream, inputErr, handler, finalizer, opts...)
+	h.workers = workers
+
+	return h
+
 }
 
+// NewTransformIOStreamHandler creates a SafeIOStreamHandler whose transformer can emit a datapack for each input,
+// the non-nil datapacks returned by transformer are written into outputStream, while a nil one emits nothing.
+// NOTE: use NewSafeIOStreamHandler for side-effect-only handlers, whose outputStream is always empty.
+// The finalizer runs right after outputStream is closed, when the emitted datapacks may still be buffered or being read,
+// so it must not release the resources referenced by them, unless WithFinalizerAfterConsumed is set.
+func NewTransformIOStreamHandler(
+	inputStream *IOStream,
+	inputErr *ErrorPasser,
+	transformer func(context.Context, io.ReadCloser) (Datapack, error),
+	finalizer func(),
+	opts ...Option,
+) *SafeIOStreamHandler {
+	return NewParallelTransformIOStreamHandler(inputStream, inputErr, transformer, finalizer, 1, opts...)
+}
+
+// NewParallelTransformIOStreamHandler is the same as NewTransformIOStreamHandler, but runs transformer in `workers`
+// goroutines concurrently, so the outputs are not ordered, use NewOrderedParallelHandler to keep the order.
+func NewParallelTransformIOStreamHandler(
+	inputStream *IOStream,
+	inputErr *ErrorPasser,
+	transformer func(context.Context, io.ReadCloser) (Datapack, error),
+	finalizer func(),
+	workers int,
+	opts ...Option,
+) *SafeIOStreamHandler {
+
+	h := NewParallelIOStreamHandler(inputStream, inputErr, nil, finalizer, workers, opts...)
+	h.transformer = transformer
+
+	return h
+
+}
+
+// NewOrderedParallelHandler creates a SafeIOStreamHandler which runs transformer in `workers` goroutines concurrently,
+// and writes the non-nil datapacks returned by transformer into outputStream in the order of their inputs.
+// NOTE: a finished result waits in a reorder buffer until all the results before it are written, the buffer holds at most
+// `workers` results, and a worker blocks when its result is too far ahead, so at most 2 * workers datapacks are held.
+// Datapacks which are skipped (nil ReadCloser, nil result, or failed with WithContinueOnError / WithContinueOnPanic)
+// leave no gap. The first error (or panic) which stops the handler drops the result of that datapack and all after it,
+// while the results of the datapacks before it may still be written if they're finished.
+func NewOrderedParallelHandler(
+	inputStream *IOStream,
+	inputErr *ErrorPasser,
+	transformer func(context.Context, io.ReadCloser) (Datapack, error),
+	finalizer func(),
+	workers int,
+	opts ...Option,
+) *SafeIOStreamHandler {
+
+	h := NewParallelTransformIOStreamHandler(inputStream, inputErr, transformer, finalizer, workers, opts...)
+	h.ordered = true
+
+	return h
+
+}
+
+// BuildStream creates outputStream and outputErr, if there's no handler, inputStream and inputErr are returned as is,
+// and nil, nil is returned if inputStream or inputErr is nil, in both cases Start is a no-op.
 func (s *SafeIOStreamHandler) BuildStream() (*IOStream, *ErrorPasser) {
 
 	if s.inputStream == nil || s.inputErr == nil {
 		return nil, nil
 	}
 
-	if s.datapackHandler == nil {
+	if s.datapackHandler == nil && s.transformer == nil && s.mapper == nil {
 		return s.inputStream, s.inputErr
 	}
 
 	s.outputStream = NewIOStream()
-	s.outputErr = NewErrorPasserWithCap(s.inputErr.Cap() + 2)
+	// room for the errors passed from inputErr, plus the error each worker puts before it stops,
+	// plus the single error of a canceled or timed out run
+	errCap := s.inputErr.Cap() + s.workers + 1
+	if s.opts.outputErrCap > 0 {
+		errCap = s.opts.outputErrCap
+	}
+	s.outputErr = NewErrorPasserWithCap(errCap)
 
 	return s.outputStream, s.outputErr
 
 }
 
+// Start starts the workers, BuildStream is called first if it has not been called.
+// NOTE: Start is a no-op if there's no handler (or no inputStream / inputErr), in which case the finalizer is not run
+// and Wait returns immediately, since BuildStream has returned the input as is (or nothing) without a stage.
 func (s *SafeIOStreamHandler) Start() {
+	s.StartWithContext(context.Background())
+}
 
-	outputStream, outputErr := s.outputStream, s.outputErr
+// StartWithContext is the same as Start, but stops reading once ctx is done,
+// in which case inputStream is closed, ctx.Err() is put into outputErr, and the finalizer still runs.
+// NOTE: after inputStream is closed, the errors from inputErr are passed into outputErr until the upstream closes
+// inputErr, so an upstream which never closes it blocks the handler (and its finalizer) until ctx is done,
+// then only the errors already buffered in inputErr are passed.
+func (s *SafeIOStreamHandler) StartWithContext(ctx context.Context) {
 
-	if outputStream == nil || outputErr == nil {
+	if s.outputStream == nil || s.outputErr == nil {
 		s.BuildStream()
 	}
+	outputStream, outputErr := s.outputStream, s.outputErr
+	if outputStream == nil || outputErr == nil {
+		// no handler or no input, nothing to start
+		return
+	}
+
+	done := make(chan struct{})
+	s.mu.Lock()
+	s.done = done
+	s.mu.Unlock()
+	s.touch()
+	s.chained = chainMiddlewares(s.core, s.opts.middlewares)
+
+	cancel := func() {}
+	if s.opts.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, s.opts.timeout)
+	}
 
 	go func() {
 
 		defer func() {
-			if r := recover(); r != nil {
-				// if current processor panicked, close inputStream manually
-				s.inputStream.Close()
-				outputErr.Put(fmt.Errorf("SafeIOStreamHandler panicked, err = %v", r))
-			}
-
+			// pass the input errors however the workers are stopped, so the upstream errors are never lost,
+			// unless the upstream never closes inputErr, in which case only the buffered ones are passed once ctx is done
+			passErrorsContext(ctx, s.inputErr, outputErr)
+			cancel()
 			outputErr.Close()
 			outputStream.Close()
 			if s.finalizer != nil {
+				if s.opts.finalizeLate {
+					<-outputStream.drainedChan()
+				}
 				s.finalizer()
 			}
+			close(done)
 		}()
 
-		for {
-			datapack, closed := s.inputStream.Read()
-			if closed {
-				break
-			}
+		wg, stop, r := &sync.WaitGroup{}, newStopper(), newIndexedReader(s.inputStream, outputStream.CloseChan())
+		s.mu.Lock()
+		var w outputWriter = &unorderedWriter{stream: outputStream}
+		if s.ordered {
+			w = newReorderWriter(outputStream, s.workers, stop)
+		}
+		// called with mu held, and only while alive > 0, so wg.Add never races with wg.Wait
+		s.spawn = func() {
+			s.alive++
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer s.exitWorker()
+				s.work(ctx, r, w, outputErr, stop)
+			}()
+		}
+		s.alive, s.retiring = 0, 0
+		for i := 0; i < s.workers; i++ {
+			s.spawn()
+		}
+		s.mu.Unlock()
+		wg.Wait()
 
-			rc, ctx := datapack.ReadCloser(), datapack.Context()
-			if rc == nil {
-				continue
+	}()
+
+}
+
+// Handled returns the number of datapacks whose handler (or transformer) call has succeeded so far,
+// it's safe to call it concurrently, e.g. for reporting the progress.
+// NOTE: the datapacks skipped (nil ReadCloser, expired) or failed are not counted.
+func (s *SafeIOStreamHandler) Handled() int64 {
+	return atomic.LoadInt64(&s.handled)
+}
+
+// LastActivity returns the last time a datapack was read from inputStream or a handler call returned,
+// it's the time of Start before any datapack arrives, and the zero time if the handler has not been started.
+// NOTE: it's observational only, e.g. for a health check to detect a wedged handler, see StalledFor.
+func (s *SafeIOStreamHandler) LastActivity() time.Time {
+	nano := atomic.LoadInt64(&s.lastActivity)
+	if nano == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nano)
+}
+
+// StalledFor reports whether the handler has been started and has had no activity for d or longer.
+// NOTE: an idle handler waiting on an empty inputStream is stalled as well, since it can't tell idle from wedged.
+func (s *SafeIOStreamHandler) StalledFor(d time.Duration) bool {
+	last := s.LastActivity()
+	return !last.IsZero() && s.opts.clock.Now().Sub(last) >= d
+}
+
+func (s *SafeIOStreamHandler) touch() {
+	atomic.StoreInt64(&s.lastActivity, s.opts.clock.Now().UnixNano())
+}
+
+// SetWorkers changes the number of the workers to n (n < 1 is treated as 1), it's safe to call it concurrently at any
+// time, e.g. for autoscaling by the Len of inputStream. Before Start it's the same as the workers of the constructor,
+// while for a running handler the extra workers are started at once, and the surplus ones retire gracefully:
+// a worker only retires before taking its next datapack, so the in-flight datapacks are never dropped.
+// NOTE: the default cap of outputErr and the reorder window of an ordered handler are sized by the workers at
+// BuildStream / Start, so the workers added later may wait on them, and SetWorkers is a no-op after the handler stops.
+func (s *SafeIOStreamHandler) SetWorkers(n int) {
+	if n < 1 {
+		n = 1
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.workers = n
+	if s.spawn == nil || s.alive == 0 {
+		return
+	}
+	diff := n - (s.alive - s.retiring)
+	// take back the pending retirements first
+	for ; diff > 0 && s.retiring > 0; diff-- {
+		s.retiring--
+	}
+	for ; diff > 0; diff-- {
+		s.spawn()
+	}
+	if diff < 0 {
+		s.retiring -= diff
+	}
+}
+
+// Workers returns the number of the workers set by the constructor or SetWorkers.
+// NOTE: the running workers may differ for a while after SetWorkers, since the surplus ones retire gracefully.
+func (s *SafeIOStreamHandler) Workers() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.workers
+}
+
+// retire reports whether the calling worker should retire, see SetWorkers.
+func (s *SafeIOStreamHandler) retire() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.retiring == 0 {
+		return false
+	}
+	s.retiring--
+	return true
+}
+
+func (s *SafeIOStreamHandler) exitWorker() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.alive--
+}
+
+// Pause makes the workers stop taking new datapacks from inputStream after their in-flight calls, until Resume,
+// it's safe to call Pause more than once, and a paused handler can still be canceled by the ctx of StartWithContext.
+// NOTE: the upstream blocks once the buffer of inputStream is full, which is the point of pausing for load shedding.
+func (s *SafeIOStreamHandler) Pause() {
+	s.gate.pause()
+}
+
+// Resume makes a paused handler go on taking datapacks, it's a no-op if the handler is not paused.
+func (s *SafeIOStreamHandler) Resume() {
+	s.gate.resume()
+}
+
+// Paused reports whether the handler is paused.
+func (s *SafeIOStreamHandler) Paused() bool {
+	return s.gate.paused()
+}
+
+// Wait blocks until the goroutine started by Start returns, which means the finalizer has been executed.
+// NOTE: Wait returns immediately if Start has not been called.
+func (s *SafeIOStreamHandler) Wait() {
+	<-s.Done()
+}
+
+// Done returns a channel which is closed after the goroutine started by Start returns,
+// if Start has not been called, the returned channel is already closed.
+func (s *SafeIOStreamHandler) Done() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done == nil {
+		return closedCh
+	}
+	return s.done
+}
+
+func (s *SafeIOStreamHandler) work(ctx context.Context, r *indexedReader, w outputWriter, outputErr *ErrorPasser, stop *stopper) {
+
+	for {
+		if s.retire() {
+			return
+		}
+		// hold the next datapack back while paused
+		s.gate.wait(ctx, stop.ch, r.downstream)
+		datapack, idx, closed, canceled := r.read(ctx)
+		if canceled {
+			if stop.stop() {
+				s.opts.logger.Debugf("SafeIOStreamHandler canceled, err = %v", ctx.Err())
+				s.putErr(outputErr, ctx.Err())
 			}
+			s.inputStream.Close()
+			return
+		}
+		if closed || stop.stopped() {
+			return
+		}
+		s.touch()
 
-			if err := s.datapackHandler(ctx, rc); err != nil {
-				outputErr.Put(err)
-				break
+		rc, dpCtx := datapack.ReadCloser(), datapack.Context()
+		if rc == nil {
+			releaseContext(datapack)
+			w.write(ctx, idx, nil)
+			continue
+		}
+
+		var result Datapack
+		var err error
+		var panicked bool
+		if dpCtx != nil && dpCtx.Err() != nil && !s.opts.keepExpired {
+			// don't waste a handler call on a datapack which is already expired
+			rc.Close()
+			err = dpCtx.Err()
+		} else {
+			release := func() {}
+			if s.opts.timeout > 0 {
+				// the in-flight handler calls observe the deadline of the run
+				dpCtx, release = mergeContext(ctx, dpCtx, true)
 			}
+			result, err, panicked = s.invoke(dpCtx, idx, rc, MetaOf(datapack))
+			release()
+			s.touch()
 		}
+		// the datapack is handled, its context needn't follow the writer any more
+		releaseContext(datapack)
+		if err != nil && ctx.Err() != nil {
+			// the run is canceled during the call, report it once like the canceled read
+			if stop.stop() {
+				s.opts.logger.Debugf("SafeIOStreamHandler canceled, err = %v", ctx.Err())
+				s.putErr(outputErr, ctx.Err())
+			}
+			s.inputStream.Close()
+			return
+		}
+		if err != nil && streamCanceled(dpCtx, err) {
+			// the upstream SafeIOStreamWriter has reported it
+			s.opts.logger.Debugf("SafeIOStreamHandler skipped a datapack since the stream is canceled, %v", err)
+			w.write(ctx, idx, nil)
+			continue
+		}
+		if err == nil {
+			atomic.AddInt64(&s.handled, 1)
+			if streamClosed := w.write(ctx, idx, result); streamClosed {
+				// downstream is gone, stop the upstream as well
+				stop.stop()
+				s.inputStream.Close()
+				return
+			}
+			continue
+		}
+
+		streamErr := NewStreamError(StageHandler, idx, err)
+		s.opts.logger.Errorf("SafeIOStreamHandler failed to handle datapack, %v", streamErr)
+		s.putErr(outputErr, streamErr)
+		if panicked && s.opts.continueOnPanic || !panicked && s.opts.continueOnError && !IsFatal(err) {
+			w.write(ctx, idx, nil)
+			continue
+		}
+
+		// stop the other workers as well
+		w.abort(idx)
+		stop.stop()
+		s.inputStream.Close()
+		return
+	}
+
+}
+
+// putErr puts err into outputErr, it never blocks if WithBestEffortErrors is set.
+func (s *SafeIOStreamHandler) putErr(outputErr *ErrorPasser, err error) {
+	err = s.opts.named(err)
+	if !s.opts.bestEffortErrs {
+		outputErr.Put(err)
+		return
+	}
+	if !outputErr.TryPut(err) {
+		s.opts.logger.Errorf("SafeIOStreamHandler dropped an error since the error buffer is full, err = %v", err)
+	}
+}
+
+// invoke calls datapackHandler (or transformer) once, a panic is recovered and returned as an error.
+func (s *SafeIOStreamHandler) invoke(ctx context.Context, idx int, rc io.ReadCloser, meta map[string]string) (
+	result Datapack, err error, panicked bool) {
 
-		// handle input err
-		for {
-			err, done := s.inputErr.Check()
-			if done {
-				break
+	start := time.Now()
+	ctx, end := s.opts.tracer.StartSpan(ctx, idx)
+
+	defer func() {
+		if r := recover(); r != nil {
+			stack := debug.Stack()
+			if p, ok := r.(*handlerPanic); ok {
+				// re-panicked by handle, keep the stack of the goroutine which panicked
+				r, stack = p.value, p.stack
 			}
-			if err != nil {
-				outputErr.Put(err)
+			if s.opts.rethrow(r) {
+				end(newPanicErrorWithStack("SafeIOStreamHandler", r, stack))
+				panic(r)
 			}
+			result, err, panicked = nil, newPanicErrorWithStack("SafeIOStreamHandler", r, stack), true
+		}
+		end(err)
+		s.opts.metrics.ObserveHandlerDuration(time.Since(start))
+		s.opts.metrics.IncProcessed()
+		if err != nil {
+			s.opts.metrics.IncErrors()
 		}
+	}()
+
+	result, err = s.handleWithRetry(ctx, rc, meta)
+	return result, err, false
+
+}
 
+// handleWithRetry calls handle on a copy of the content until it succeeds, the error is not retryable,
+// the attempts are used up or ctx is done, if WithHandlerRetry is set.
+func (s *SafeIOStreamHandler) handleWithRetry(ctx context.Context, rc io.ReadCloser, meta map[string]string) (
+	Datapack, error) {
+
+	retry := s.opts.retry
+	if retry == nil {
+		return s.handle(ctx, rc, meta)
+	}
+	retryable := retry.retryable
+	if retryable == nil {
+		retryable = IsRetryable
+	}
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	bs, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && retry.backoff != nil {
+			select {
+			case <-s.opts.clock.After(retry.backoff(attempt)):
+			case <-ctx.Done():
+				return nil, err
+			}
+		}
+		var result Datapack
+		result, err = s.handle(ctx, ioutil.NopCloser(bytes.NewReader(bs)), meta)
+		if err == nil || attempt+1 >= retry.maxAttempts || ctx.Err() != nil || !retryable(err) {
+			return result, err
+		}
+		s.opts.logger.Debugf("SafeIOStreamHandler retries a datapack, attempt = %d, err = %v", attempt+1, err)
+	}
+
+}
+
+func (s *SafeIOStreamHandler) handle(ctx context.Context, rc io.ReadCloser, meta map[string]string) (Datapack, error) {
+
+	timeout := s.opts.handlerTimeout
+	if timeout <= 0 {
+		return s.call(ctx, rc, meta)
+	}
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	var cancel context.CancelFunc
+	var timeoutCh <-chan time.Time
+	if _, ok := s.opts.clock.(realClock); ok {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+		timeoutCh = s.opts.clock.After(timeout)
+	}
+	defer cancel()
+
+	type handleResult struct {
+		datapack Datapack
+		err      error
+	}
+
+	resultCh, panicCh := make(chan handleResult, 1), make(chan *handlerPanic, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				panicCh <- &handlerPanic{value: r, stack: debug.Stack()}
+			}
+		}()
+		datapack, err := s.call(ctx, rc, meta)
+		resultCh <- handleResult{datapack: datapack, err: err}
 	}()
 
+	select {
+	case result := <-resultCh:
+		return result.datapack, result.err
+	case p := <-panicCh:
+		// re-panic in the calling goroutine, so it's recovered by invoke
+		panic(p)
+	case <-timeoutCh:
+		cancel()
+		rc.Close()
+		return nil, fmt.Errorf("%w, timeout = %v", ErrHandlerTimeout, timeout)
+	case <-ctx.Done():
+		// abandon the handler call, closing rc helps it return if it's blocked on reading
+		rc.Close()
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("%w, timeout = %v", ErrHandlerTimeout, timeout)
+		}
+		return nil, ctx.Err()
+	}
+
+}
+
+// handlerPanic carries a panic of the handler call running in another goroutine along with its stack, see handle.
+type handlerPanic struct {
+	value interface{}
+	stack []byte
+}
+
+// call calls mapper or transformer if it's set, otherwise datapackHandler, which never returns a datapack,
+// mapper gets the metadata of the input datapack as well.
+func (s *SafeIOStreamHandler) call(ctx context.Context, rc io.ReadCloser, meta map[string]string) (Datapack, error) {
+	if meta != nil {
+		return s.chained(NewMetaDatapack(ctx, rc, meta))
+	}
+	return s.chained(NewSimpleDatapack(ctx, rc))
+}
+
+// core is the Handler wrapped by the middlewares, which calls the mapper, transformer or handler.
+func (s *SafeIOStreamHandler) core(datapack Datapack) (Datapack, error) {
+	if s.mapper != nil {
+		return s.mapper(datapack)
+	}
+	if s.transformer != nil {
+		return s.transformer(datapack.Context(), datapack.ReadCloser())
+	}
+	return nil, s.datapackHandler(datapack.Context(), datapack.ReadCloser())
+}
+
+// indexedReader reads datapacks from an IOStream along with their zero-based index.
+type indexedReader struct {
+	mu         *sync.Mutex
+	stream     *IOStream
+	downstream <-chan struct{}
+	idx        int
+}
+
+// newIndexedReader creates an indexedReader, which closes stream once downstream is closed.
+func newIndexedReader(stream *IOStream, downstream <-chan struct{}) *indexedReader {
+	return &indexedReader{
+		mu:         &sync.Mutex{},
+		stream:     stream,
+		downstream: downstream,
+	}
+}
+
+// read blocks until a datapack is read, the stream is closed, or ctx is done.
+// NOTE: the stream is closed and reported as closed if downstream is closed, even when it still has datapacks,
+// so the upstream is stopped without waiting for its next datapack.
+func (r *indexedReader) read(ctx context.Context) (datapack Datapack, idx int, closed bool, canceled bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	select {
+	case <-ctx.Done():
+		return nil, -1, false, true
+	case <-r.downstream:
+		r.stream.Close()
+		return nil, -1, true, false
+	default:
+	}
+	select {
+	case data, ok := <-r.stream.dataCh:
+		r.stream.onRead(ok)
+		if !ok {
+			return nil, -1, true, false
+		}
+		idx = r.idx
+		r.idx++
+		return data, idx, false, false
+	case <-ctx.Done():
+		return nil, -1, false, true
+	case <-r.downstream:
+		r.stream.Close()
+		return nil, -1, true, false
+	}
+}
+
+var closedCh = func() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}()
+
+// stopper tells the workers of a SafeIOStreamHandler to stop,
+// the datapacks still buffered in the closed inputStream should not be handled.
+type stopper struct {
+	once *sync.Once
+	ch   chan struct{}
+}
+
+func newStopper() *stopper {
+	return &stopper{
+		once: &sync.Once{},
+		ch:   make(chan struct{}),
+	}
+}
+
+// stop returns true for the first call.
+func (s *stopper) stop() (first bool) {
+	s.once.Do(func() {
+		close(s.ch)
+		first = true
+	})
+	return
+}
+
+func (s *stopper) stopped() bool {
+	select {
+	case <-s.ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// pauseGate blocks its waiters while it's paused.
+type pauseGate struct {
+	mu *sync.Mutex
+	// ch is closed while the gate is open
+	ch chan struct{}
+}
+
+func newPauseGate() *pauseGate {
+	return &pauseGate{
+		mu: &sync.Mutex{},
+		ch: closedCh,
+	}
+}
+
+func (g *pauseGate) pause() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.isPaused() {
+		g.ch = make(chan struct{})
+	}
+}
+
+func (g *pauseGate) resume() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.isPaused() {
+		close(g.ch)
+	}
+}
+
+func (g *pauseGate) paused() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.isPaused()
+}
+
+func (g *pauseGate) isPaused() bool {
+	select {
+	case <-g.ch:
+		return false
+	default:
+		return true
+	}
+}
+
+// wait blocks until the gate is open, ctx is done, or either of stop and downstream is closed.
+func (g *pauseGate) wait(ctx context.Context, stop, downstream <-chan struct{}) {
+	g.mu.Lock()
+	ch := g.ch
+	g.mu.Unlock()
+	select {
+	case <-ch:
+	case <-ctx.Done():
+	case <-stop:
+	case <-downstream:
+	}
+}
+
+// outputWriter writes the results of a SafeIOStreamHandler into its outputStream.
+type outputWriter interface {
+	// write writes the result of the datapack with index idx, a nil datapack means there's no result for idx.
+	write(ctx context.Context, idx int, datapack Datapack) (streamClosed bool)
+	// abort makes the results at or after idx never written.
+	abort(idx int)
+}
+
+type unorderedWriter struct {
+	stream *IOStream
+}
+
+func (w *unorderedWriter) write(ctx context.Context, _ int, datapack Datapack) (streamClosed bool) {
+	if datapack == nil {
+		return false
+	}
+	streamClosed, _ = w.stream.WriteContext(ctx, datapack)
+	return
+}
+
+func (w *unorderedWriter) abort(int) {}
+
+// reorderWriter buffers the results which come out of order, and writes them in the order of idx.
+type reorderWriter struct {
+	mu       *sync.Mutex
+	stream   *IOStream
+	window   int
+	next     int
+	limit    int
+	pending  map[int]Datapack
+	advanced chan struct{}
+	stop     *stopper
+}
+
+func newReorderWriter(stream *IOStream, window int, stop *stopper) *reorderWriter {
+	return &reorderWriter{
+		mu:       &sync.Mutex{},
+		stream:   stream,
+		window:   window,
+		limit:    math.MaxInt64,
+		pending:  make(map[int]Datapack, window),
+		advanced: make(chan struct{}),
+		stop:     stop,
+	}
+}
+
+func (w *reorderWriter) write(ctx context.Context, idx int, datapack Datapack) (streamClosed bool) {
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// wait until idx gets into the window, the worker of w.next never waits
+	for idx >= w.next+w.window {
+		advanced := w.advanced
+		w.mu.Unlock()
+		select {
+		case <-advanced:
+		case <-w.stop.ch:
+			w.mu.Lock()
+			return false
+		case <-ctx.Done():
+			w.mu.Lock()
+			return false
+		}
+		w.mu.Lock()
+	}
+
+	w.pending[idx] = datapack
+	advanced := false
+	for ; w.next < w.limit; w.next++ {
+		datapack, ok := w.pending[w.next]
+		if !ok {
+			break
+		}
+		delete(w.pending, w.next)
+		advanced = true
+		if datapack == nil {
+			continue
+		}
+		if closed, canceled := w.stream.WriteContext(ctx, datapack); closed || canceled {
+			streamClosed = closed
+			w.next++
+			break
+		}
+	}
+	if advanced {
+		close(w.advanced)
+		w.advanced = make(chan struct{})
+	}
+
+	return streamClosed
+
+}
+
+func (w *reorderWriter) abort(idx int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if idx < w.limit {
+		w.limit = idx
+	}
 }
@@ -3,11 +3,23 @@ package stream
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"math/rand"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestDownstreamPanic(t *testing.T) {
@@ -91,3 +103,1311 @@ func (p *ProcWithPanic) finalizeFn() {
 	p.pw.Close()
 	p.pr.Close()
 }
+
+func TestParallelHandler(t *testing.T) {
+
+	goroutineCnt := runtime.NumGoroutine()
+
+	var handled, running, maxRunning int32
+	handler := func(ctx context.Context, rc io.ReadCloser) error {
+		cur := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if cur <= max || atomic.CompareAndSwapInt32(&maxRunning, max, cur) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond * 10)
+		atomic.AddInt32(&handled, 1)
+		return rc.Close()
+	}
+
+	finalized := make(chan struct{})
+	stream, ep := NewSafeIOStreamWriter(&countProducer{cnt: 50}).Start()
+	safeHandler := NewParallelIOStreamHandler(stream, ep, handler, func() { close(finalized) }, 4)
+	outputStream, outputErr := safeHandler.BuildStream()
+	safeHandler.Start()
+
+	for {
+		_, closed := outputStream.Read()
+		if closed {
+			break
+		}
+	}
+	err, done := outputErr.Check()
+	assert.Nil(t, err)
+	assert.True(t, done)
+
+	<-finalized
+	assert.Equal(t, int32(50), atomic.LoadInt32(&handled))
+	assert.True(t, atomic.LoadInt32(&maxRunning) <= 4)
+	assert.True(t, atomic.LoadInt32(&maxRunning) > 1)
+
+	assertNoGoroutineLeak(t, goroutineCnt)
+
+}
+
+func TestParallelHandlerWithErr(t *testing.T) {
+
+	goroutineCnt := runtime.NumGoroutine()
+
+	var handled int32
+	handlerErr := errors.New("handler failed")
+	handler := func(ctx context.Context, rc io.ReadCloser) error {
+		time.Sleep(time.Millisecond * 10)
+		if atomic.AddInt32(&handled, 1) == 5 {
+			return handlerErr
+		}
+		return nil
+	}
+
+	stream, ep := NewSafeIOStreamWriter(&countProducer{cnt: 1000}).Start()
+	safeHandler := NewParallelIOStreamHandler(stream, ep, handler, nil, 4)
+	outputStream, outputErr := safeHandler.BuildStream()
+	safeHandler.Start()
+
+	for {
+		_, closed := outputStream.Read()
+		if closed {
+			break
+		}
+	}
+
+	errs := make([]error, 0)
+	for {
+		err, done := outputErr.Check()
+		if done {
+			break
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	t.Logf("errs = %v", errs)
+	assert.True(t, errors.Is(errs[0], handlerErr))
+	assert.True(t, atomic.LoadInt32(&handled) < 1000)
+
+	assertNoGoroutineLeak(t, goroutineCnt)
+
+}
+
+type countProducer struct {
+	idx, cnt int
+}
+
+func (p *countProducer) Next() (datapack Datapack, hasNext bool, err error) {
+	p.idx++
+	rc := ioutil.NopCloser(bytes.NewBufferString(fmt.Sprintf("%d", p.idx)))
+	datapack = NewSimpleDatapack(context.Background(), rc)
+	hasNext = p.idx < p.cnt
+	return
+}
+
+func assertNoGoroutineLeak(t *testing.T, expected int) {
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > expected && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.LessOrEqual(t, runtime.NumGoroutine(), expected, "goroutines leaked")
+}
+
+func TestWriterStartWithContext(t *testing.T) {
+
+	goroutineCnt := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, ep := NewSafeIOStreamWriter(&countProducer{cnt: math.MaxInt32}).StartWithContext(ctx)
+
+	for i := 0; ; i++ {
+		if i == 10 {
+			cancel()
+		}
+		_, closed := stream.Read()
+		if closed {
+			break
+		}
+	}
+
+	assert.Equal(t, context.Canceled, ep.Get())
+	assert.Nil(t, ep.Get())
+
+	assertNoGoroutineLeak(t, goroutineCnt)
+
+}
+
+func TestHandlerWait(t *testing.T) {
+
+	var finalized int32
+	stream, ep := NewSafeIOStreamWriter(&countProducer{cnt: 10}).Start()
+	safeHandler := NewSafeIOStreamHandler(stream, ep, func(ctx context.Context, rc io.ReadCloser) error {
+		return rc.Close()
+	}, func() {
+		time.Sleep(time.Millisecond * 100)
+		atomic.StoreInt32(&finalized, 1)
+	})
+
+	// not started
+	safeHandler.Wait()
+	select {
+	case <-safeHandler.Done():
+	default:
+		t.Fatal("Done should be closed before Start")
+	}
+
+	safeHandler.BuildStream()
+	safeHandler.Start()
+
+	select {
+	case <-safeHandler.Done():
+		t.Fatal("Done should not be closed before the finalizer returned")
+	default:
+	}
+
+	safeHandler.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&finalized))
+	<-safeHandler.Done()
+
+}
+
+func TestHandlerTimeout(t *testing.T) {
+
+	var handled int32
+	handler := func(ctx context.Context, rc io.ReadCloser) error {
+		idx, _ := ioutil.ReadAll(rc)
+		if string(idx) == "3" {
+			// a stuck handler which respects ctx
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		atomic.AddInt32(&handled, 1)
+		return nil
+	}
+
+	stream, ep := NewSafeIOStreamWriter(&countProducer{cnt: 5}).Start()
+	safeHandler := NewSafeIOStreamHandler(stream, ep, handler, nil, WithHandlerTimeout(time.Millisecond*100))
+	_, outputErr := safeHandler.BuildStream()
+
+	start := time.Now()
+	safeHandler.Start()
+	safeHandler.Wait()
+	elapsed := time.Since(start)
+
+	err := outputErr.Get()
+	assert.True(t, errors.Is(err, ErrHandlerTimeout), "err = %v", err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&handled))
+	assert.True(t, elapsed < time.Second, "elapsed = %v", elapsed)
+
+}
+
+func TestHandlerInTime(t *testing.T) {
+
+	var handled int32
+	handler := func(ctx context.Context, rc io.ReadCloser) error {
+		time.Sleep(time.Millisecond * 10)
+		atomic.AddInt32(&handled, 1)
+		return nil
+	}
+
+	stream, ep := NewSafeIOStreamWriter(&countProducer{cnt: 5}).Start()
+	safeHandler := NewSafeIOStreamHandler(stream, ep, handler, nil, WithHandlerTimeout(time.Second))
+	_, outputErr := safeHandler.BuildStream()
+	safeHandler.Start()
+	safeHandler.Wait()
+
+	assert.Nil(t, outputErr.Get())
+	assert.Equal(t, int32(5), atomic.LoadInt32(&handled))
+
+}
+
+func TestWriterStartWithContextStalled(t *testing.T) {
+
+	goroutineCnt := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+
+	// nobody reads the stream
+	_, ep := NewSafeIOStreamWriter(&countProducer{cnt: math.MaxInt32}).StartWithContext(ctx)
+	assert.Equal(t, context.DeadlineExceeded, ep.Get())
+
+	assertNoGoroutineLeak(t, goroutineCnt)
+
+}
+
+func TestStreamError(t *testing.T) {
+
+	// handler
+	handlerErr := errors.New("handler failed")
+	stream, ep := NewSafeIOStreamWriter(&countProducer{cnt: 5}).Start()
+	safeHandler := NewSafeIOStreamHandler(stream, ep, func(ctx context.Context, rc io.ReadCloser) error {
+		bs, _ := ioutil.ReadAll(rc)
+		if string(bs) == "3" {
+			return handlerErr
+		}
+		return nil
+	}, nil)
+	_, outputErr := safeHandler.BuildStream()
+	safeHandler.Start()
+
+	err := outputErr.Get()
+	assert.True(t, errors.Is(err, handlerErr))
+	streamErr := &StreamError{}
+	assert.True(t, errors.As(err, &streamErr))
+	assert.Equal(t, StageHandler, streamErr.Stage)
+	assert.Equal(t, 2, streamErr.Index)
+	safeHandler.Wait()
+
+	// producer
+	producerErr := errors.New("producer failed")
+	_, errs := Collect(NewSafeIOStreamWriter(&failAtProducer{p: newStringProducer("a", "b", "c"), failAt: 2, err: producerErr}).Start())
+	assert.Len(t, errs, 1)
+	err = errs[0]
+	assert.True(t, errors.As(err, &streamErr))
+	assert.Equal(t, StageProducer, streamErr.Stage)
+	assert.Equal(t, 2, streamErr.Index)
+	assert.Equal(t, producerErr, streamErr.Unwrap())
+
+}
+
+// failAtProducer fails at the `failAt`th call of Next, which is zero-based.
+type failAtProducer struct {
+	p      DatapackProducer
+	calls  int
+	failAt int
+	err    error
+}
+
+func (f *failAtProducer) Next() (datapack Datapack, hasNext bool, err error) {
+	defer func() { f.calls++ }()
+	if f.calls == f.failAt {
+		return nil, false, f.err
+	}
+	return f.p.Next()
+}
+
+func TestContinueOnPanic(t *testing.T) {
+
+	for _, timeout := range []time.Duration{0, time.Second} {
+		handled := make([]string, 0)
+		stream, ep := NewSafeIOStreamWriter(&countProducer{cnt: 5}).Start()
+		safeHandler := NewSafeIOStreamHandler(stream, ep, func(ctx context.Context, rc io.ReadCloser) error {
+			bs, _ := ioutil.ReadAll(rc)
+			if string(bs) == "2" || string(bs) == "4" {
+				panic("bad datapack " + string(bs))
+			}
+			handled = append(handled, string(bs))
+			return nil
+		}, nil, WithContinueOnPanic(true), WithHandlerTimeout(timeout))
+		_, outputErr := safeHandler.BuildStream()
+		safeHandler.Start()
+
+		errs := outputErr.Drain()
+		safeHandler.Wait()
+
+		assert.Equal(t, []string{"1", "3", "5"}, handled)
+		assert.Len(t, errs, 2)
+		assert.Contains(t, errs[0].Error(), "bad datapack 2")
+		assert.Contains(t, errs[1].Error(), "bad datapack 4")
+	}
+
+}
+
+func TestHandlerPanicKeepsInputErrors(t *testing.T) {
+
+	upstreamErr := errors.New("upstream err")
+	for _, workers := range []int{1, 4} {
+		inputErr := NewErrorPasserWithCap(1)
+		inputErr.Put(upstreamErr)
+		inputStream := NewClosedIOStream(newStringDatapack("a"), newStringDatapack("b"))
+		safeHandler := NewParallelIOStreamHandler(inputStream, inputErr, func(context.Context, io.ReadCloser) error {
+			panic("handler panic")
+		}, nil, workers)
+		_, outputErr := safeHandler.BuildStream()
+		safeHandler.Start()
+
+		// the upstream closes inputErr after the handler has panicked
+		time.Sleep(time.Millisecond * 50)
+		inputErr.Close()
+		safeHandler.Wait()
+
+		errs := outputErr.Drain()
+		assert.Contains(t, errs, upstreamErr)
+		var streamErr *StreamError
+		assert.True(t, errors.As(errs[0], &streamErr))
+		assert.Contains(t, errs[0].Error(), "handler panic")
+	}
+
+}
+
+func TestContinueOnError(t *testing.T) {
+
+	var attempted int32
+	stream, ep := NewSafeIOStreamWriter(&countProducer{cnt: 6}).Start()
+	safeHandler := NewSafeIOStreamHandler(stream, ep, func(ctx context.Context, rc io.ReadCloser) error {
+		atomic.AddInt32(&attempted, 1)
+		bs, _ := ioutil.ReadAll(rc)
+		if string(bs) != "3" {
+			return fmt.Errorf("failed on %s", bs)
+		}
+		return nil
+	}, nil, WithContinueOnError(true))
+	_, outputErr := safeHandler.BuildStream()
+	safeHandler.Start()
+
+	errs := outputErr.Drain()
+	assert.Equal(t, int32(6), atomic.LoadInt32(&attempted))
+	assert.Len(t, errs, 5)
+	for i, idx := range []int{0, 1, 3, 4, 5} {
+		streamErr := &StreamError{}
+		assert.True(t, errors.As(errs[i], &streamErr))
+		assert.Equal(t, idx, streamErr.Index)
+	}
+
+}
+
+func TestHandlerRetry(t *testing.T) {
+
+	errTransient, errFatal := errors.New("503"), errors.New("400")
+	backoffs := make([]int, 0)
+	backoff := func(attempt int) time.Duration {
+		backoffs = append(backoffs, attempt)
+		return time.Millisecond
+	}
+
+	// fails twice then succeeds, every attempt reads the whole content
+	attempts := 0
+	safeHandler := NewTransformIOStreamHandler(NewClosedIOStream(newStringDatapack("hello")), NewClosedErrorPasser(),
+		func(ctx context.Context, rc io.ReadCloser) (Datapack, error) {
+			bs, _ := ioutil.ReadAll(rc)
+			assert.Equal(t, "hello", string(bs))
+			if attempts++; attempts <= 2 {
+				return nil, errTransient
+			}
+			return newStringDatapack("ok"), nil
+		}, nil, WithHandlerRetry(3, backoff, nil))
+	outputStream, outputErr := safeHandler.BuildStream()
+	safeHandler.Start()
+
+	assert.Equal(t, []string{"ok"}, readStrings(t, outputStream))
+	assert.Empty(t, outputErr.Drain())
+	assert.Equal(t, 3, attempts)
+	assert.Equal(t, []int{1, 2}, backoffs)
+
+	// always fails, only the last error is reported
+	attempts = 0
+	safeHandler = NewSafeIOStreamHandler(NewClosedIOStream(newStringDatapack("a"), newStringDatapack("b")),
+		NewClosedErrorPasser(), func(ctx context.Context, rc io.ReadCloser) error {
+			attempts++
+			return fmt.Errorf("attempt %d, %w", attempts, errTransient)
+		}, nil, WithHandlerRetry(3, nil, nil), WithContinueOnError(true))
+	_, outputErr = safeHandler.BuildStream()
+	safeHandler.Start()
+
+	errs := outputErr.Drain()
+	assert.Equal(t, 6, attempts)
+	assert.Len(t, errs, 2)
+	assert.True(t, errors.Is(errs[0], errTransient))
+	assert.Contains(t, errs[0].Error(), "attempt 3")
+	assert.Contains(t, errs[1].Error(), "attempt 6")
+
+	// a non-retryable error is reported at once
+	attempts = 0
+	safeHandler = NewSafeIOStreamHandler(NewClosedIOStream(newStringDatapack("a")), NewClosedErrorPasser(),
+		func(ctx context.Context, rc io.ReadCloser) error {
+			attempts++
+			return errFatal
+		}, nil, WithHandlerRetry(3, nil, func(err error) bool {
+			return errors.Is(err, errTransient)
+		}))
+	_, outputErr = safeHandler.BuildStream()
+	safeHandler.Start()
+
+	errs = outputErr.Drain()
+	assert.Equal(t, 1, attempts)
+	assert.Len(t, errs, 1)
+	assert.True(t, errors.Is(errs[0], errFatal))
+
+}
+
+func TestSkipExpired(t *testing.T) {
+
+	expired, cancel := context.WithCancel(context.Background())
+	cancel()
+	newInput := func() (*IOStream, *closeRecorder) {
+		rc := &closeRecorder{Reader: bytes.NewBufferString("expired")}
+		return NewClosedIOStream(newStringDatapack("a"), NewSimpleDatapack(expired, rc), newStringDatapack("b")), rc
+	}
+
+	for _, skip := range []bool{true, false} {
+		handled := make([]string, 0)
+		inputStream, rc := newInput()
+		safeHandler := NewSafeIOStreamHandler(inputStream, NewClosedErrorPasser(), func(ctx context.Context, rc io.ReadCloser) error {
+			bs, _ := ioutil.ReadAll(rc)
+			handled = append(handled, string(bs))
+			return nil
+		}, nil, WithContinueOnError(true), WithSkipExpired(skip))
+		_, outputErr := safeHandler.BuildStream()
+		safeHandler.Start()
+
+		errs := outputErr.Drain()
+		if !skip {
+			assert.Equal(t, []string{"a", "expired", "b"}, handled)
+			assert.Empty(t, errs)
+			continue
+		}
+		assert.Equal(t, []string{"a", "b"}, handled)
+		assert.True(t, rc.closed)
+		assert.Len(t, errs, 1)
+		streamErr := &StreamError{}
+		assert.True(t, errors.As(errs[0], &streamErr))
+		assert.Equal(t, 1, streamErr.Index)
+		assert.True(t, errors.Is(errs[0], context.Canceled))
+	}
+
+	// without WithContinueOnError the handler stops at the expired datapack
+	handled := 0
+	inputStream, _ := newInput()
+	safeHandler := NewSafeIOStreamHandler(inputStream, NewClosedErrorPasser(), func(context.Context, io.ReadCloser) error {
+		handled++
+		return nil
+	}, nil)
+	_, outputErr := safeHandler.BuildStream()
+	safeHandler.Start()
+
+	errs := outputErr.Drain()
+	assert.Equal(t, 1, handled)
+	assert.Len(t, errs, 1)
+	assert.True(t, errors.Is(errs[0], context.Canceled))
+
+}
+
+func TestHandlerPause(t *testing.T) {
+
+	goroutineCnt := runtime.NumGoroutine()
+
+	var handled int32
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, ep := NewSafeIOStreamWriter(&countProducer{cnt: math.MaxInt32}).Start()
+	safeHandler := NewParallelIOStreamHandler(stream, ep, func(context.Context, io.ReadCloser) error {
+		atomic.AddInt32(&handled, 1)
+		time.Sleep(time.Millisecond)
+		return nil
+	}, nil, 2)
+	_, outputErr := safeHandler.BuildStream()
+
+	// paused before Start, nothing is handled
+	safeHandler.Pause()
+	safeHandler.Pause()
+	assert.True(t, safeHandler.Paused())
+	safeHandler.StartWithContext(ctx)
+	time.Sleep(time.Millisecond * 100)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&handled))
+
+	safeHandler.Resume()
+	assert.False(t, safeHandler.Paused())
+	time.Sleep(time.Millisecond * 100)
+	assert.Greater(t, atomic.LoadInt32(&handled), int32(0))
+
+	// the in-flight calls finish after Pause, then no more calls
+	safeHandler.Pause()
+	time.Sleep(time.Millisecond * 50)
+	paused := atomic.LoadInt32(&handled)
+	time.Sleep(time.Millisecond * 100)
+	assert.Equal(t, paused, atomic.LoadInt32(&handled))
+
+	safeHandler.Resume()
+	safeHandler.Resume()
+	time.Sleep(time.Millisecond * 100)
+	assert.Greater(t, atomic.LoadInt32(&handled), paused)
+
+	// a paused handler can still be canceled
+	safeHandler.Pause()
+	cancel()
+	select {
+	case <-safeHandler.Done():
+	case <-time.After(time.Second * 3):
+		t.Fatal("paused handler is not canceled")
+	}
+	assert.Equal(t, []error{context.Canceled}, outputErr.Drain())
+	assertNoGoroutineLeak(t, goroutineCnt)
+
+}
+
+func TestProducedAndHandled(t *testing.T) {
+
+	writer := NewSafeIOStreamWriter(&countProducer{cnt: 20})
+	assert.Equal(t, int64(0), writer.Produced())
+	stream, ep := writer.Start()
+
+	// the odd ones fail
+	safeHandler := NewParallelIOStreamHandler(stream, ep, func(ctx context.Context, rc io.ReadCloser) error {
+		bs, _ := ioutil.ReadAll(rc)
+		if n, _ := strconv.Atoi(string(bs)); n%2 == 1 {
+			return errors.New("odd")
+		}
+		return nil
+	}, nil, 4, WithContinueOnError(true), WithOutputErrCap(20))
+	_, outputErr := safeHandler.BuildStream()
+	safeHandler.Start()
+
+	// the counters can be read while running
+	t.Logf("produced = %d, handled = %d", writer.Produced(), safeHandler.Handled())
+
+	safeHandler.Wait()
+	writer.Wait()
+	assert.Len(t, outputErr.Drain(), 10)
+	assert.Equal(t, int64(20), writer.Produced())
+	assert.Equal(t, int64(10), safeHandler.Handled())
+
+}
+
+func TestLastActivity(t *testing.T) {
+
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	stream := NewIOStreamWithCap(0)
+	safeHandler := NewSafeIOStreamHandler(stream, NewClosedErrorPasser(), func(ctx context.Context, rc io.ReadCloser) error {
+		return rc.Close()
+	}, nil, WithClock(clock))
+	assert.True(t, safeHandler.LastActivity().IsZero())
+	assert.False(t, safeHandler.StalledFor(0))
+
+	safeHandler.BuildStream()
+	safeHandler.Start()
+	assert.True(t, start.Equal(safeHandler.LastActivity()))
+
+	for i := 1; i <= 3; i++ {
+		clock.Advance(time.Second)
+		stream.Write(newStringDatapack(fmt.Sprintf("%d", i)))
+		for safeHandler.Handled() < int64(i) {
+			runtime.Gosched()
+		}
+		t.Logf("handled = %d, last activity = %v", i, safeHandler.LastActivity())
+		assert.True(t, start.Add(time.Duration(i)*time.Second).Equal(safeHandler.LastActivity()))
+	}
+
+	// idle, the last activity stays put while the clock goes on
+	clock.Advance(5 * time.Second)
+	assert.True(t, start.Add(3*time.Second).Equal(safeHandler.LastActivity()))
+	assert.True(t, safeHandler.StalledFor(5*time.Second))
+	assert.False(t, safeHandler.StalledFor(6*time.Second))
+
+	stream.Close()
+	safeHandler.Wait()
+
+}
+
+func TestSetWorkers(t *testing.T) {
+
+	stream := NewIOStreamWithCap(100)
+	go func() {
+		for i := 0; i < 100; i++ {
+			stream.Write(newStringDatapack(strconv.Itoa(i)))
+		}
+		stream.Close()
+	}()
+
+	var cur, peak int64
+	mu, seen := &sync.Mutex{}, make(map[string]int)
+	safeHandler := NewParallelIOStreamHandler(stream, NewClosedErrorPasser(), func(ctx context.Context, rc io.ReadCloser) error {
+		n := atomic.AddInt64(&cur, 1)
+		defer atomic.AddInt64(&cur, -1)
+		for p := atomic.LoadInt64(&peak); n > p && !atomic.CompareAndSwapInt64(&peak, p, n); p = atomic.LoadInt64(&peak) {
+		}
+		bs, _ := ioutil.ReadAll(rc)
+		mu.Lock()
+		seen[string(bs)]++
+		mu.Unlock()
+		time.Sleep(2 * time.Millisecond)
+		return nil
+	}, nil, 1)
+	_, outputErr := safeHandler.BuildStream()
+	safeHandler.Start()
+
+	waitHandled := func(n int64) {
+		for safeHandler.Handled() < n {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	alive := func() int {
+		safeHandler.mu.Lock()
+		defer safeHandler.mu.Unlock()
+		return safeHandler.alive
+	}
+
+	// scale up
+	waitHandled(10)
+	assert.Equal(t, int64(1), atomic.LoadInt64(&peak))
+	safeHandler.SetWorkers(4)
+	assert.Equal(t, 4, safeHandler.Workers())
+	waitHandled(50)
+	t.Logf("peak after scaling up = %d", atomic.LoadInt64(&peak))
+	assert.Greater(t, atomic.LoadInt64(&peak), int64(1))
+
+	// scale down, the surplus workers retire after their in-flight calls
+	safeHandler.SetWorkers(0)
+	assert.Equal(t, 1, safeHandler.Workers())
+	for alive() > 1 {
+		time.Sleep(time.Millisecond)
+	}
+	atomic.StoreInt64(&peak, 0)
+
+	safeHandler.Wait()
+	assert.Empty(t, outputErr.Drain())
+	assert.LessOrEqual(t, atomic.LoadInt64(&peak), int64(1))
+	assert.Equal(t, int64(100), safeHandler.Handled())
+	// nothing dropped or handled twice
+	assert.Len(t, seen, 100)
+	for str, cnt := range seen {
+		assert.Equal(t, 1, cnt, str)
+	}
+
+	// a no-op after the handler stops
+	safeHandler.SetWorkers(8)
+	assert.Equal(t, 0, alive())
+
+}
+
+func TestHandlerStartWithoutBuildStream(t *testing.T) {
+
+	finalized := false
+	finalizer := func() {
+		finalized = true
+	}
+
+	// no handler, Start is a no-op and the input is left as is
+	input := NewClosedIOStream(newStringDatapack("a"))
+	safeHandler := NewSafeIOStreamHandler(input, NewClosedErrorPasser(), nil, finalizer)
+	assert.NotPanics(t, safeHandler.Start)
+	safeHandler.Wait()
+	assert.False(t, finalized)
+	outputStream, _ := safeHandler.BuildStream()
+	assert.Equal(t, input, outputStream)
+	assert.Equal(t, []string{"a"}, readStrings(t, input))
+
+	// no input
+	safeHandler = NewSafeIOStreamHandler(nil, nil, func(context.Context, io.ReadCloser) error {
+		return nil
+	}, finalizer)
+	assert.NotPanics(t, safeHandler.Start)
+	safeHandler.Wait()
+	assert.False(t, finalized)
+
+	// BuildStream is called by Start
+	handled := make([]string, 0)
+	safeHandler = NewSafeIOStreamHandler(
+		NewClosedIOStream(newStringDatapack("a"), newStringDatapack("b")),
+		NewClosedErrorPasser(errors.New("upstream err")),
+		func(ctx context.Context, rc io.ReadCloser) error {
+			bs, _ := ioutil.ReadAll(rc)
+			handled = append(handled, string(bs))
+			return nil
+		}, finalizer)
+	assert.NotPanics(t, safeHandler.Start)
+	safeHandler.Wait()
+	assert.True(t, finalized)
+	assert.Equal(t, []string{"a", "b"}, handled)
+	assert.Equal(t, []error{errors.New("upstream err")}, safeHandler.outputErr.Drain())
+
+}
+
+func TestFatalError(t *testing.T) {
+
+	errFatal, errTransient := errors.New("bad config"), errors.New("503")
+	attempts := make(map[string]int)
+	safeHandler := NewSafeIOStreamHandler(
+		NewClosedIOStream(newStringDatapack("1"), newStringDatapack("2"), newStringDatapack("3")),
+		NewClosedErrorPasser(),
+		func(ctx context.Context, rc io.ReadCloser) error {
+			bs, _ := ioutil.ReadAll(rc)
+			attempts[string(bs)]++
+			switch string(bs) {
+			case "1":
+				return errTransient
+			case "2":
+				return MarkFatal(errFatal)
+			}
+			return nil
+		}, nil, WithContinueOnError(true), WithHandlerRetry(2, nil, nil))
+	_, outputErr := safeHandler.BuildStream()
+	safeHandler.Start()
+
+	// the non-fatal error is retried, collected and skipped, while the fatal one is not retried and aborts
+	errs := outputErr.Drain()
+	assert.Equal(t, map[string]int{"1": 2, "2": 1}, attempts)
+	assert.Len(t, errs, 2)
+	assert.True(t, errors.Is(errs[0], errTransient))
+	assert.True(t, errors.Is(errs[1], errFatal))
+	assert.True(t, IsFatal(errs[1]))
+
+}
+
+func TestHandlerStartWithContext(t *testing.T) {
+
+	goroutineCnt := runtime.NumGoroutine()
+
+	var handled int32
+	finalized := false
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, ep := NewSafeIOStreamWriter(&countProducer{cnt: math.MaxInt32}).Start()
+	safeHandler := NewParallelIOStreamHandler(stream, ep, func(ctx context.Context, rc io.ReadCloser) error {
+		if atomic.AddInt32(&handled, 1) == 10 {
+			cancel()
+		}
+		return nil
+	}, func() { finalized = true }, 2)
+	_, outputErr := safeHandler.BuildStream()
+	safeHandler.StartWithContext(ctx)
+
+	errs := outputErr.Drain()
+	safeHandler.Wait()
+
+	assert.Equal(t, []error{context.Canceled}, errs)
+	assert.True(t, finalized)
+	assertNoGoroutineLeak(t, goroutineCnt)
+
+}
+
+func TestHandlerStopWithOpenInputErr(t *testing.T) {
+
+	upstreamErr := errors.New("upstream err")
+	finalized := false
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// a long-lived upstream which never closes inputErr
+	inputStream, inputErr := NewIOStream(), NewErrorPasserWithCap(1)
+	inputErr.Put(upstreamErr)
+	inputStream.Write(newStringDatapack("a"))
+	inputStream.Close()
+
+	safeHandler := NewSafeIOStreamHandler(inputStream, inputErr, func(context.Context, io.ReadCloser) error {
+		return nil
+	}, func() { finalized = true })
+	_, outputErr := safeHandler.BuildStream()
+	safeHandler.StartWithContext(ctx)
+
+	select {
+	case <-safeHandler.Done():
+		t.Fatal("handler should wait for inputErr to be closed")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	cancel()
+	select {
+	case <-safeHandler.Done():
+	case <-time.After(time.Second * 3):
+		t.Fatal("handler is blocked by the open inputErr")
+	}
+	assert.True(t, finalized)
+	// the buffered upstream error is still passed
+	assert.Equal(t, []error{upstreamErr}, outputErr.Drain())
+
+}
+
+func TestWriterBackpressure(t *testing.T) {
+
+	for _, backpressure := range []bool{true, false} {
+		p := &countProducer{cnt: 10}
+		var calls int32
+		stream, ep := NewSafeIOStreamWriter(&callCounter{p: p, calls: &calls},
+			WithOutputStreamCap(2), WithBackpressure(backpressure)).Start()
+
+		// nobody reads, so the buffer gets full
+		time.Sleep(time.Millisecond * 100)
+		if backpressure {
+			assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+		} else {
+			assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+		}
+
+		// every read makes room for one more call
+		stream.Read()
+		time.Sleep(time.Millisecond * 100)
+		if backpressure {
+			assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+		}
+
+		datapacks, errs := Collect(stream, ep)
+		assert.Len(t, datapacks, 9)
+		assert.Empty(t, errs)
+		assert.Equal(t, int32(10), atomic.LoadInt32(&calls))
+	}
+
+}
+
+type callCounter struct {
+	p     DatapackProducer
+	calls *int32
+}
+
+func (c *callCounter) Next() (datapack Datapack, hasNext bool, err error) {
+	atomic.AddInt32(c.calls, 1)
+	return c.p.Next()
+}
+
+func TestBestEffortErrors(t *testing.T) {
+
+	var attempted int32
+	stream, ep := NewSafeIOStreamWriter(&countProducer{cnt: 10}).Start()
+	safeHandler := NewSafeIOStreamHandler(stream, ep, func(ctx context.Context, rc io.ReadCloser) error {
+		atomic.AddInt32(&attempted, 1)
+		return errors.New("always fails")
+	}, nil, WithContinueOnError(true), WithBestEffortErrors(true))
+	_, outputErr := safeHandler.BuildStream()
+	safeHandler.Start()
+
+	// nobody drains outputErr until the handling is done
+	select {
+	case <-safeHandler.Done():
+	case <-time.After(time.Second * 3):
+		t.Fatal("handler is blocked by the full error buffer")
+	}
+	assert.Equal(t, int32(10), atomic.LoadInt32(&attempted))
+	assert.Len(t, outputErr.Drain(), outputErr.Cap())
+
+}
+
+func TestOutputErrCap(t *testing.T) {
+
+	stream, ep := NewSafeIOStreamWriter(&countProducer{cnt: 100}).Start()
+	safeHandler := NewParallelIOStreamHandler(stream, ep, func(ctx context.Context, rc io.ReadCloser) error {
+		return errors.New("always fails")
+	}, nil, 4, WithContinueOnError(true), WithOutputErrCap(ep.Cap()+100))
+	_, outputErr := safeHandler.BuildStream()
+	assert.Equal(t, ep.Cap()+100, outputErr.Cap())
+	safeHandler.Start()
+
+	// nobody drains outputErr until the handling is done
+	select {
+	case <-safeHandler.Done():
+	case <-time.After(time.Second * 3):
+		t.Fatal("handler is blocked by the full error buffer")
+	}
+	assert.Len(t, outputErr.Drain(), 100)
+
+	// the default capacity
+	safeHandler = NewParallelIOStreamHandler(NewIOStream(), NewErrorPasserWithCap(3), func(context.Context, io.ReadCloser) error {
+		return nil
+	}, nil, 4)
+	_, outputErr = safeHandler.BuildStream()
+	assert.Equal(t, 3+4+1, outputErr.Cap())
+
+}
+
+func TestOrderedParallelHandler(t *testing.T) {
+
+	goroutineCnt := runtime.NumGoroutine()
+
+	var running, maxRunning int32
+	transformer := func(ctx context.Context, rc io.ReadCloser) (Datapack, error) {
+		cur := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if cur <= max || atomic.CompareAndSwapInt32(&maxRunning, max, cur) {
+				break
+			}
+		}
+		bs, _ := ioutil.ReadAll(rc)
+		// jittered latency makes the results come out of order
+		time.Sleep(time.Millisecond * time.Duration(rand.Intn(20)))
+		return newStringDatapack("out-" + string(bs)), nil
+	}
+
+	stream, ep := NewSafeIOStreamWriter(&countProducer{cnt: 100}).Start()
+	safeHandler := NewOrderedParallelHandler(stream, ep, transformer, nil, 8)
+	outputStream, outputErr := safeHandler.BuildStream()
+	safeHandler.Start()
+
+	results := readStrings(t, outputStream)
+	assert.Empty(t, outputErr.Drain())
+	assert.Len(t, results, 100)
+	for i, result := range results {
+		assert.Equal(t, fmt.Sprintf("out-%d", i+1), result)
+	}
+	assert.True(t, atomic.LoadInt32(&maxRunning) > 1)
+
+	assertNoGoroutineLeak(t, goroutineCnt)
+
+}
+
+func TestOrderedParallelHandlerSkip(t *testing.T) {
+
+	transformer := func(ctx context.Context, rc io.ReadCloser) (Datapack, error) {
+		bs, _ := ioutil.ReadAll(rc)
+		time.Sleep(time.Millisecond * time.Duration(rand.Intn(10)))
+		switch string(bs) {
+		case "3":
+			return nil, errors.New("failed on 3")
+		case "5":
+			return nil, nil
+		}
+		return newStringDatapack(string(bs)), nil
+	}
+
+	stream, ep := NewSafeIOStreamWriter(&countProducer{cnt: 8}).Start()
+	safeHandler := NewOrderedParallelHandler(stream, ep, transformer, nil, 4, WithContinueOnError(true))
+	outputStream, outputErr := safeHandler.BuildStream()
+	safeHandler.Start()
+
+	var errs []error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		errs = outputErr.Drain()
+	}()
+	assert.Equal(t, []string{"1", "2", "4", "6", "7", "8"}, readStrings(t, outputStream))
+	<-done
+	assert.Len(t, errs, 1)
+
+}
+
+func TestOrderedParallelHandlerWithErr(t *testing.T) {
+
+	goroutineCnt := runtime.NumGoroutine()
+
+	handlerErr := errors.New("handler failed")
+	transformer := func(ctx context.Context, rc io.ReadCloser) (Datapack, error) {
+		bs, _ := ioutil.ReadAll(rc)
+		time.Sleep(time.Millisecond * time.Duration(rand.Intn(10)))
+		if string(bs) == "10" {
+			return nil, handlerErr
+		}
+		return newStringDatapack(string(bs)), nil
+	}
+
+	stream, ep := NewSafeIOStreamWriter(&countProducer{cnt: 1000}).Start()
+	safeHandler := NewOrderedParallelHandler(stream, ep, transformer, nil, 4)
+	outputStream, outputErr := safeHandler.BuildStream()
+	safeHandler.Start()
+
+	results := readStrings(t, outputStream)
+	errs := outputErr.Drain()
+	t.Logf("results = %v", results)
+
+	// nothing at or after the failed one, and no gap before it
+	assert.True(t, len(results) < 10)
+	for i, result := range results {
+		assert.Equal(t, fmt.Sprintf("%d", i+1), result)
+	}
+	assert.Len(t, errs, 1)
+	assert.True(t, errors.Is(errs[0], handlerErr))
+
+	assertNoGoroutineLeak(t, goroutineCnt)
+
+}
+
+func TestTransformHandler(t *testing.T) {
+
+	transformer := func(ctx context.Context, rc io.ReadCloser) (Datapack, error) {
+		bs, err := ioutil.ReadAll(rc)
+		if err != nil {
+			return nil, err
+		}
+		if string(bs) == "2" {
+			// emits nothing
+			return nil, nil
+		}
+		return newStringDatapack("t" + string(bs)), nil
+	}
+
+	stream, ep := NewSafeIOStreamWriter(&countProducer{cnt: 4}).Start()
+	safeHandler := NewTransformIOStreamHandler(stream, ep, transformer, nil)
+	outputStream, outputErr := safeHandler.BuildStream()
+	safeHandler.Start()
+
+	assert.Equal(t, []string{"t1", "t3", "t4"}, readStrings(t, outputStream))
+	assert.Empty(t, outputErr.Drain())
+
+	// parallel
+	stream, ep = NewSafeIOStreamWriter(&countProducer{cnt: 100}).Start()
+	safeHandler = NewParallelTransformIOStreamHandler(stream, ep, transformer, nil, 4)
+	outputStream, outputErr = safeHandler.BuildStream()
+	safeHandler.Start()
+
+	assert.Len(t, readStrings(t, outputStream), 99)
+	assert.Empty(t, outputErr.Drain())
+
+}
+
+func TestSideEffectHandlerOutput(t *testing.T) {
+
+	var handled int32
+	stream, ep := NewSafeIOStreamWriter(&countProducer{cnt: 5}).Start()
+	safeHandler := NewSafeIOStreamHandler(stream, ep, func(ctx context.Context, rc io.ReadCloser) error {
+		atomic.AddInt32(&handled, 1)
+		return nil
+	}, nil)
+	outputStream, outputErr := safeHandler.BuildStream()
+	safeHandler.Start()
+
+	// the output stream is closed without any datapack once all are handled
+	datapacks, errs := Collect(outputStream, outputErr)
+	assert.Empty(t, datapacks)
+	assert.Empty(t, errs)
+	assert.Equal(t, int32(5), atomic.LoadInt32(&handled))
+
+}
+
+// sharedResource is referenced by the emitted datapacks, and released by the finalizer.
+type sharedResource struct {
+	mu       sync.Mutex
+	released bool
+}
+
+func (r *sharedResource) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.released {
+		return 0, errors.New("use after release")
+	}
+	return 0, io.EOF
+}
+
+func (r *sharedResource) release() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.released = true
+}
+
+func TestFinalizerAfterConsumed(t *testing.T) {
+
+	res := &sharedResource{}
+	transformer := func(ctx context.Context, rc io.ReadCloser) (Datapack, error) {
+		return NewSimpleDatapack(ctx, ioutil.NopCloser(res)), nil
+	}
+
+	stream, ep := NewSafeIOStreamWriter(&countProducer{cnt: 5}).Start()
+	safeHandler := NewTransformIOStreamHandler(stream, ep, transformer, res.release, WithFinalizerAfterConsumed(true))
+	outputStream, outputErr := safeHandler.BuildStream()
+	safeHandler.Start()
+
+	// a slow consumer
+	for {
+		datapack, closed := outputStream.Read()
+		if closed {
+			break
+		}
+		time.Sleep(time.Millisecond * 20)
+		_, err := ioutil.ReadAll(datapack.ReadCloser())
+		assert.Nil(t, err)
+	}
+	assert.Empty(t, outputErr.Drain())
+
+	safeHandler.Wait()
+	res.mu.Lock()
+	assert.True(t, res.released)
+	res.mu.Unlock()
+
+}
+
+type closableProducer struct {
+	DatapackProducer
+	closed int32
+}
+
+func (c *closableProducer) Close() error {
+	atomic.AddInt32(&c.closed, 1)
+	return errors.New("close failed")
+}
+
+func TestWriterAbortProducer(t *testing.T) {
+
+	// the consumer closes the stream mid-production
+	p := &closableProducer{DatapackProducer: &countProducer{cnt: math.MaxInt32}}
+	stream, ep := NewSafeIOStreamWriter(p).Start()
+	stream.Read()
+	stream.Close()
+	assert.Empty(t, ep.Drain())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&p.closed))
+
+	// canceled
+	ctx, cancel := context.WithCancel(context.Background())
+	p = &closableProducer{DatapackProducer: &countProducer{cnt: math.MaxInt32}}
+	stream, ep = NewSafeIOStreamWriter(p).StartWithContext(ctx)
+	stream.Read()
+	cancel()
+	assert.Equal(t, []error{context.Canceled}, ep.Drain())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&p.closed))
+
+	// producer error
+	p = &closableProducer{DatapackProducer: &failAtProducer{p: &countProducer{cnt: 10}, failAt: 2, err: errors.New("e")}}
+	stream, ep = NewSafeIOStreamWriter(p).Start()
+	Collect(stream, ep)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&p.closed))
+
+	// exhausted, no abort
+	p = &closableProducer{DatapackProducer: &countProducer{cnt: 3}}
+	stream, ep = NewSafeIOStreamWriter(p).Start()
+	datapacks, _ := Collect(stream, ep)
+	assert.Len(t, datapacks, 3)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&p.closed))
+
+}
+
+type panicProducer struct {
+	r interface{}
+}
+
+func (p *panicProducer) Next() (datapack Datapack, hasNext bool, err error) {
+	panic(p.r)
+}
+
+// rethrowRuntimeErrors only rethrows the programming bugs.
+func rethrowRuntimeErrors(r interface{}) bool {
+	_, ok := r.(runtime.Error)
+	return ok
+}
+
+func TestPanicFilterConvert(t *testing.T) {
+
+	stream, ep := NewSafeIOStreamWriter(&panicProducer{r: "expected"}, WithPanicFilter(rethrowRuntimeErrors)).Start()
+	datapacks, errs := Collect(stream, ep)
+	assert.Empty(t, datapacks)
+	assert.Len(t, errs, 1)
+	assert.Contains(t, errs[0].Error(), "expected")
+
+	stream, ep = NewSafeIOStreamWriter(&countProducer{cnt: 3}).Start()
+	safeHandler := NewSafeIOStreamHandler(stream, ep, func(ctx context.Context, rc io.ReadCloser) error {
+		panic("expected")
+	}, nil, WithPanicFilter(rethrowRuntimeErrors))
+	_, outputErr := safeHandler.BuildStream()
+	safeHandler.Start()
+	errs = outputErr.Drain()
+	assert.Len(t, errs, 1)
+	assert.Contains(t, errs[0].Error(), "expected")
+
+}
+
+func TestPanicFilterRethrow(t *testing.T) {
+
+	// the rethrown panic crashes the process, so run the stage in a subprocess
+	switch os.Getenv("STREAM_TEST_RETHROW") {
+	case "writer":
+		var m map[string]int
+		stream, ep := NewSafeIOStreamWriter(&callbackProducer{fn: func() { m["key"]++ }}, WithPanicFilter(rethrowRuntimeErrors)).Start()
+		Collect(stream, ep)
+		return
+	case "handler":
+		var m map[string]int
+		stream, ep := NewSafeIOStreamWriter(&countProducer{cnt: 3}).Start()
+		safeHandler := NewSafeIOStreamHandler(stream, ep, func(ctx context.Context, rc io.ReadCloser) error {
+			m["key"]++
+			return nil
+		}, nil, WithPanicFilter(rethrowRuntimeErrors))
+		_, outputErr := safeHandler.BuildStream()
+		safeHandler.Start()
+		outputErr.Drain()
+		return
+	}
+
+	for _, stage := range []string{"writer", "handler"} {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestPanicFilterRethrow$")
+		cmd.Env = append(os.Environ(), "STREAM_TEST_RETHROW="+stage)
+		out, err := cmd.CombinedOutput()
+		assert.NotNil(t, err, "%s should crash", stage)
+		assert.Contains(t, string(out), "assignment to entry in nil map", stage)
+	}
+
+}
+
+type callbackProducer struct {
+	fn func()
+}
+
+func (p *callbackProducer) Next() (datapack Datapack, hasNext bool, err error) {
+	p.fn()
+	return nil, false, nil
+}
+
+func TestMultiWriter(t *testing.T) {
+
+	goroutineCnt := runtime.NumGoroutine()
+
+	producers := []DatapackProducer{
+		newStringProducer("a1", "a2", "a3", "a4", "a5"),
+		nil,
+		newStringProducer("b1", "b2"),
+	}
+	stream, ep := NewSafeIOStreamWriterMulti(producers).Start()
+	strs := readStrings(t, stream)
+	assert.Empty(t, ep.Drain())
+
+	// the order is kept within a producer only
+	assert.Len(t, strs, 7)
+	as, bs := make([]string, 0), make([]string, 0)
+	for _, str := range strs {
+		if str[0] == 'a' {
+			as = append(as, str)
+		} else {
+			bs = append(bs, str)
+		}
+	}
+	assert.Equal(t, []string{"a1", "a2", "a3", "a4", "a5"}, as)
+	assert.Equal(t, []string{"b1", "b2"}, bs)
+
+	assertNoGoroutineLeak(t, goroutineCnt)
+
+}
+
+func TestMultiWriterErr(t *testing.T) {
+
+	producerErr := errors.New("producer failed")
+	producers := []DatapackProducer{
+		&failAtProducer{p: &countProducer{cnt: 10}, failAt: 1, err: producerErr},
+		newStringProducer("b1", "b2", "b3"),
+	}
+	stream, ep := NewSafeIOStreamWriterMulti(producers).Start()
+	datapacks, errs := Collect(stream, ep)
+
+	// the failed producer doesn't stop the other one
+	assert.Len(t, datapacks, 4)
+	assert.Len(t, errs, 1)
+	assert.True(t, errors.Is(errs[0], producerErr))
+
+}
+
+func TestWriterStop(t *testing.T) {
+
+	goroutineCnt := runtime.NumGoroutine()
+
+	p := &closableProducer{DatapackProducer: &countProducer{cnt: math.MaxInt32}}
+	writer := NewSafeIOStreamWriter(p)
+	writer.Wait()
+	stream, ep := writer.Start()
+
+	for i := 1; i <= 3; i++ {
+		datapack, closed := stream.Read()
+		assert.False(t, closed)
+		bs, _ := ioutil.ReadAll(datapack.ReadCloser())
+		assert.Equal(t, fmt.Sprintf("%d", i), string(bs))
+	}
+
+	writer.Stop()
+	writer.Stop()
+	writer.Wait()
+
+	// at most the buffered one is left, and no error
+	datapacks, errs := Collect(stream, ep)
+	assert.True(t, len(datapacks) <= 1)
+	assert.Empty(t, errs)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&p.closed))
+
+	assertNoGoroutineLeak(t, goroutineCnt)
+
+	// stopped before Start
+	writer = NewSafeIOStreamWriter(&countProducer{cnt: math.MaxInt32})
+	writer.Stop()
+	stream, ep = writer.Start()
+	writer.Wait()
+	datapacks, errs = Collect(stream, ep)
+	assert.Empty(t, datapacks)
+	assert.Empty(t, errs)
+
+}
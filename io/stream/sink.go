@@ -0,0 +1,344 @@
+package stream
+
+import (
+	"context"
+	"io"
+)
+
+// Collect blocks until both inputStream and inputErr are closed, and returns all the datapacks and errors in arrival order.
+// NOTE: errors are collected concurrently, so an upstream blocked on putting errors won't deadlock.
+func Collect(inputStream *IOStream, inputErr *ErrorPasser) ([]Datapack, []error) {
+
+	datapacks, errs := make([]Datapack, 0), make([]error, 0)
+	if inputStream == nil || inputErr == nil {
+		return datapacks, errs
+	}
+
+	errCh := make(chan []error, 1)
+	go func() {
+		errCh <- inputErr.Drain()
+	}()
+
+	for {
+		datapack, closed := inputStream.Read()
+		if closed {
+			break
+		}
+		datapacks = append(datapacks, datapack)
+	}
+
+	for _, err := range <-errCh {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return datapacks, errs
+
+}
+
+// CollectOptions configures CollectWithOptions.
+type CollectOptions struct {
+	// StopOnFirstError makes the collecting stop at the first non-nil error,
+	// otherwise all the datapacks and errors are drained, which is the default.
+	StopOnFirstError bool
+}
+
+// CollectWithOptions is the same as Collect, but follows opts.
+// With StopOnFirstError, once a non-nil error arrives, inputStream is closed to stop the upstream,
+// and the datapacks collected so far are returned along with that single error.
+// NOTE: after stopping, the rest of inputStream and inputErr are drained in the background so the upstream is not
+// blocked, the datapacks drained there are discarded (their ReadClosers are closed) and the errors are dropped.
+func CollectWithOptions(inputStream *IOStream, inputErr *ErrorPasser, opts CollectOptions) ([]Datapack, []error) {
+
+	if !opts.StopOnFirstError {
+		return Collect(inputStream, inputErr)
+	}
+
+	datapacks, errs := make([]Datapack, 0), make([]error, 0)
+	if inputStream == nil || inputErr == nil {
+		return datapacks, errs
+	}
+
+	dataCh, errCh := inputStream.dataCh, inputErr.errCh
+	for dataCh != nil || errCh != nil {
+		select {
+		case datapack, ok := <-dataCh:
+			inputStream.onRead(ok)
+			if !ok {
+				dataCh = nil
+				continue
+			}
+			datapacks = append(datapacks, datapack)
+		case err, ok := <-errCh:
+			if !ok {
+				errCh = nil
+				continue
+			}
+			if err == nil {
+				continue
+			}
+			inputStream.Close()
+			// both are drained at the same time, since the upstream may block on either of them
+			go func() {
+				for {
+					datapack, closed := inputStream.Read()
+					if closed {
+						return
+					}
+					discard(datapack)
+				}
+			}()
+			go inputErr.Drain()
+			return datapacks, append(errs, err)
+		}
+	}
+
+	return datapacks, errs
+
+}
+
+// CollectN is the same as Collect, but collects at most max datapacks, then closes inputStream to stop the upstream,
+// truncated reports whether there was any datapack beyond max, max < 0 is treated as 0.
+// NOTE: the datapacks beyond max (those still buffered in inputStream after it's closed) are discarded,
+// and their ReadClosers are closed.
+func CollectN(inputStream *IOStream, inputErr *ErrorPasser, max int) (datapacks []Datapack, errs []error, truncated bool) {
+
+	datapacks, errs = make([]Datapack, 0), make([]error, 0)
+	if inputStream == nil || inputErr == nil {
+		return datapacks, errs, false
+	}
+
+	errCh := make(chan []error, 1)
+	go func() {
+		errCh <- inputErr.Drain()
+	}()
+
+	for {
+		datapack, closed := inputStream.Read()
+		if closed {
+			break
+		}
+		if len(datapacks) < max {
+			datapacks = append(datapacks, datapack)
+			continue
+		}
+		truncated = true
+		inputStream.Close()
+		discard(datapack)
+	}
+
+	for _, err := range <-errCh {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return datapacks, errs, truncated
+
+}
+
+// Reduce folds inputStream into a single result, fn is called for each datapack in order with the accumulator so far,
+// starting from init, and returns the next one, the final accumulator and all the errors are returned after both
+// inputStream and inputErr are closed. The ReadCloser of each datapack is closed after fn returns.
+// NOTE: this package sticks to go1.16, so the accumulator is an interface{}, which should be asserted by the caller.
+// An error from fn is put into errs as a StreamError, and stops the reducing as well as the upstream, the accumulator
+// before the failed call is returned, and the datapacks left in inputStream are discarded.
+func Reduce(inputStream *IOStream, inputErr *ErrorPasser, init interface{},
+	fn func(acc interface{}, datapack Datapack) (interface{}, error)) (interface{}, []error) {
+
+	acc, errs := init, make([]error, 0)
+	if inputStream == nil || inputErr == nil {
+		return acc, errs
+	}
+
+	errCh := make(chan []error, 1)
+	go func() {
+		errCh <- inputErr.Drain()
+	}()
+
+	var reduceErr error
+	for idx := 0; ; idx++ {
+		datapack, closed := inputStream.Read()
+		if closed {
+			break
+		}
+		if reduceErr != nil {
+			discard(datapack)
+			continue
+		}
+		next, err := fn(acc, datapack)
+		discard(datapack)
+		if err != nil {
+			reduceErr = NewStreamError(StageHandler, idx, err)
+			inputStream.Close()
+			continue
+		}
+		acc = next
+	}
+
+	for _, err := range <-errCh {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if reduceErr != nil {
+		errs = append(errs, reduceErr)
+	}
+
+	return acc, errs
+
+}
+
+// ToChannel forwards the datapacks from inputStream and the non-nil errors from inputErr onto two unbuffered channels,
+// each of them is closed once its source is closed, so they can be ranged over, a nil input gives closed channels.
+// NOTE: each source is forwarded by its own goroutine, which exits after its source is closed and the last item
+// is received, so consume both channels (e.g. in a select, or in two goroutines) until they're closed,
+// an abandoned channel blocks its goroutine and, once the buffer is full, the upstream as well.
+func ToChannel(inputStream *IOStream, inputErr *ErrorPasser) (<-chan Datapack, <-chan error) {
+
+	datapackCh, errCh := make(chan Datapack), make(chan error)
+	if inputStream == nil || inputErr == nil {
+		close(datapackCh)
+		close(errCh)
+		return datapackCh, errCh
+	}
+
+	go func() {
+		defer close(datapackCh)
+		for {
+			datapack, closed := inputStream.Read()
+			if closed {
+				return
+			}
+			datapackCh <- datapack
+		}
+	}()
+
+	go func() {
+		defer close(errCh)
+		for err := range inputErr.errCh {
+			if err != nil {
+				errCh <- err
+			}
+		}
+	}()
+
+	return datapackCh, errCh
+
+}
+
+// NullSink reads and discards everything from inputStream (closing the ReadCloser of each datapack) and inputErr,
+// the returned channel is closed once both of them are closed, a nil input gives a closed channel.
+func NullSink(inputStream *IOStream, inputErr *ErrorPasser) <-chan struct{} {
+
+	done := make(chan struct{})
+	if inputStream == nil || inputErr == nil {
+		close(done)
+		return done
+	}
+
+	go func() {
+		defer close(done)
+		errDone := make(chan struct{})
+		go func() {
+			defer close(errDone)
+			for range inputErr.errCh {
+			}
+		}()
+		for {
+			datapack, closed := inputStream.Read()
+			if closed {
+				break
+			}
+			discard(datapack)
+		}
+		<-errDone
+	}()
+
+	return done
+
+}
+
+// ForEachParallel runs fn for every datapack from inputStream in a pool of `workers` goroutines, so at most `workers`
+// calls run at the same time, it blocks until inputStream is drained and inputErr is closed, and returns all the errors
+// from fn (as StreamErrors, a panic included) and inputErr, a nil input gives no error.
+// NOTE: unlike SafeIOStreamHandler, the ReadCloser of each datapack is closed after fn returns,
+// and a failed fn doesn't stop the others.
+func ForEachParallel(inputStream *IOStream, inputErr *ErrorPasser, workers int,
+	fn func(ctx context.Context, rc io.ReadCloser) error) []error {
+
+	errs := make([]error, 0)
+	if inputStream == nil || inputErr == nil {
+		return errs
+	}
+
+	safeHandler := NewParallelIOStreamHandler(inputStream, inputErr, func(ctx context.Context, rc io.ReadCloser) error {
+		defer rc.Close()
+		return fn(ctx, rc)
+	}, nil, workers, WithContinueOnError(true), WithContinueOnPanic(true))
+	_, outputErr := safeHandler.BuildStream()
+	safeHandler.Start()
+
+	for _, err := range outputErr.Drain() {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+
+}
+
+// WriteToWriter copies the content of every datapack from inputStream into w and closes its ReadCloser,
+// it returns the bytes written and the first error got from copying or inputErr.
+// NOTE: after a copying error, inputStream is closed and the rest datapacks are only closed without copying.
+func WriteToWriter(inputStream *IOStream, inputErr *ErrorPasser, w io.Writer) (int64, error) {
+
+	if inputStream == nil || inputErr == nil {
+		return 0, nil
+	}
+
+	errCh := make(chan []error, 1)
+	go func() {
+		errCh <- inputErr.Drain()
+	}()
+
+	var written int64
+	var copyErr error
+
+	for {
+		datapack, closed := inputStream.Read()
+		if closed {
+			break
+		}
+		rc := datapack.ReadCloser()
+		if rc == nil {
+			continue
+		}
+		if copyErr == nil {
+			var n int64
+			n, copyErr = io.Copy(w, rc)
+			written += n
+			if copyErr != nil {
+				inputStream.Close()
+			}
+		}
+		if err := rc.Close(); err != nil && copyErr == nil {
+			copyErr = err
+			inputStream.Close()
+		}
+	}
+
+	errs := <-errCh
+	if copyErr != nil {
+		return written, copyErr
+	}
+	for _, err := range errs {
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+
+}
@@ -0,0 +1,17 @@
+package stream
+
+import (
+	"context"
+	"testing"
+)
+
+func BenchmarkNullSink(b *testing.B) {
+	datapacks := make([]Datapack, b.N)
+	for i := range datapacks {
+		datapacks[i] = NewBytesDatapack(context.Background(), payload)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	stream, ep := NewSafeIOStreamWriter(NewSliceDatapackProducer(datapacks)).Start()
+	<-NullSink(stream, ep)
+}
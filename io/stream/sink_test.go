@@ -0,0 +1,372 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollect(t *testing.T) {
+
+	// unbuffered, so the writer must interleave datapacks and errors
+	stream, ep := NewIOStreamWithCap(0), NewErrorPasserWithCap(0)
+	go func() {
+		for i := 0; i < 5; i++ {
+			stream.Write(newStringDatapack(fmt.Sprintf("%d", i)))
+			ep.Put(fmt.Errorf("err %d", i))
+		}
+		stream.Close()
+		ep.Close()
+	}()
+
+	datapacks, errs := Collect(stream, ep)
+	assert.Len(t, datapacks, 5)
+	assert.Len(t, errs, 5)
+	for i := range datapacks {
+		bs, err := ioutil.ReadAll(datapacks[i].ReadCloser())
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprintf("%d", i), string(bs))
+		assert.Equal(t, fmt.Sprintf("err %d", i), errs[i].Error())
+	}
+
+	datapacks, errs = Collect(NewClosedIOStream(), NewClosedErrorPasser(errors.New("upstream err")))
+	assert.Empty(t, datapacks)
+	assert.Equal(t, []error{errors.New("upstream err")}, errs)
+
+}
+
+func TestCollectWithOptions(t *testing.T) {
+
+	goroutineCnt := runtime.NumGoroutine()
+
+	// unbuffered, so the writer must interleave datapacks and errors: 0, err 0, 1, err 1, ...
+	interleaved := func() (*IOStream, *ErrorPasser) {
+		stream, ep := NewIOStreamWithCap(0), NewErrorPasserWithCap(0)
+		go func() {
+			for i := 0; i < 5; i++ {
+				stream.Write(newStringDatapack(fmt.Sprintf("%d", i)))
+				ep.Put(fmt.Errorf("err %d", i))
+			}
+			stream.Close()
+			ep.Close()
+		}()
+		return stream, ep
+	}
+
+	// drains everything by default
+	stream, ep := interleaved()
+	datapacks, errs := CollectWithOptions(stream, ep, CollectOptions{})
+	assert.Len(t, datapacks, 5)
+	assert.Len(t, errs, 5)
+
+	stream, ep = interleaved()
+	datapacks, errs = CollectWithOptions(stream, ep, CollectOptions{StopOnFirstError: true})
+	t.Logf("collected %d datapacks, errs = %v", len(datapacks), errs)
+	assert.Len(t, datapacks, 1)
+	bs, err := ReadAllAndClose(datapacks[0])
+	assert.Nil(t, err)
+	assert.Equal(t, "0", string(bs))
+	assert.Equal(t, []error{errors.New("err 0")}, errs)
+
+	// the upstream is stopped, and nothing is left blocked
+	assert.True(t, stream.isClosed())
+	assertNoGoroutineLeak(t, goroutineCnt)
+
+	// no error, everything is collected
+	datapacks, errs = CollectWithOptions(NewClosedIOStream(newStringDatapack("a"), newStringDatapack("b")),
+		NewClosedErrorPasser(nil), CollectOptions{StopOnFirstError: true})
+	assert.Len(t, datapacks, 2)
+	assert.Empty(t, errs)
+
+}
+
+func TestCollectN(t *testing.T) {
+
+	newInput := func(n int) (*IOStream, *ErrorPasser, []*closeRecorder) {
+		stream, ep := NewIOStreamWithCap(n), NewClosedErrorPasser(errors.New("upstream err"))
+		rcs := make([]*closeRecorder, n)
+		for i := 0; i < n; i++ {
+			rcs[i] = &closeRecorder{Reader: bytes.NewBufferString(fmt.Sprintf("%d", i))}
+			stream.Write(NewSimpleDatapack(context.Background(), rcs[i]))
+		}
+		stream.Close()
+		return stream, ep, rcs
+	}
+
+	for _, c := range []struct {
+		n, max    int
+		collected int
+		truncated bool
+	}{
+		{n: 3, max: 3, collected: 3, truncated: false},
+		{n: 2, max: 3, collected: 2, truncated: false},
+		{n: 5, max: 3, collected: 3, truncated: true},
+		{n: 2, max: 0, collected: 0, truncated: true},
+	} {
+		stream, ep, rcs := newInput(c.n)
+		datapacks, errs, truncated := CollectN(stream, ep, c.max)
+		t.Logf("n = %d, max = %d, collected = %d, truncated = %v", c.n, c.max, len(datapacks), truncated)
+		assert.Len(t, datapacks, c.collected)
+		assert.Equal(t, c.truncated, truncated)
+		assert.Equal(t, []error{errors.New("upstream err")}, errs)
+		for i := range datapacks {
+			bs, err := ioutil.ReadAll(datapacks[i].ReadCloser())
+			assert.Nil(t, err)
+			assert.Equal(t, fmt.Sprintf("%d", i), string(bs))
+		}
+		// the datapacks beyond max are closed, the collected ones are left to the caller
+		for i := range rcs {
+			assert.Equal(t, i >= c.collected, rcs[i].closed)
+		}
+	}
+
+	// the upstream is stopped once max is exceeded
+	stream, ep := NewIOStreamWithCap(0), NewErrorPasserWithCap(0)
+	go func() {
+		defer ep.Close()
+		for i := 0; ; i++ {
+			if stream.Write(newStringDatapack(fmt.Sprintf("%d", i))) {
+				return
+			}
+		}
+	}()
+	datapacks, errs, truncated := CollectN(stream, ep, 2)
+	assert.Len(t, datapacks, 2)
+	assert.Empty(t, errs)
+	assert.True(t, truncated)
+
+}
+
+func TestReduce(t *testing.T) {
+
+	sumLen := func(acc interface{}, datapack Datapack) (interface{}, error) {
+		bs, err := ioutil.ReadAll(datapack.ReadCloser())
+		if err != nil {
+			return nil, err
+		}
+		if string(bs) == "bad" {
+			return nil, errors.New("bad datapack")
+		}
+		return acc.(int) + len(bs), nil
+	}
+
+	stream, ep := NewSafeIOStreamWriter(newStringProducer("a", "bb", "ccc")).Start()
+	acc, errs := Reduce(stream, ep, 0, sumLen)
+	assert.Empty(t, errs)
+	assert.Equal(t, 6, acc)
+
+	// an error mid-reduce stops it, and the rest are discarded
+	rest := &closeRecorder{Reader: bytes.NewBufferString("dddd")}
+	acc, errs = Reduce(
+		NewClosedIOStream(newStringDatapack("a"), newStringDatapack("bb"), newStringDatapack("bad"),
+			NewSimpleDatapack(context.Background(), rest)),
+		NewClosedErrorPasser(errors.New("upstream err")),
+		0, sumLen,
+	)
+	t.Logf("acc = %v, errs = %v", acc, errs)
+	assert.Equal(t, 3, acc)
+	assert.Len(t, errs, 2)
+	assert.Equal(t, errors.New("upstream err"), errs[0])
+	var streamErr *StreamError
+	assert.True(t, errors.As(errs[1], &streamErr))
+	assert.Equal(t, 2, streamErr.Index)
+	assert.True(t, rest.closed)
+
+	// empty
+	acc, errs = Reduce(NewClosedIOStream(), NewClosedErrorPasser(), 0, sumLen)
+	assert.Equal(t, 0, acc)
+	assert.Empty(t, errs)
+
+}
+
+func TestToChannel(t *testing.T) {
+
+	goroutineCnt := runtime.NumGoroutine()
+
+	// unbuffered, so the channels must be consumed concurrently
+	stream, ep := NewIOStreamWithCap(0), NewErrorPasserWithCap(0)
+	go func() {
+		for i := 1; i <= 5; i++ {
+			stream.Write(newStringDatapack(fmt.Sprintf("%d", i)))
+			if i == 4 {
+				ep.Put(errors.New("upstream err"))
+			}
+		}
+		stream.Close()
+		ep.Put(nil)
+		ep.Close()
+	}()
+	datapackCh, errCh := ToChannel(stream, ep)
+
+	strs, errs := make([]string, 0), make([]error, 0)
+	for datapackCh != nil || errCh != nil {
+		select {
+		case datapack, ok := <-datapackCh:
+			if !ok {
+				datapackCh = nil
+				continue
+			}
+			bs, err := ReadAllAndClose(datapack)
+			assert.Nil(t, err)
+			strs = append(strs, string(bs))
+		case err, ok := <-errCh:
+			if !ok {
+				errCh = nil
+				continue
+			}
+			errs = append(errs, err)
+		}
+	}
+	assert.Equal(t, []string{"1", "2", "3", "4", "5"}, strs)
+	assert.Equal(t, []error{errors.New("upstream err")}, errs)
+	assertNoGoroutineLeak(t, goroutineCnt)
+
+	// a nil input gives closed channels
+	datapackCh, errCh = ToChannel(nil, nil)
+	for range datapackCh {
+		t.Fatal("datapackCh should be closed")
+	}
+	for range errCh {
+		t.Fatal("errCh should be closed")
+	}
+
+}
+
+func TestWriteToWriter(t *testing.T) {
+
+	buf := &bytes.Buffer{}
+	stream, ep := NewSafeIOStreamWriter(newStringProducer("hello", " ", "world")).Start()
+	n, err := WriteToWriter(stream, ep, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(11), n)
+	assert.Equal(t, "hello world", buf.String())
+
+	// upstream err
+	upstreamErr := errors.New("upstream err")
+	buf.Reset()
+	n, err = WriteToWriter(NewClosedIOStream(newStringDatapack("a")), NewClosedErrorPasser(upstreamErr), buf)
+	assert.Equal(t, upstreamErr, err)
+	assert.Equal(t, int64(1), n)
+
+}
+
+func TestWriteToFailingWriter(t *testing.T) {
+
+	rcs := make([]*closeRecorder, 0)
+	datapacks := make([]Datapack, 0)
+	for _, str := range []string{"a", "b", "c"} {
+		rc := &closeRecorder{Reader: bytes.NewBufferString(str)}
+		rcs = append(rcs, rc)
+		datapacks = append(datapacks, NewSimpleDatapack(context.Background(), rc))
+	}
+
+	writeErr := errors.New("write failed")
+	n, err := WriteToWriter(NewClosedIOStream(datapacks...), NewClosedErrorPasser(), &failingWriter{err: writeErr})
+	assert.Equal(t, writeErr, err)
+	assert.Equal(t, int64(0), n)
+	for _, rc := range rcs {
+		assert.True(t, rc.closed)
+	}
+
+}
+
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+type failingWriter struct {
+	err error
+}
+
+func (f *failingWriter) Write([]byte) (int, error) {
+	return 0, f.err
+}
+
+func TestNullSink(t *testing.T) {
+
+	rcs := make([]*closeRecorder, 0)
+	datapacks := make([]Datapack, 0)
+	for i := 0; i < 5; i++ {
+		rc := &closeRecorder{Reader: bytes.NewBufferString("a")}
+		rcs = append(rcs, rc)
+		datapacks = append(datapacks, NewSimpleDatapack(context.Background(), rc))
+	}
+	datapacks = append(datapacks, NewSimpleDatapack(context.Background(), nil), nil)
+
+	stream, ep := NewSafeIOStreamWriter(NewSliceDatapackProducer(datapacks)).Start()
+	select {
+	case <-NullSink(stream, ep):
+	case <-time.After(time.Second * 3):
+		t.Fatal("NullSink is not done")
+	}
+	for i := range rcs {
+		assert.True(t, rcs[i].closed)
+	}
+
+	<-NullSink(nil, nil)
+
+}
+
+func TestForEachParallel(t *testing.T) {
+
+	goroutineCnt := runtime.NumGoroutine()
+
+	const workers = 4
+	var running, maxRunning, handled int32
+	rcs := make([]*closeRecorder, 0)
+	datapacks := make([]Datapack, 0)
+	for i := 0; i < 40; i++ {
+		rc := &closeRecorder{Reader: bytes.NewBufferString(fmt.Sprintf("%d", i))}
+		rcs = append(rcs, rc)
+		datapacks = append(datapacks, NewSimpleDatapack(context.Background(), rc))
+	}
+	stream, ep := NewSafeIOStreamWriter(NewSliceDatapackProducer(datapacks)).Start()
+
+	errs := ForEachParallel(stream, ep, workers, func(ctx context.Context, rc io.ReadCloser) error {
+		cur := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if cur <= max || atomic.CompareAndSwapInt32(&maxRunning, max, cur) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond * 5)
+		atomic.AddInt32(&handled, 1)
+		bs, _ := ioutil.ReadAll(rc)
+		switch string(bs) {
+		case "7":
+			return errors.New("failed on 7")
+		case "9":
+			panic("panicked on 9")
+		}
+		return nil
+	})
+
+	assert.Equal(t, int32(40), atomic.LoadInt32(&handled))
+	assert.LessOrEqual(t, atomic.LoadInt32(&maxRunning), int32(workers))
+	assert.Len(t, errs, 2)
+	for i := range rcs {
+		// closed even if fn failed or panicked
+		assert.True(t, rcs[i].closed)
+	}
+	assertNoGoroutineLeak(t, goroutineCnt)
+
+	assert.Empty(t, ForEachParallel(nil, nil, workers, nil))
+
+}
@@ -0,0 +1,160 @@
+package stream
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// StreamStats accumulates the statistics of a stream monitored by Monitor, it's safe for concurrent use.
+type StreamStats struct {
+	mu         *sync.Mutex
+	datapacks  int64
+	errors     int64
+	bytes      int64
+	start, end time.Time
+}
+
+func newStreamStats() *StreamStats {
+	return &StreamStats{
+		mu:    &sync.Mutex{},
+		start: time.Now(),
+	}
+}
+
+// Datapacks returns the number of datapacks seen.
+func (s *StreamStats) Datapacks() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.datapacks
+}
+
+// Errors returns the number of non-nil errors seen.
+func (s *StreamStats) Errors() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.errors
+}
+
+// Bytes returns the total size of the datapacks seen which implement Sized, the others are not counted.
+func (s *StreamStats) Bytes() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bytes
+}
+
+// Start returns the time when Monitor is called.
+func (s *StreamStats) Start() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.start
+}
+
+// End returns the time when the monitored stream is closed and drained, it's zero before that.
+func (s *StreamStats) End() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.end
+}
+
+// Duration returns End - Start, or the time elapsed since Start if the stream is not closed yet.
+func (s *StreamStats) Duration() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.duration()
+}
+
+// Throughput returns the number of datapacks per second during Duration.
+func (s *StreamStats) Throughput() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := s.duration()
+	if d <= 0 {
+		return 0
+	}
+	return float64(s.datapacks) / d.Seconds()
+}
+
+func (s *StreamStats) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fmt.Sprintf("datapacks = %d, errors = %d, bytes = %d, duration = %v",
+		s.datapacks, s.errors, s.bytes, s.duration())
+}
+
+func (s *StreamStats) duration() time.Duration {
+	if s.end.IsZero() {
+		return time.Since(s.start)
+	}
+	return s.end.Sub(s.start)
+}
+
+func (s *StreamStats) observeDatapack(datapack Datapack) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.datapacks++
+	if sized, ok := datapack.(Sized); ok {
+		s.bytes += int64(sized.Len())
+	}
+}
+
+func (s *StreamStats) observeError() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errors++
+}
+
+func (s *StreamStats) finish() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.end = time.Now()
+}
+
+// Monitor passes datapacks and errors through untouched, while accumulating the statistics into the returned StreamStats.
+// NOTE: the statistics are final once the returned ErrorPasser is closed.
+func Monitor(inputStream *IOStream, inputErr *ErrorPasser) (*IOStream, *ErrorPasser, *StreamStats) {
+
+	if inputStream == nil || inputErr == nil {
+		return nil, nil, nil
+	}
+
+	outputStream := NewIOStream()
+	outputErr := NewErrorPasserWithCap(inputErr.Cap() + 1)
+	stats := newStreamStats()
+
+	go func() {
+
+		defer func() {
+			if r := recover(); r != nil {
+				inputStream.Close()
+				outputErr.Put(newPanicError("Monitor", r))
+			}
+			stats.finish()
+			outputErr.Close()
+			outputStream.Close()
+		}()
+
+		for {
+			datapack, closed := inputStream.readUntil(outputStream)
+			if closed {
+				break
+			}
+			stats.observeDatapack(datapack)
+			if streamClosed := outputStream.Write(datapack); streamClosed {
+				inputStream.Close()
+				break
+			}
+		}
+
+		for _, err := range inputErr.Drain() {
+			if err != nil {
+				stats.observeError()
+				outputErr.Put(err)
+			}
+		}
+
+	}()
+
+	return outputStream, outputErr, stats
+
+}
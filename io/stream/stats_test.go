@@ -0,0 +1,53 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMonitor(t *testing.T) {
+
+	datapacks := []Datapack{
+		NewBytesDatapack(context.Background(), []byte("abc")),
+		NewBytesDatapack(context.Background(), []byte("de")),
+		// not Sized
+		newStringDatapack("fghij"),
+	}
+	stream, ep, stats := Monitor(NewClosedIOStream(datapacks...), NewClosedErrorPasser(errors.New("e"), nil))
+
+	assert.True(t, stats.End().IsZero())
+	out, errs := Collect(stream, ep)
+	assert.Len(t, out, 3)
+	assert.Len(t, errs, 1)
+
+	assert.Equal(t, int64(3), stats.Datapacks())
+	assert.Equal(t, int64(1), stats.Errors())
+	assert.Equal(t, int64(5), stats.Bytes())
+	assert.False(t, stats.End().IsZero())
+	assert.Equal(t, stats.End().Sub(stats.Start()), stats.Duration())
+	assert.True(t, stats.Throughput() > 0)
+	t.Logf("stats = %v, throughput = %v", stats, stats.Throughput())
+
+	// consistent after close
+	d := stats.Duration()
+	time.Sleep(time.Millisecond * 10)
+	assert.Equal(t, d, stats.Duration())
+
+}
+
+func TestMonitorThroughput(t *testing.T) {
+
+	stream, ep := NewSafeIOStreamWriter(&slowProducer{p: &countProducer{cnt: 10}, interval: time.Millisecond * 20}).Start()
+	stream, ep, stats := Monitor(stream, ep)
+	Collect(stream, ep)
+
+	assert.Equal(t, int64(10), stats.Datapacks())
+	assert.True(t, stats.Duration() >= time.Millisecond*180)
+	// about 50 datapacks per second
+	assert.True(t, stats.Throughput() > 10 && stats.Throughput() < 60, "throughput = %v", stats.Throughput())
+
+}
@@ -0,0 +1,17 @@
+package stream
+
+import "context"
+
+// Tracer starts a span around each datapackHandler call of a SafeIOStreamHandler, it should be safe for concurrent use.
+type Tracer interface {
+	// StartSpan is called before the handler call with the context of the datapack and its zero-based index,
+	// the returned context is passed to the handler, and end is called with the result of the call,
+	// a panic is passed as an error.
+	StartSpan(ctx context.Context, idx int) (spanCtx context.Context, end func(err error))
+}
+
+type noopTracer struct{}
+
+func (noopTracer) StartSpan(ctx context.Context, _ int) (context.Context, func(error)) {
+	return ctx, func(error) {}
+}
@@ -0,0 +1,50 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTracer(t *testing.T) {
+
+	tracer := &mockTracer{ended: make(map[int]error)}
+	stream, ep := NewSafeIOStreamWriter(&countProducer{cnt: 3}).Start()
+	safeHandler := NewSafeIOStreamHandler(stream, ep, func(ctx context.Context, rc io.ReadCloser) error {
+		idx := ctx.Value(ctxKey("span")).(int)
+		if idx == 1 {
+			panic("bad datapack")
+		}
+		if idx == 2 {
+			return errors.New("handler failed")
+		}
+		return nil
+	}, nil, WithTracer(tracer), WithContinueOnPanic(true), WithContinueOnError(true))
+	_, outputErr := safeHandler.BuildStream()
+	safeHandler.Start()
+	outputErr.Drain()
+
+	assert.Len(t, tracer.ended, 3)
+	assert.Nil(t, tracer.ended[0])
+	assert.Contains(t, tracer.ended[1].Error(), "bad datapack")
+	assert.Equal(t, "handler failed", tracer.ended[2].Error())
+
+}
+
+// mockTracer puts the index into the span context, and records the error of each ended span.
+type mockTracer struct {
+	mu    sync.Mutex
+	ended map[int]error
+}
+
+func (m *mockTracer) StartSpan(ctx context.Context, idx int) (context.Context, func(error)) {
+	return context.WithValue(ctx, ctxKey("span"), idx), func(err error) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.ended[idx] = err
+	}
+}